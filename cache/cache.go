@@ -0,0 +1,47 @@
+// Copyright 2018 Adam Tauber
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cache provides the stores of the response cache of colly
+package cache
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// ErrCacheMiss is returned by Cache.Get if the key is not cached
+var ErrCacheMiss = errors.New("cache: key not found")
+
+// Cache is the interface of the response cache stores.
+// Keys are hexadecimal hashes created by Key, so they can be used as
+// file names. Implementations must be safe for concurrent use.
+type Cache interface {
+	// Get returns the value of key and the time when it was stored.
+	// It returns ErrCacheMiss if key is not cached.
+	Get(key string) (value []byte, stored time.Time, err error)
+	// Set stores the value of key
+	Set(key string, value []byte) error
+	// Delete removes key from the cache
+	Delete(key string) error
+	// Iterate calls fn for every cached key until fn returns false
+	Iterate(fn func(key string, value []byte) bool) error
+}
+
+// Key returns the cache key of u
+func Key(u string) string {
+	sum := sha1.Sum([]byte(u))
+	return hex.EncodeToString(sum[:])
+}
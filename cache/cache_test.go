@@ -0,0 +1,152 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testCache(t *testing.T, c Cache) {
+	key := Key("http://example.com/")
+	if _, _, err := c.Get(key); !errors.Is(err, ErrCacheMiss) {
+		t.Fatalf("expected ErrCacheMiss, got %v", err)
+	}
+	if err := c.Set(key, []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set(Key("http://example.com/2"), []byte("value 2")); err != nil {
+		t.Fatal(err)
+	}
+	v, stored, err := c.Get(key)
+	if err != nil || !bytes.Equal(v, []byte("value")) || stored.IsZero() {
+		t.Fatalf("unexpected value: %q %v %v", v, stored, err)
+	}
+	n := 0
+	if err := c.Iterate(func(string, []byte) bool {
+		n++
+		return true
+	}); err != nil || n != 2 {
+		t.Fatalf("expected 2 keys, got %d %v", n, err)
+	}
+	n = 0
+	c.Iterate(func(string, []byte) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Errorf("Iterate not stopped")
+	}
+	if err := c.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.Get(key); !errors.Is(err, ErrCacheMiss) {
+		t.Fatalf("expected ErrCacheMiss after Delete, got %v", err)
+	}
+	if err := c.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirCache(t *testing.T) {
+	dir := t.TempDir()
+	testCache(t, &DirCache{Path: dir})
+
+	key := Key("http://example.com/2")
+	if _, err := os.Stat(filepath.Join(dir, key[:2], key)); err != nil {
+		t.Errorf("unexpected cache layout: %v", err)
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	testCache(t, &LRUCache{})
+
+	c := &LRUCache{MaxSize: 10}
+	c.Set("a", []byte("1234"))
+	c.Set("b", []byte("1234"))
+	c.Get("a")
+	c.Set("c", []byte("1234"))
+	if _, _, err := c.Get("b"); !errors.Is(err, ErrCacheMiss) {
+		t.Error("least recently used key not evicted")
+	}
+	if c.Len() != 2 || c.Size() != 8 {
+		t.Errorf("unexpected size: %d keys, %d bytes", c.Len(), c.Size())
+	}
+	c.Set("d", []byte("12345678901"))
+	if c.Len() != 2 {
+		t.Error("value larger than MaxSize stored")
+	}
+}
+
+func TestDiskCache(t *testing.T) {
+	c := &DiskCache{Path: t.TempDir()}
+	defer c.Close()
+	testCache(t, c)
+}
+
+func TestDiskCacheCompression(t *testing.T) {
+	dir := t.TempDir()
+	c := &DiskCache{Path: dir}
+	defer c.Close()
+	value := bytes.Repeat([]byte("compressible "), 1000)
+	key := Key("http://example.com/")
+	if err := c.Set(key, value); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dir, key[:2], key+".gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() >= int64(len(value))/10 || c.Size() != info.Size() {
+		t.Errorf("value not compressed: %d bytes on disk, size %d", info.Size(), c.Size())
+	}
+	v, _, err := c.Get(key)
+	if err != nil || !bytes.Equal(v, value) {
+		t.Fatalf("unexpected value: %v", err)
+	}
+}
+
+func TestDiskCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	c := &DiskCache{Path: dir, EvictInterval: time.Hour}
+	for _, key := range []string{"a1", "b1", "c1"} {
+		if err := c.Set(key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Get("a1")
+	entrySize := c.Size() / 3
+	c.Close()
+
+	// the order of use is restored from the files
+	c = &DiskCache{Path: dir, MaxSize: 2 * entrySize, EvictInterval: time.Hour}
+	defer c.Close()
+	if c.Len() != 3 {
+		t.Fatalf("expected 3 entries, got %d", c.Len())
+	}
+	removed, err := c.Prune()
+	if err != nil || removed != 1 {
+		t.Fatalf("expected 1 removed entry, got %d %v", removed, err)
+	}
+	if _, _, err := c.Get("b1"); !errors.Is(err, ErrCacheMiss) {
+		t.Error("least recently used entry not evicted")
+	}
+
+	// background eviction
+	c.Set("d1", []byte("d1"))
+	deadline := time.Now().Add(time.Second)
+	for c.Len() > 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if c.Len() != 2 || c.Size() > c.MaxSize {
+		t.Errorf("cache not evicted in background: %d entries, %d bytes", c.Len(), c.Size())
+	}
+
+	c.MaxAge = time.Nanosecond
+	if removed, _ := c.Prune(); removed != 2 || c.Len() != 0 {
+		t.Errorf("expired entries not pruned: %d", removed)
+	}
+}
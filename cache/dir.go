@@ -0,0 +1,106 @@
+// Copyright 2018 Adam Tauber
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DirCache is a Cache which stores every key as a file under Path.
+// The file of a key is Path/key[:2]/key, which is the layout of
+// Collector.CacheDir.
+type DirCache struct {
+	// Path is the root directory of the cache
+	Path string
+}
+
+func (c *DirCache) filename(key string) (string, string) {
+	dir := filepath.Join(c.Path, key[:min(len(key), 2)])
+	return dir, filepath.Join(dir, key)
+}
+
+// Get implements Cache.Get()
+func (c *DirCache) Get(key string) ([]byte, time.Time, error) {
+	_, filename := c.filename(key)
+	info, err := os.Stat(filename)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = ErrCacheMiss
+		}
+		return nil, time.Time{}, err
+	}
+	value, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		err = ErrCacheMiss
+	}
+	return value, info.ModTime(), err
+}
+
+// Set implements Cache.Set(). The file is replaced atomically.
+func (c *DirCache) Set(key string, value []byte) error {
+	dir, filename := c.filename(key)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filename+"~", value, 0640); err != nil {
+		return err
+	}
+	return os.Rename(filename+"~", filename)
+}
+
+// Delete implements Cache.Delete()
+func (c *DirCache) Delete(key string) error {
+	_, filename := c.filename(key)
+	if err := os.Remove(filename); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Iterate implements Cache.Iterate()
+func (c *DirCache) Iterate(fn func(key string, value []byte) bool) error {
+	errStop := errors.New("stop")
+	err := filepath.WalkDir(c.Path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(d.Name(), "~") {
+			return nil
+		}
+		value, err := os.ReadFile(path)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !fn(d.Name(), value) {
+			return errStop
+		}
+		return nil
+	})
+	if err == errStop {
+		return nil
+	}
+	return err
+}
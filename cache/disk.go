@@ -0,0 +1,388 @@
+// Copyright 2018 Adam Tauber
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	diskCacheSuffix = ".gz"
+	// diskCacheHeaderSize is the size of the store time written before
+	// the compressed value
+	diskCacheHeaderSize = 8
+
+	defaultEvictInterval = time.Minute
+)
+
+// DiskCache is a Cache which stores gzip compressed values as files
+// under Path, using the layout of DirCache with a .gz suffix.
+// The total size of the files is limited by MaxSize: when it is
+// exceeded, the least recently used entries are evicted in the
+// background. Entries older than MaxAge are evicted too.
+//
+// Init is called automatically on first use. Close stops the
+// background eviction.
+type DiskCache struct {
+	// Path is the root directory of the cache
+	Path string
+	// MaxSize is the maximum total size of the cache files in bytes.
+	// 0 means unlimited.
+	MaxSize int64
+	// MaxAge is the maximum age of the entries. 0 means unlimited.
+	MaxAge time.Duration
+	// EvictInterval is the interval of the background eviction of
+	// expired entries. Defaults to 1 minute.
+	EvictInterval time.Duration
+
+	once    sync.Once
+	initErr error
+	lock    sync.Mutex
+	items   map[string]*list.Element
+	order   list.List
+	size    int64
+	evict   chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+type diskItem struct {
+	key    string
+	size   int64
+	stored time.Time
+}
+
+// Init loads the index of the cached files and starts the background
+// eviction
+func (c *DiskCache) Init() error {
+	c.once.Do(func() {
+		c.initErr = c.load()
+		if c.initErr != nil {
+			return
+		}
+		if c.EvictInterval <= 0 {
+			c.EvictInterval = defaultEvictInterval
+		}
+		c.evict = make(chan struct{}, 1)
+		c.done = make(chan struct{})
+		c.wg.Add(1)
+		go c.evictLoop(c.done)
+	})
+	return c.initErr
+}
+
+// Close stops the background eviction
+func (c *DiskCache) Close() error {
+	if err := c.Init(); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	if c.done != nil {
+		close(c.done)
+		c.done = nil
+	}
+	c.lock.Unlock()
+	c.wg.Wait()
+	return nil
+}
+
+func (c *DiskCache) filename(key string) string {
+	return filepath.Join(c.Path, key[:min(len(key), 2)], key+diskCacheSuffix)
+}
+
+// load builds the index from the files of the cache. The modification
+// time of a file is the time of its last use.
+func (c *DiskCache) load() error {
+	c.items = make(map[string]*list.Element)
+	type file struct {
+		item     *diskItem
+		accessed time.Time
+	}
+	var files []file
+	err := filepath.WalkDir(c.Path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if strings.HasSuffix(d.Name(), "~") {
+			os.Remove(path)
+			return nil
+		}
+		key, ok := strings.CutSuffix(d.Name(), diskCacheSuffix)
+		if !ok {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		stored, err := readStoreTime(path)
+		if err != nil {
+			os.Remove(path)
+			return nil
+		}
+		files = append(files, file{&diskItem{key: key, size: info.Size(), stored: stored}, info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// the most recently used files are pushed to the front last
+	slices.SortFunc(files, func(a, b file) int { return a.accessed.Compare(b.accessed) })
+	for _, f := range files {
+		c.items[f.item.key] = c.order.PushFront(f.item)
+		c.size += f.item.size
+	}
+	return nil
+}
+
+func readStoreTime(path string) (time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	header := make([]byte, diskCacheHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(header))), nil
+}
+
+// Get implements Cache.Get()
+func (c *DiskCache) Get(key string) ([]byte, time.Time, error) {
+	if err := c.Init(); err != nil {
+		return nil, time.Time{}, err
+	}
+	c.lock.Lock()
+	e, ok := c.items[key]
+	if !ok {
+		c.lock.Unlock()
+		return nil, time.Time{}, ErrCacheMiss
+	}
+	item := e.Value.(*diskItem)
+	if c.MaxAge > 0 && time.Since(item.stored) > c.MaxAge {
+		c.remove(e)
+		c.lock.Unlock()
+		return nil, time.Time{}, ErrCacheMiss
+	}
+	c.order.MoveToFront(e)
+	stored := item.stored
+	c.lock.Unlock()
+
+	value, err := c.read(key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	now := time.Now()
+	_ = os.Chtimes(c.filename(key), now, now)
+	return value, stored, nil
+}
+
+// read returns the decompressed value of the file of key
+func (c *DiskCache) read(key string) ([]byte, error) {
+	data, err := os.ReadFile(c.filename(key))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = ErrCacheMiss
+		}
+		return nil, err
+	}
+	if len(data) < diskCacheHeaderSize {
+		return nil, ErrCacheMiss
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data[diskCacheHeaderSize:]))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// Set implements Cache.Set()
+func (c *DiskCache) Set(key string, value []byte) error {
+	if err := c.Init(); err != nil {
+		return err
+	}
+	stored := time.Now()
+	var buf bytes.Buffer
+	buf.Grow(diskCacheHeaderSize + len(value)/2)
+	binary.Write(&buf, binary.BigEndian, uint64(stored.UnixNano()))
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(value); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	filename := c.filename(key)
+	if err := os.MkdirAll(filepath.Dir(filename), 0750); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := os.WriteFile(filename+"~", buf.Bytes(), 0640); err != nil {
+		return err
+	}
+	if err := os.Rename(filename+"~", filename); err != nil {
+		return err
+	}
+	if e, ok := c.items[key]; ok {
+		c.size -= e.Value.(*diskItem).size
+		c.order.Remove(e)
+	}
+	item := &diskItem{key: key, size: int64(buf.Len()), stored: stored}
+	c.items[key] = c.order.PushFront(item)
+	c.size += item.size
+	if c.MaxSize > 0 && c.size > c.MaxSize {
+		select {
+		case c.evict <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Delete implements Cache.Delete()
+func (c *DiskCache) Delete(key string) error {
+	if err := c.Init(); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.items[key]; ok {
+		return c.remove(e)
+	}
+	return nil
+}
+
+// Iterate implements Cache.Iterate(). Keys are visited from the most
+// recently used one. Iterate doesn't change the order of use.
+func (c *DiskCache) Iterate(fn func(key string, value []byte) bool) error {
+	if err := c.Init(); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	keys := make([]string, 0, len(c.items))
+	for e := c.order.Front(); e != nil; e = e.Next() {
+		keys = append(keys, e.Value.(*diskItem).key)
+	}
+	c.lock.Unlock()
+	for _, key := range keys {
+		value, err := c.read(key)
+		if errors.Is(err, ErrCacheMiss) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !fn(key, value) {
+			break
+		}
+	}
+	return nil
+}
+
+// Size returns the total size of the cache files in bytes
+func (c *DiskCache) Size() int64 {
+	if c.Init() != nil {
+		return 0
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.size
+}
+
+// Len returns the number of cached keys
+func (c *DiskCache) Len() int {
+	if c.Init() != nil {
+		return 0
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.items)
+}
+
+// Prune removes the entries older than MaxAge and evicts the least
+// recently used entries until the cache fits in MaxSize. It returns the
+// number of removed entries.
+func (c *DiskCache) Prune() (int, error) {
+	if err := c.Init(); err != nil {
+		return 0, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	removed := 0
+	var err error
+	if c.MaxAge > 0 {
+		for e := c.order.Front(); e != nil; {
+			next := e.Next()
+			if time.Since(e.Value.(*diskItem).stored) > c.MaxAge {
+				err = errors.Join(err, c.remove(e))
+				removed++
+			}
+			e = next
+		}
+	}
+	for c.MaxSize > 0 && c.size > c.MaxSize {
+		err = errors.Join(err, c.remove(c.order.Back()))
+		removed++
+	}
+	return removed, err
+}
+
+// remove deletes the entry of e. The lock must be held.
+func (c *DiskCache) remove(e *list.Element) error {
+	item := e.Value.(*diskItem)
+	c.order.Remove(e)
+	delete(c.items, item.key)
+	c.size -= item.size
+	if err := os.Remove(c.filename(item.key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (c *DiskCache) evictLoop(done chan struct{}) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(c.EvictInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		case <-c.evict:
+		}
+		c.Prune()
+	}
+}
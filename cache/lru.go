@@ -0,0 +1,119 @@
+// Copyright 2018 Adam Tauber
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// LRUCache is an in-memory Cache which evicts the least recently used
+// keys when the total size of the cached values exceeds MaxSize.
+// The zero value is an unbounded cache ready to use.
+type LRUCache struct {
+	// MaxSize is the maximum total size of the cached values in bytes.
+	// 0 means unlimited.
+	MaxSize int64
+
+	lock  sync.Mutex
+	items map[string]*list.Element
+	order list.List
+	size  int64
+}
+
+type lruItem struct {
+	key    string
+	value  []byte
+	stored time.Time
+}
+
+// Get implements Cache.Get(). The returned value must not be modified.
+func (c *LRUCache) Get(key string) ([]byte, time.Time, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil, time.Time{}, ErrCacheMiss
+	}
+	c.order.MoveToFront(e)
+	item := e.Value.(*lruItem)
+	return item.value, item.stored, nil
+}
+
+// Set implements Cache.Set(). Values larger than MaxSize are not stored.
+func (c *LRUCache) Set(key string, value []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.items == nil {
+		c.items = make(map[string]*list.Element)
+	}
+	c.remove(key)
+	if c.MaxSize > 0 && int64(len(value)) > c.MaxSize {
+		return nil
+	}
+	c.items[key] = c.order.PushFront(&lruItem{key: key, value: value, stored: time.Now()})
+	c.size += int64(len(value))
+	for c.MaxSize > 0 && c.size > c.MaxSize {
+		c.remove(c.order.Back().Value.(*lruItem).key)
+	}
+	return nil
+}
+
+// Delete implements Cache.Delete()
+func (c *LRUCache) Delete(key string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.remove(key)
+	return nil
+}
+
+// Iterate implements Cache.Iterate(). Keys are visited from the most
+// recently used one. The cache is locked during the iteration.
+func (c *LRUCache) Iterate(fn func(key string, value []byte) bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for e := c.order.Front(); e != nil; e = e.Next() {
+		item := e.Value.(*lruItem)
+		if !fn(item.key, item.value) {
+			break
+		}
+	}
+	return nil
+}
+
+// Len returns the number of cached keys
+func (c *LRUCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.items)
+}
+
+// Size returns the total size of the cached values in bytes
+func (c *LRUCache) Size() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.size
+}
+
+func (c *LRUCache) remove(key string) {
+	e, ok := c.items[key]
+	if !ok {
+		return
+	}
+	c.size -= int64(len(e.Value.(*lruItem).value))
+	c.order.Remove(e)
+	delete(c.items, key)
+}
@@ -0,0 +1,286 @@
+// Copyright 2018 Adam Tauber
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package colly
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of the circuit of a host
+type CircuitState int
+
+const (
+	// CircuitClosed lets requests through
+	CircuitClosed CircuitState = iota
+	// CircuitOpen rejects requests
+	CircuitOpen
+	// CircuitHalfOpen lets a limited number of probe requests through
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("CircuitState(%d)", int(s))
+}
+
+// CircuitOpenError is the error of requests rejected by an open circuit.
+// It matches ErrCircuitOpen with errors.Is.
+type CircuitOpenError struct {
+	// Host is the host of the open circuit
+	Host string
+	// RetryAfter is the remaining time until the circuit half-opens
+	RetryAfter time.Duration
+}
+
+// Error implements error interface.
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit of %q is open, retry after %v", e.Host, e.RetryAfter)
+}
+
+// Unwrap returns ErrCircuitOpen
+func (e *CircuitOpenError) Unwrap() error {
+	return ErrCircuitOpen
+}
+
+// CircuitBreaker stops sending requests to hosts which fail repeatedly.
+// Every host has its own circuit. After Failures consecutive failures the
+// circuit of the host opens and its requests fail immediately with a
+// *CircuitOpenError, without waiting for a connection slot of the
+// LimitRules. After Cooldown the circuit half-opens and lets Probes
+// requests through. If they succeed, the circuit closes, otherwise it
+// opens again.
+type CircuitBreaker struct {
+	// Failures is the number of consecutive failures which open the
+	// circuit of a host. Defaults to 5.
+	Failures int
+	// Cooldown is the duration of the open state. Defaults to 30 seconds.
+	Cooldown time.Duration
+	// Probes is the number of requests let through in the half-open
+	// state. All of them have to succeed to close the circuit.
+	// Defaults to 1.
+	Probes int
+	// IsFailure returns true if the result of a request is a failure.
+	// Defaults to network errors and 5xx responses.
+	IsFailure func(statusCode int, err error) bool
+	// OnStateChange is called when the circuit of a host changes its state
+	OnStateChange func(host string, from, to CircuitState)
+	lock          sync.Mutex
+	hosts         map[string]*circuit
+	// notifiers report the state changes to the debuggers of the
+	// collectors using the breaker, by collector ID
+	notifiers map[uint32]func(host string, from, to CircuitState)
+	changes   []stateChange
+}
+
+type stateChange struct {
+	host     string
+	from, to CircuitState
+}
+
+// circuit is the circuit of a host
+type circuit struct {
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	// probes is the number of the started probe requests and successes
+	// is the number of the successful ones in the half-open state
+	probes    int
+	successes int
+}
+
+// SetCircuitBreaker sets the circuit breaker of the requests of the
+// collector. The circuit breaker is shared with the clones of the
+// collector and it can be shared with other collectors. State changes
+// are reported as "circuit" debugger events to every collector which
+// set the breaker.
+func (c *Collector) SetCircuitBreaker(b *CircuitBreaker) {
+	c.backend.lock.Lock()
+	prev := c.backend.circuitBreaker
+	c.backend.circuitBreaker = b
+	c.backend.lock.Unlock()
+	if prev != nil && prev != b {
+		prev.lock.Lock()
+		delete(prev.notifiers, c.ID)
+		prev.lock.Unlock()
+	}
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	if b.notifiers == nil {
+		b.notifiers = make(map[uint32]func(host string, from, to CircuitState))
+	}
+	b.notifiers[c.ID] = func(host string, from, to CircuitState) {
+		if c.debugger != nil {
+			c.debugger.Event(createEvent("circuit", 0, c.ID, map[string]string{
+				"host": host,
+				"from": from.String(),
+				"to":   to.String(),
+			}))
+		}
+	}
+	b.lock.Unlock()
+}
+
+// State returns the state of the circuit of host
+func (b *CircuitBreaker) State(host string) CircuitState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	cb := b.hosts[host]
+	if cb == nil {
+		return CircuitClosed
+	}
+	if cb.state == CircuitOpen && time.Since(cb.openedAt) >= b.cooldown() {
+		return CircuitHalfOpen
+	}
+	return cb.state
+}
+
+func (b *CircuitBreaker) cooldown() time.Duration {
+	if b.Cooldown <= 0 {
+		return 30 * time.Second
+	}
+	return b.Cooldown
+}
+
+// check returns a *CircuitOpenError if the circuit of host is open
+func (b *CircuitBreaker) check(host string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	cb := b.hosts[host]
+	if cb == nil || cb.state != CircuitOpen {
+		return nil
+	}
+	if remaining := b.cooldown() - time.Since(cb.openedAt); remaining > 0 {
+		return &CircuitOpenError{Host: host, RetryAfter: remaining}
+	}
+	return nil
+}
+
+// allow reserves a request to host. It returns a *CircuitOpenError if
+// the request is rejected, otherwise the result of the request has to
+// be passed to done.
+func (b *CircuitBreaker) allow(host string) (done func(statusCode int, err error), err error) {
+	b.lock.Lock()
+	defer b.unlock()
+	if b.hosts == nil {
+		b.hosts = make(map[string]*circuit)
+	}
+	cb := b.hosts[host]
+	if cb == nil {
+		cb = &circuit{}
+		b.hosts[host] = cb
+	}
+	probes := max(b.Probes, 1)
+	switch cb.state {
+	case CircuitOpen:
+		remaining := b.cooldown() - time.Since(cb.openedAt)
+		if remaining > 0 {
+			return nil, &CircuitOpenError{Host: host, RetryAfter: remaining}
+		}
+		b.setState(host, cb, CircuitHalfOpen)
+		cb.probes, cb.successes = 0, 0
+		fallthrough
+	case CircuitHalfOpen:
+		if cb.probes >= probes {
+			return nil, &CircuitOpenError{Host: host}
+		}
+		cb.probes++
+	}
+	return func(statusCode int, err error) {
+		b.record(host, cb, statusCode, err)
+	}, nil
+}
+
+// record updates the circuit of host with the result of a request
+func (b *CircuitBreaker) record(host string, cb *circuit, statusCode int, err error) {
+	if errors.Is(err, context.Canceled) {
+		// canceled requests say nothing about the host
+		b.lock.Lock()
+		if cb.state == CircuitHalfOpen {
+			cb.probes--
+		}
+		b.lock.Unlock()
+		return
+	}
+	failed := err != nil || statusCode >= 500
+	if b.IsFailure != nil {
+		failed = b.IsFailure(statusCode, err)
+	}
+	b.lock.Lock()
+	defer b.unlock()
+	switch {
+	case failed && cb.state == CircuitHalfOpen:
+		cb.openedAt = time.Now()
+		b.setState(host, cb, CircuitOpen)
+	case failed && cb.state == CircuitClosed:
+		cb.failures++
+		failures := b.Failures
+		if failures <= 0 {
+			failures = 5
+		}
+		if cb.failures >= failures {
+			cb.openedAt = time.Now()
+			b.setState(host, cb, CircuitOpen)
+		}
+	case !failed && cb.state == CircuitHalfOpen:
+		cb.successes++
+		if cb.successes >= max(b.Probes, 1) {
+			cb.failures = 0
+			b.setState(host, cb, CircuitClosed)
+		}
+	case !failed && cb.state == CircuitClosed:
+		cb.failures = 0
+	}
+}
+
+// setState changes the state of a circuit. b.lock must be held.
+func (b *CircuitBreaker) setState(host string, cb *circuit, state CircuitState) {
+	b.changes = append(b.changes, stateChange{host, cb.state, state})
+	cb.state = state
+}
+
+// unlock releases b.lock and reports the state changes made while it
+// was held, so the callbacks can use the circuit breaker
+func (b *CircuitBreaker) unlock() {
+	changes := b.changes
+	b.changes = nil
+	var notifiers []func(host string, from, to CircuitState)
+	if len(changes) > 0 {
+		for _, notify := range b.notifiers {
+			notifiers = append(notifiers, notify)
+		}
+	}
+	b.lock.Unlock()
+	for _, c := range changes {
+		for _, notify := range notifiers {
+			notify(c.host, c.from, c.to)
+		}
+		if b.OnStateChange != nil {
+			b.OnStateChange(c.host, c.from, c.to)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package colly
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerStates(t *testing.T) {
+	var changes []string
+	b := &CircuitBreaker{
+		Failures: 2,
+		Cooldown: 50 * time.Millisecond,
+		Probes:   1,
+		OnStateChange: func(host string, from, to CircuitState) {
+			changes = append(changes, from.String()+">"+to.String())
+		},
+	}
+	const host = "example.com"
+	fail := func() {
+		done, err := b.allow(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done(http.StatusServiceUnavailable, nil)
+	}
+	fail()
+	if b.State(host) != CircuitClosed {
+		t.Fatal("circuit opened before reaching the failure threshold")
+	}
+	fail()
+	if b.State(host) != CircuitOpen {
+		t.Fatal("circuit not opened")
+	}
+	_, err := b.allow(host)
+	var openErr *CircuitOpenError
+	if !errors.As(err, &openErr) || !errors.Is(err, ErrCircuitOpen) || openErr.Host != host || openErr.RetryAfter <= 0 {
+		t.Fatalf("unexpected error of open circuit: %v", err)
+	}
+	if b.check("other.com") != nil {
+		t.Error("hosts are not independent")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	probe, err := b.allow(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.allow(host); !errors.Is(err, ErrCircuitOpen) {
+		t.Error("more probes than allowed in half-open state")
+	}
+	probe(http.StatusServiceUnavailable, nil)
+	if b.State(host) != CircuitOpen {
+		t.Fatal("failed probe didn't reopen the circuit")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	probe, err = b.allow(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	probe(http.StatusOK, nil)
+	if b.State(host) != CircuitClosed {
+		t.Fatal("successful probe didn't close the circuit")
+	}
+	expected := "closed>open,open>half-open,half-open>open,open>half-open,half-open>closed"
+	if strings.Join(changes, ",") != expected {
+		t.Errorf("unexpected state changes: %v", changes)
+	}
+}
+
+func TestCollectorCircuitBreaker(t *testing.T) {
+	var requests atomic.Int32
+	var healthy atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	recorder := &eventRecorder{}
+	c := NewCollector(AllowURLRevisit(), Debugger(recorder))
+	c.SetCircuitBreaker(&CircuitBreaker{Failures: 3, Cooldown: 100 * time.Millisecond})
+	for i := 0; i < 5; i++ {
+		err := c.Visit(ts.URL)
+		if i >= 3 && !errors.Is(err, ErrCircuitOpen) {
+			t.Errorf("request %d not rejected: %v", i, err)
+		}
+	}
+	if requests.Load() != 3 {
+		t.Errorf("expected 3 requests, got %d", requests.Load())
+	}
+
+	healthy.Store(true)
+	time.Sleep(110 * time.Millisecond)
+	if err := c.Visit(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	var states []string
+	for _, e := range recorder.events {
+		if e.Type == "circuit" {
+			states = append(states, e.Values["to"])
+		}
+	}
+	if strings.Join(states, ",") != "open,half-open,closed" {
+		t.Errorf("unexpected circuit events: %v", states)
+	}
+}
+
+func TestCollectorCircuitBreakerShared(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	b := &CircuitBreaker{Failures: 2, Cooldown: time.Minute}
+	recorders := []*eventRecorder{{}, {}}
+	c1 := NewCollector(AllowURLRevisit(), Debugger(recorders[0]))
+	c1.SetCircuitBreaker(b)
+	c2 := NewCollector(AllowURLRevisit(), Debugger(recorders[1]))
+	c2.SetCircuitBreaker(b)
+	c1.Visit(ts.URL)
+	c2.Visit(ts.URL)
+	if err := c1.Visit(ts.URL); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("request not rejected: %v", err)
+	}
+	for i, recorder := range recorders {
+		found := false
+		for _, e := range recorder.events {
+			if e.Type == "circuit" && e.Values["to"] == "open" {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("no circuit event of collector %d", i+1)
+		}
+	}
+
+	// replaced breakers don't report to the collectors
+	c1.SetCircuitBreaker(nil)
+	c2.SetCircuitBreaker(&CircuitBreaker{})
+	if n := len(b.notifiers); n != 0 {
+		t.Errorf("%d notifiers kept after the breaker was replaced", n)
+	}
+}
+
+func TestCollectorCircuitBreakerBodyError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer ts.Close()
+
+	c := NewCollector()
+	breaker := &CircuitBreaker{Failures: 1}
+	c.SetCircuitBreaker(breaker)
+	if err := c.Visit(ts.URL); err == nil {
+		t.Error("truncated body not reported")
+	}
+	if s := breaker.State(ts.Listener.Addr().String()); s != CircuitOpen {
+		t.Errorf("body read error not recorded as failure, circuit is %v", s)
+	}
+}
@@ -26,7 +26,6 @@ import (
 	"io"
 	"log"
 	"net/http"
-	"net/http/cookiejar"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -41,11 +40,11 @@ import (
 	"github.com/PuerkitoBio/goquery"
 	"github.com/antchfx/htmlquery"
 	"github.com/antchfx/xmlquery"
+	"github.com/gocolly/colly/v2/cache"
 	"github.com/gocolly/colly/v2/debug"
 	"github.com/gocolly/colly/v2/storage"
 	"github.com/kennygrant/sanitize"
 	whatwgUrl "github.com/nlnwa/whatwg-url/url"
-	"github.com/temoto/robotstxt"
 	"google.golang.org/appengine/urlfetch"
 )
 
@@ -82,17 +81,44 @@ type Collector struct {
 
 	// AllowURLRevisit allows multiple downloads of the same URL
 	AllowURLRevisit bool
+	// RevisitAfter is the duration after which a visited URL becomes
+	// eligible for revisiting. 0 means visited URLs never expire (default).
+	// It requires a storage implementing storage.VisitTimeStorage.
+	RevisitAfter time.Duration
+	// DomainRevisitAfter overrides RevisitAfter for specific domains.
+	// Use c.SetDomainRevisitAfter to set values of this map
+	DomainRevisitAfter map[string]time.Duration
 	// MaxBodySize is the limit of the retrieved response body in bytes.
 	// 0 means unlimited.
 	// The default value for MaxBodySize is 10MB (10 * 1024 * 1024 bytes).
+	// Longer bodies are truncated and Response.Truncated is set.
 	MaxBodySize int
+	// TruncatedBodyError makes responses truncated at MaxBodySize
+	// errors. They are passed to OnError callbacks with ErrBodyTruncated
+	// instead of being processed.
+	TruncatedBodyError bool
 	// CacheDir specifies a location where GET requests are cached as files.
-	// When it's not defined, caching is disabled.
+	// When it's not defined, caching is disabled, unless a cache is set by
+	// c.SetCache.
 	CacheDir string
 	// IgnoreRobotsTxt allows the Collector to ignore any restrictions set by
 	// the target host's robots.txt file.  See http://www.robotstxt.org/ for more
-	// information.
+	// information. Requests blocked by robots.txt fail with
+	// ErrRobotsTxtBlocked, which is returned by Visit or reported to
+	// OnError in Async mode. robots.txt files are fetched with Headers and
+	// UserAgent, but without calling the OnRequest callbacks.
 	IgnoreRobotsTxt bool
+	// HonorCrawlDelay spaces the requests to hosts by the Crawl-delay and
+	// Request-rate directives of their robots.txt files. It only has an
+	// effect if IgnoreRobotsTxt is false.
+	HonorCrawlDelay bool
+	// RobotsUserAgent is the product token matched against the
+	// User-agent lines of robots.txt files, e.g. "mybot". Defaults to
+	// UserAgent, which only matches if it starts with the product token.
+	RobotsUserAgent string
+	// RobotsTTL is the time robots.txt files are cached.
+	// Defaults to 24 hours.
+	RobotsTTL time.Duration
 	// Async turns on asynchronous network communication. Use Collector.Wait() to
 	// be sure all requests have been finished.
 	Async bool
@@ -119,15 +145,21 @@ type Collector struct {
 	// MaxRequests limit the number of requests done by the instance.
 	// Set it to 0 for infinite requests (default).
 	MaxRequests uint32
+	// RetryPolicy enables the automatic retry of failed requests.
+	// Requests are not retried automatically if it is nil (default).
+	RetryPolicy *RetryPolicy
 
 	store                    storage.Storage
+	cache                    cache.Cache
 	debugger                 debug.Debugger
-	robotsMap                map[string]*robotstxt.RobotsData
+	robotsMap                map[string]*robotsEntry
+	pendingVisits            map[uint64]struct{}
 	htmlCallbacks            []*htmlCallbackContainer
 	xmlCallbacks             []*xmlCallbackContainer
 	requestCallbacks         []RequestCallback
 	responseCallbacks        []ResponseCallback
 	responseHeadersCallbacks []ResponseHeadersCallback
+	responseStreamCallbacks  []ResponseStreamCallback
 	requestHeadersCallbacks  []RequestCallback
 	errorCallbacks           []ErrorCallback
 	scrapedCallbacks         []ScrapedCallback
@@ -139,6 +171,11 @@ type Collector struct {
 	// CacheExpiration sets the maximum age for cache files.
 	// If a cached file is older than this duration, it will be ignored and refreshed.
 	CacheExpiration time.Duration
+	// HTTPCache makes the response cache follow the HTTP caching rules
+	// (RFC 9111). Responses are stored and reused according to their
+	// Cache-Control, Expires and Vary headers, and stale responses are
+	// revalidated with conditional requests. CacheExpiration is ignored.
+	HTTPCache bool
 }
 
 // RequestCallback is a type alias for OnRequest callback functions
@@ -156,6 +193,9 @@ type HTMLCallback func(*HTMLElement)
 // XMLCallback is a type alias for OnXML callback functions
 type XMLCallback func(*XMLElement)
 
+// ResponseStreamCallback is a type alias for OnResponseStream callback functions
+type ResponseStreamCallback func(*Response, io.Reader) error
+
 // ErrorCallback is a type alias for OnError callback functions
 type ErrorCallback func(*Response, error)
 
@@ -200,6 +240,9 @@ type xmlCallbackContainer struct {
 type cookieJarSerializer struct {
 	store storage.Storage
 	lock  *sync.RWMutex
+	// onError reports the errors of storing cookie records,
+	// which can't be returned by http.CookieJar.SetCookies
+	onError func(error)
 }
 
 var collectorCounter uint32
@@ -236,6 +279,9 @@ var (
 	ErrRobotsTxtBlocked = errors.New("URL blocked by robots.txt")
 	// ErrNoCookieJar is the error type for missing cookie jar
 	ErrNoCookieJar = errors.New("Cookie jar is not available")
+	// ErrNoCookieStorage is the error type for storages without
+	// structured cookie support
+	ErrNoCookieStorage = errors.New("Storage doesn't implement storage.CookieStorage")
 	// ErrNoPattern is the error type for LimitRules without patterns
 	ErrNoPattern = errors.New("No pattern defined in LimitRule")
 	// ErrEmptyProxyURL is the error type for empty Proxy URL list
@@ -250,6 +296,21 @@ var (
 	ErrMaxRequests = errors.New("Max Requests limit reached")
 	// ErrRetryBodyUnseekable is the error when retry with not seekable body
 	ErrRetryBodyUnseekable = errors.New("Retry Body Unseekable")
+	// ErrBodyTruncated is the error when a response body is longer than
+	// MaxBodySize and TruncatedBodyError is set
+	ErrBodyTruncated = errors.New("Response body truncated")
+	// ErrUnsupportedContentEncoding is the error when a response has a
+	// known Content-Encoding, like br or zstd, without registered decoder
+	ErrUnsupportedContentEncoding = errors.New("Unsupported Content-Encoding")
+	// ErrDownloadIncomplete is the error when the size of a downloaded file
+	// differs from the size announced by the server
+	ErrDownloadIncomplete = errors.New("Download incomplete")
+	// ErrChecksumMismatch is the error when the checksum of a downloaded
+	// file doesn't match the expected checksum
+	ErrChecksumMismatch = errors.New("Checksum mismatch")
+	// ErrCircuitOpen is the error of requests rejected by the
+	// CircuitBreaker, see CircuitOpenError
+	ErrCircuitOpen = errors.New("Circuit open")
 )
 
 var envMap = map[string]func(*Collector, string){
@@ -259,6 +320,9 @@ var envMap = map[string]func(*Collector, string){
 	"CACHE_DIR": func(c *Collector, val string) {
 		c.CacheDir = val
 	},
+	"HTTP_CACHE": func(c *Collector, val string) {
+		c.HTTPCache = isYesString(val)
+	},
 	"DETECT_CHARSET": func(c *Collector, val string) {
 		c.DetectCharset = isYesString(val)
 	},
@@ -271,6 +335,18 @@ var envMap = map[string]func(*Collector, string){
 	"IGNORE_ROBOTSTXT": func(c *Collector, val string) {
 		c.IgnoreRobotsTxt = isYesString(val)
 	},
+	"HONOR_CRAWL_DELAY": func(c *Collector, val string) {
+		c.HonorCrawlDelay = isYesString(val)
+	},
+	"ROBOTS_USER_AGENT": func(c *Collector, val string) {
+		c.RobotsUserAgent = val
+	},
+	"ROBOTS_TTL": func(c *Collector, val string) {
+		d, err := time.ParseDuration(val)
+		if err == nil {
+			c.RobotsTTL = d
+		}
+	},
 	"FOLLOW_REDIRECTS": func(c *Collector, val string) {
 		if !isYesString(val) {
 			c.redirectHandler = func(req *http.Request, via []*http.Request) error {
@@ -296,6 +372,12 @@ var envMap = map[string]func(*Collector, string){
 			c.MaxRequests = uint32(maxRequests)
 		}
 	},
+	"REVISIT_AFTER": func(c *Collector, val string) {
+		d, err := time.ParseDuration(val)
+		if err == nil {
+			c.RevisitAfter = d
+		}
+	},
 	"PARSE_HTTP_ERROR_RESPONSE": func(c *Collector, val string) {
 		c.ParseHTTPErrorResponse = isYesString(val)
 	},
@@ -400,6 +482,21 @@ func AllowURLRevisit() CollectorOption {
 	}
 }
 
+// RevisitAfter sets the duration after which a visited URL can be visited again.
+func RevisitAfter(d time.Duration) CollectorOption {
+	return func(c *Collector) {
+		c.RevisitAfter = d
+	}
+}
+
+// DomainRevisitAfter sets the duration after which a visited URL of the
+// given domain can be visited again. It overrides RevisitAfter.
+func DomainRevisitAfter(domain string, d time.Duration) CollectorOption {
+	return func(c *Collector) {
+		c.SetDomainRevisitAfter(domain, d)
+	}
+}
+
 // MaxBodySize sets the limit of the retrieved response body in bytes.
 func MaxBodySize(sizeInBytes int) CollectorOption {
 	return func(c *Collector) {
@@ -422,6 +519,31 @@ func IgnoreRobotsTxt() CollectorOption {
 	}
 }
 
+// HonorCrawlDelay instructs the Collector to space the requests to
+// hosts by the Crawl-delay and Request-rate directives of their
+// robots.txt files. The delays are combined with the LimitRules, so the
+// stricter limit applies. Delays longer than a minute are capped.
+func HonorCrawlDelay() CollectorOption {
+	return func(c *Collector) {
+		c.HonorCrawlDelay = true
+	}
+}
+
+// RobotsUserAgent sets the product token matched against the User-agent
+// lines of robots.txt files.
+func RobotsUserAgent(token string) CollectorOption {
+	return func(c *Collector) {
+		c.RobotsUserAgent = token
+	}
+}
+
+// RobotsTTL sets the time robots.txt files are cached.
+func RobotsTTL(d time.Duration) CollectorOption {
+	return func(c *Collector) {
+		c.RobotsTTL = d
+	}
+}
+
 // TraceHTTP instructs the Collector to collect and report request trace data
 // on the Response.Trace.
 func TraceHTTP() CollectorOption {
@@ -479,6 +601,13 @@ func CheckHead() CollectorOption {
 	}
 }
 
+// TruncatedBodyError makes responses truncated at MaxBodySize errors.
+func TruncatedBodyError() CollectorOption {
+	return func(c *Collector) {
+		c.TruncatedBodyError = true
+	}
+}
+
 // CacheExpiration sets the maximum age for cache files.
 // If a cached file is older than this duration, it will be ignored and refreshed.
 func CacheExpiration(d time.Duration) CollectorOption {
@@ -487,6 +616,13 @@ func CacheExpiration(d time.Duration) CollectorOption {
 	}
 }
 
+// HTTPCache makes the response cache follow the HTTP caching rules.
+func HTTPCache() CollectorOption {
+	return func(c *Collector) {
+		c.HTTPCache = true
+	}
+}
+
 // Init initializes the Collector's private variables and sets default
 // configuration for the Collector
 func (c *Collector) Init() {
@@ -498,12 +634,12 @@ func (c *Collector) Init() {
 	c.store.Init()
 	c.MaxBodySize = 10 * 1024 * 1024
 	c.backend = &httpBackend{}
-	jar, _ := cookiejar.New(nil)
-	c.backend.Init(jar)
+	c.backend.Init(createJar(c.store, c.handleOnCookieError))
 	c.backend.Client.CheckRedirect = c.checkRedirectFunc()
 	c.wg = &sync.WaitGroup{}
 	c.lock = &sync.RWMutex{}
-	c.robotsMap = make(map[string]*robotstxt.RobotsData)
+	c.robotsMap = make(map[string]*robotsEntry)
+	c.pendingVisits = make(map[uint64]struct{})
 	c.IgnoreRobotsTxt = true
 	c.ID = atomic.AddUint32(&collectorCounter, 1)
 	c.TraceHTTP = false
@@ -536,11 +672,11 @@ func (c *Collector) Appengine(ctx context.Context) {
 // Visit also calls the previously provided callbacks
 func (c *Collector) Visit(URL string) error {
 	if c.CheckHead {
-		if check := c.scrape(URL, "HEAD", 1, nil, nil, nil, true); check != nil {
+		if check := c.scrape(URL, "HEAD", 1, 0, nil, nil, nil, true); check != nil {
 			return check
 		}
 	}
-	return c.scrape(URL, "GET", 1, nil, nil, nil, true)
+	return c.scrape(URL, "GET", 1, 0, nil, nil, nil, true)
 }
 
 // HasVisited checks if the provided URL has been visited
@@ -556,19 +692,19 @@ func (c *Collector) HasPosted(URL string, requestData map[string]string) (bool,
 
 // Head starts a collector job by creating a HEAD request.
 func (c *Collector) Head(URL string) error {
-	return c.scrape(URL, "HEAD", 1, nil, nil, nil, false)
+	return c.scrape(URL, "HEAD", 1, 0, nil, nil, nil, false)
 }
 
 // Post starts a collector job by creating a POST request.
 // Post also calls the previously provided callbacks
 func (c *Collector) Post(URL string, requestData map[string]string) error {
-	return c.scrape(URL, "POST", 1, createFormReader(requestData), nil, nil, true)
+	return c.scrape(URL, "POST", 1, 0, createFormReader(requestData), nil, nil, true)
 }
 
 // PostRaw starts a collector job by creating a POST request with raw binary data.
 // Post also calls the previously provided callbacks
 func (c *Collector) PostRaw(URL string, requestData []byte) error {
-	return c.scrape(URL, "POST", 1, bytes.NewReader(requestData), nil, nil, true)
+	return c.scrape(URL, "POST", 1, 0, bytes.NewReader(requestData), nil, nil, true)
 }
 
 // PostMultipart starts a collector job by creating a Multipart POST request
@@ -578,7 +714,7 @@ func (c *Collector) PostMultipart(URL string, requestData map[string][]byte) err
 	hdr := http.Header{}
 	hdr.Set("Content-Type", "multipart/form-data; boundary="+boundary)
 	hdr.Set("User-Agent", c.UserAgent)
-	return c.scrape(URL, "POST", 1, createMultipartReader(boundary, requestData), nil, hdr, true)
+	return c.scrape(URL, "POST", 1, 0, createMultipartReader(boundary, requestData), nil, hdr, true)
 }
 
 // Request starts a collector job by creating a custom HTTP request
@@ -593,7 +729,7 @@ func (c *Collector) PostMultipart(URL string, requestData map[string][]byte) err
 //   - "PATCH"
 //   - "OPTIONS"
 func (c *Collector) Request(method, URL string, requestData io.Reader, ctx *Context, hdr http.Header) error {
-	return c.scrape(URL, method, 1, requestData, ctx, hdr, true)
+	return c.scrape(URL, method, 1, 0, requestData, ctx, hdr, true)
 }
 
 // SetDebugger attaches a debugger to the collector
@@ -629,11 +765,12 @@ func (c *Collector) UnmarshalRequest(r []byte) (*Request, error) {
 		ID:        c.requestCount.Add(1),
 		Headers:   &req.Headers,
 		Host:      req.Host,
+		Priority:  req.Priority,
 		collector: c,
 	}, nil
 }
 
-func (c *Collector) scrape(u, method string, depth int, requestData io.Reader, ctx *Context, hdr http.Header, checkRevisit bool) error {
+func (c *Collector) scrape(u, method string, depth, priority int, requestData io.Reader, ctx *Context, hdr http.Header, checkRevisit bool) error {
 	parsedWhatwgURL, err := urlParser.Parse(u)
 	if err != nil {
 		return err
@@ -676,19 +813,22 @@ func (c *Collector) scrape(u, method string, depth int, requestData io.Reader, c
 	// replace this with http.NewRequestWithContext
 	req = req.WithContext(context.WithValue(c.Context, CheckRevisitKey, checkRevisit))
 
-	if err := c.requestCheck(parsedURL, method, req.GetBody, depth, checkRevisit); err != nil {
+	// In async mode robots.txt is checked by fetch, so blocked requests
+	// are always reported to OnError
+	deferRobots := c.Async && method != "HEAD" && !c.IgnoreRobotsTxt
+	if err := c.requestCheck(parsedURL, method, req.GetBody, depth, checkRevisit, !deferRobots); err != nil {
 		return err
 	}
 	u = parsedURL.String()
 	c.wg.Add(1)
 	if c.Async {
-		go c.fetch(u, method, depth, requestData, ctx, hdr, req)
+		go c.fetch(u, method, depth, priority, requestData, ctx, hdr, req, deferRobots)
 		return nil
 	}
-	return c.fetch(u, method, depth, requestData, ctx, hdr, req)
+	return c.fetch(u, method, depth, priority, requestData, ctx, hdr, req, false)
 }
 
-func (c *Collector) fetch(u, method string, depth int, requestData io.Reader, ctx *Context, hdr http.Header, req *http.Request) error {
+func (c *Collector) fetch(u, method string, depth, priority int, requestData io.Reader, ctx *Context, hdr http.Header, req *http.Request, checkRobots bool) error {
 	defer c.wg.Done()
 	if ctx == nil {
 		ctx = NewContext()
@@ -699,10 +839,24 @@ func (c *Collector) fetch(u, method string, depth int, requestData io.Reader, ct
 		Host:      req.Host,
 		Ctx:       ctx,
 		Depth:     depth,
+		Priority:  priority,
 		Method:    method,
 		Body:      requestData,
 		collector: c,
 		ID:        c.requestCount.Add(1),
+		Attempt:   1,
+	}
+
+	if checkRobots {
+		err := c.checkRobots(req.URL)
+		if checkRevisit, _ := req.Context().Value(CheckRevisitKey).(bool); checkRevisit && !c.AllowURLRevisit {
+			if err := c.settleVisit(req.URL, method, req.GetBody, err == nil); err != nil {
+				return c.handleOnError(nil, err, request, ctx)
+			}
+		}
+		if err != nil {
+			return c.handleOnError(nil, err, request, ctx)
+		}
 	}
 
 	if req.Header.Get("Accept") == "" {
@@ -737,7 +891,49 @@ func (c *Collector) fetch(u, method string, depth int, requestData io.Reader, ct
 		c.handleOnRequestHeaders(request)
 		return !request.abort
 	}
-	response, err := c.backend.Cache(req, c.MaxBodySize, checkRequestHeadersFunc, checkResponseHeadersFunc, c.CacheDir, c.CacheExpiration)
+	c.lock.RLock()
+	streaming := len(c.responseStreamCallbacks) > 0
+	c.lock.RUnlock()
+	if streaming {
+		return c.fetchStream(req, request, hTrace, checkRequestHeadersFunc, checkResponseHeadersFunc)
+	}
+	store := c.cache
+	if store == nil && c.CacheDir != "" {
+		store = &cache.DirCache{Path: c.CacheDir}
+	}
+	// responses which would be retried are neither cached nor
+	// served from the cache, so retries reach the server
+	var retryable func(*Response) bool
+	if c.RetryPolicy != nil {
+		retryable = func(resp *Response) bool {
+			return c.RetryPolicy.retryable(resp, nil)
+		}
+	}
+	doRequest := func(req *http.Request) (*Response, error) {
+		if c.HTTPCache {
+			return c.backend.HTTPCache(req, c.MaxBodySize, checkRequestHeadersFunc, checkResponseHeadersFunc, store, retryable)
+		}
+		return c.backend.Cache(req, c.MaxBodySize, checkRequestHeadersFunc, checkResponseHeadersFunc, store, c.CacheExpiration, retryable)
+	}
+	response, err := doRequest(req)
+	for c.RetryPolicy != nil && !request.abort {
+		delay, ok := c.RetryPolicy.retry(request.Attempt, response, err)
+		if !ok {
+			break
+		}
+		retryReq, ok := rewindRequest(req)
+		if !ok {
+			break
+		}
+		c.handleOnRetry(request, response, err, delay)
+		if sleepContext(req.Context(), delay) != nil {
+			break
+		}
+		req = retryReq
+		origURL = req.URL
+		request.Attempt++
+		response, err = doRequest(req)
+	}
 	if proxyURL, ok := req.Context().Value(ProxyURLKey).(string); ok {
 		request.ProxyURL = proxyURL
 	}
@@ -748,6 +944,12 @@ func (c *Collector) fetch(u, method string, depth int, requestData io.Reader, ct
 	response.Ctx = ctx
 	response.Request = request
 	response.Trace = hTrace
+	if response.Truncated {
+		if c.TruncatedBodyError {
+			return c.handleOnError(response, ErrBodyTruncated, request, ctx)
+		}
+		c.handleOnTruncated(response)
+	}
 
 	err = response.fixCharset(c.DetectCharset, request.ResponseCharacterEncoding)
 	if err != nil {
@@ -771,7 +973,32 @@ func (c *Collector) fetch(u, method string, depth int, requestData io.Reader, ct
 	return err
 }
 
-func (c *Collector) requestCheck(parsedURL *url.URL, method string, getBody func() (io.ReadCloser, error), depth int, checkRevisit bool) error {
+// fetchStream sends req in streaming mode, see OnResponseStream
+func (c *Collector) fetchStream(req *http.Request, request *Request, hTrace *HTTPTrace, checkRequestHeadersFunc checkRequestHeadersFunc, checkResponseHeadersFunc checkResponseHeadersFunc) error {
+	var response *Response
+	err := c.backend.DoStream(req, true, checkRequestHeadersFunc, checkResponseHeadersFunc, func(resp *Response, body io.Reader) error {
+		response = resp
+		response.Ctx = request.Ctx
+		response.Request = request
+		response.Trace = hTrace
+		if proxyURL, ok := req.Context().Value(ProxyURLKey).(string); ok {
+			request.ProxyURL = proxyURL
+		}
+		if !c.ParseHTTPErrorResponse && resp.StatusCode >= 300 {
+			// reported by handleOnError
+			return nil
+		}
+		c.responseCount.Add(1)
+		return c.handleOnResponseStream(resp, body)
+	})
+	if err := c.handleOnError(response, err, request, request.Ctx); err != nil {
+		return err
+	}
+	c.handleOnScraped(response)
+	return nil
+}
+
+func (c *Collector) requestCheck(parsedURL *url.URL, method string, getBody func() (io.ReadCloser, error), depth int, checkRevisit, checkRobots bool) error {
 	u := parsedURL.String()
 	if c.MaxDepth > 0 && c.MaxDepth < depth {
 		return ErrMaxDepth
@@ -782,41 +1009,90 @@ func (c *Collector) requestCheck(parsedURL *url.URL, method string, getBody func
 	if err := c.checkFilters(u, parsedURL.Hostname()); err != nil {
 		return err
 	}
-	if method != "HEAD" && !c.IgnoreRobotsTxt {
+	if checkRobots && method != "HEAD" && !c.IgnoreRobotsTxt {
 		if err := c.checkRobots(parsedURL); err != nil {
 			return err
 		}
 	}
 	if checkRevisit && !c.AllowURLRevisit {
-		// TODO weird behaviour, it allows CheckHead to work correctly,
-		// but it should probably better be solved with
-		// "check-but-not-save" flag or something
-		if method != "GET" && getBody == nil {
-			return nil
-		}
+		// requests waiting for the robots.txt check of fetch are
+		// stored as visited only if robots.txt allows them
+		return c.checkRevisit(parsedURL, method, getBody, !checkRobots)
+	}
+	return nil
+}
 
-		var body io.ReadCloser
-		if getBody != nil {
-			var err error
-			body, err = getBody()
-			if err != nil {
-				return err
-			}
-			defer body.Close()
-		}
-		uHash := requestHash(u, body)
-		visited, err := c.store.IsVisited(uHash)
-		if err != nil {
-			return err
-		}
-		if visited {
-			return &AlreadyVisitedError{parsedURL}
-		}
+// checkRevisit returns AlreadyVisitedError if the request was visited
+// before or is waiting for its robots.txt check, otherwise it stores
+// the request as visited. If pending is true, the request is only
+// reserved until settleVisit is called.
+func (c *Collector) checkRevisit(parsedURL *url.URL, method string, getBody func() (io.ReadCloser, error), pending bool) error {
+	uHash, ok, err := visitHash(parsedURL, method, getBody)
+	if err != nil || !ok {
+		return err
+	}
+	c.lock.RLock()
+	_, waiting := c.pendingVisits[uHash]
+	c.lock.RUnlock()
+	if waiting {
+		return &AlreadyVisitedError{parsedURL}
+	}
+	visited, err := c.isVisited(uHash, parsedURL)
+	if err != nil {
+		return err
+	}
+	if visited {
+		return &AlreadyVisitedError{parsedURL}
+	}
+	if !pending {
 		return c.store.Visited(uHash)
 	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, waiting := c.pendingVisits[uHash]; waiting {
+		return &AlreadyVisitedError{parsedURL}
+	}
+	c.pendingVisits[uHash] = struct{}{}
 	return nil
 }
 
+// settleVisit releases the reservation of a request made by
+// checkRevisit and stores the request as visited if allowed is true
+func (c *Collector) settleVisit(parsedURL *url.URL, method string, getBody func() (io.ReadCloser, error), allowed bool) error {
+	uHash, ok, err := visitHash(parsedURL, method, getBody)
+	if err != nil || !ok {
+		return err
+	}
+	if allowed {
+		err = c.store.Visited(uHash)
+	}
+	c.lock.Lock()
+	delete(c.pendingVisits, uHash)
+	c.lock.Unlock()
+	return err
+}
+
+// visitHash returns the hash of a request used by the visited checks.
+// ok is false if the request is not checked.
+func visitHash(parsedURL *url.URL, method string, getBody func() (io.ReadCloser, error)) (uHash uint64, ok bool, err error) {
+	// TODO weird behaviour, it allows CheckHead to work correctly,
+	// but it should probably better be solved with
+	// "check-but-not-save" flag or something
+	if method != "GET" && getBody == nil {
+		return 0, false, nil
+	}
+
+	var body io.ReadCloser
+	if getBody != nil {
+		body, err = getBody()
+		if err != nil {
+			return 0, false, err
+		}
+		defer body.Close()
+	}
+	return requestHash(parsedURL.String(), body), true, nil
+}
+
 func (c *Collector) checkFilters(URL, domain string) error {
 	if len(c.DisallowedURLFilters) > 0 {
 		if isMatchingFilter(c.DisallowedURLFilters, []byte(URL)) {
@@ -844,67 +1120,6 @@ func (c *Collector) isDomainAllowed(domain string) bool {
 	return slices.Contains(c.AllowedDomains, domain)
 }
 
-func (c *Collector) checkRobots(u *url.URL) error {
-	c.lock.RLock()
-	robot, ok := c.robotsMap[u.Host]
-	c.lock.RUnlock()
-
-	if !ok {
-		// no robots file cached
-
-		// Prepare request,
-		req, err := http.NewRequest("GET", u.Scheme+"://"+u.Host+"/robots.txt", nil)
-		if err != nil {
-			return err
-		}
-		hdr := http.Header{}
-		if c.Headers != nil {
-			for k, v := range *c.Headers {
-				for _, value := range v {
-					hdr.Add(k, value)
-				}
-			}
-		}
-		if _, ok := hdr["User-Agent"]; !ok {
-			hdr.Set("User-Agent", c.UserAgent)
-		}
-		req.Header = hdr
-		// The Go HTTP API ignores "Host" in the headers, preferring the client
-		// to use the Host field on Request.
-		if hostHeader := hdr.Get("Host"); hostHeader != "" {
-			req.Host = hostHeader
-		}
-
-		resp, err := c.backend.Client.Do(req)
-		if err != nil {
-			return err
-		}
-		defer resp.Body.Close()
-
-		robot, err = robotstxt.FromResponse(resp)
-		if err != nil {
-			return err
-		}
-		c.lock.Lock()
-		c.robotsMap[u.Host] = robot
-		c.lock.Unlock()
-	}
-
-	uaGroup := robot.FindGroup(c.UserAgent)
-	if uaGroup == nil {
-		return nil
-	}
-
-	eu := u.EscapedPath()
-	if u.RawQuery != "" {
-		eu += "?" + u.Query().Encode()
-	}
-	if !uaGroup.Test(eu) {
-		return ErrRobotsTxtBlocked
-	}
-	return nil
-}
-
 // String is the text representation of the collector.
 // It contains useful debug information about the collector's internals
 func (c *Collector) String() string {
@@ -1039,6 +1254,27 @@ func (c *Collector) OnError(f ErrorCallback) {
 	c.lock.Unlock()
 }
 
+// OnResponseStream registers a function which receives the body of every
+// response as a stream instead of Response.Body. Registering it switches
+// the collector into streaming mode: response bodies are neither
+// buffered nor limited by MaxBodySize, the cache is bypassed and
+// OnResponse, OnHTML and OnXML callbacks are not called. Use a
+// dedicated collector (e.g. a Clone) for large downloads.
+//
+// The callbacks are called in the order of registration with the same
+// reader, the body can be read only once. The slot of the matching
+// LimitRule is held until the callbacks return. An error returned by a
+// callback is passed to OnError callbacks. Responses are not retried by
+// RetryPolicy in streaming mode.
+func (c *Collector) OnResponseStream(f ResponseStreamCallback) {
+	c.lock.Lock()
+	if c.responseStreamCallbacks == nil {
+		c.responseStreamCallbacks = make([]ResponseStreamCallback, 0, 4)
+	}
+	c.responseStreamCallbacks = append(c.responseStreamCallbacks, f)
+	c.lock.Unlock()
+}
+
 // OnScraped registers a function that will be executed as the final part of
 // the scraping, after OnHTML and OnXML have finished.
 func (c *Collector) OnScraped(f ScrapedCallback) {
@@ -1060,6 +1296,12 @@ func (c *Collector) WithTransport(transport http.RoundTripper) {
 	c.backend.Client.Transport = transport
 }
 
+// Transport returns the http.RoundTripper (transport) of the collector.
+// It is nil if the collector uses http.DefaultTransport.
+func (c *Collector) Transport() http.RoundTripper {
+	return c.backend.Client.Transport
+}
+
 // DisableCookies turns off cookie handling
 func (c *Collector) DisableCookies() {
 	c.backend.Client.Jar = nil
@@ -1082,10 +1324,16 @@ func (c *Collector) SetStorage(s storage.Storage) error {
 		return err
 	}
 	c.store = s
-	c.backend.Client.Jar = createJar(s)
+	c.backend.Client.Jar = createJar(s, c.handleOnCookieError)
 	return nil
 }
 
+// SetCache sets the store of the response cache. It overrides CacheDir.
+// The cache is shared with the clones of the collector.
+func (c *Collector) SetCache(cc cache.Cache) {
+	c.cache = cc
+}
+
 // SetProxy sets a proxy for the collector. This method overrides the previously
 // used http.Transport if the type of the transport is not http.RoundTripper.
 // The proxy type is determined by the URL scheme. "http"
@@ -1176,6 +1424,33 @@ func (c *Collector) handleOnRequestHeaders(r *Request) {
 	}
 }
 
+func (c *Collector) handleOnRetry(r *Request, resp *Response, err error, delay time.Duration) {
+	if c.debugger == nil {
+		return
+	}
+	values := map[string]string{
+		"url":     r.URL.String(),
+		"attempt": strconv.Itoa(r.Attempt),
+		"delay":   delay.String(),
+	}
+	if err != nil {
+		values["error"] = err.Error()
+	} else {
+		values["status"] = http.StatusText(resp.StatusCode)
+	}
+	c.debugger.Event(createEvent("retry", r.ID, c.ID, values))
+}
+
+// handleOnCookieError reports cookies which the storage failed to store
+// as "cookieError" debugger events
+func (c *Collector) handleOnCookieError(err error) {
+	if c.debugger != nil {
+		c.debugger.Event(createEvent("cookieError", 0, c.ID, map[string]string{
+			"error": err.Error(),
+		}))
+	}
+}
+
 func (c *Collector) handleOnHTML(resp *Response) error {
 	c.lock.RLock()
 	htmlCallbacks := slices.Clone(c.htmlCallbacks)
@@ -1362,6 +1637,34 @@ func (c *Collector) cleanupCallbacks() {
 	})
 }
 
+func (c *Collector) handleOnResponseStream(r *Response, body io.Reader) error {
+	c.lock.RLock()
+	responseStreamCallbacks := slices.Clone(c.responseStreamCallbacks)
+	c.lock.RUnlock()
+
+	if c.debugger != nil {
+		c.debugger.Event(createEvent("responseStream", r.Request.ID, c.ID, map[string]string{
+			"url":    r.Request.URL.String(),
+			"status": http.StatusText(r.StatusCode),
+		}))
+	}
+	for _, f := range responseStreamCallbacks {
+		if err := f(r, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Collector) handleOnTruncated(r *Response) {
+	if c.debugger != nil {
+		c.debugger.Event(createEvent("truncated", r.Request.ID, c.ID, map[string]string{
+			"url":  r.Request.URL.String(),
+			"size": strconv.Itoa(len(r.Body)),
+		}))
+	}
+}
+
 func (c *Collector) handleOnScraped(r *Response) {
 	if c.debugger != nil {
 		c.debugger.Event(createEvent("scraped", r.Request.ID, c.ID, map[string]string{
@@ -1381,11 +1684,34 @@ func (c *Collector) Limit(rule *LimitRule) error {
 	return c.backend.Limit(rule)
 }
 
+// DomainLimit returns the number of concurrent requests allowed to the
+// domain by the matching LimitRule and the number of requests currently
+// holding a slot of the rule. limit is 0 if no LimitRule matches the domain.
+func (c *Collector) DomainLimit(domain string) (limit, active int) {
+	r := c.backend.GetMatchingRule(domain)
+	if r == nil {
+		return 0, 0
+	}
+	return r.slots(domain)
+}
+
 // Limits adds new LimitRules to the collector
 func (c *Collector) Limits(rules []*LimitRule) error {
 	return c.backend.Limits(rules)
 }
 
+// SetDomainRevisitAfter sets the duration after which a visited URL of
+// the given domain can be visited again. It overrides c.RevisitAfter
+// for the domain.
+func (c *Collector) SetDomainRevisitAfter(domain string, d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.DomainRevisitAfter == nil {
+		c.DomainRevisitAfter = make(map[string]time.Duration)
+	}
+	c.DomainRevisitAfter[domain] = d
+}
+
 // SetRedirectHandler instructs the Collector to allow multiple downloads of the same URL
 func (c *Collector) SetRedirectHandler(f func(req *http.Request, via []*http.Request) error) {
 	c.redirectHandler = f
@@ -1417,6 +1743,45 @@ func (c *Collector) Cookies(URL string) []*http.Cookie {
 	return c.backend.Client.Jar.Cookies(u)
 }
 
+// ImportCookies adds cookie records to the cookie jar of the Collector,
+// e.g. cookies of a browser session loaded by storage.ReadNetscapeCookies.
+// The records are stored unchanged, which requires a storage
+// implementing storage.CookieStorage, unless a cookie jar is set by
+// SetCookieJar.
+func (c *Collector) ImportCookies(cookies []*storage.Cookie) error {
+	jar := c.backend.Client.Jar
+	if jar == nil {
+		return ErrNoCookieJar
+	}
+	if j, ok := jar.(*cookieJarSerializer); ok {
+		cs, ok := j.store.(storage.CookieStorage)
+		if !ok {
+			return ErrNoCookieStorage
+		}
+		return cs.SetCookieRecords(cookies)
+	}
+	for _, r := range cookies {
+		scheme := "http"
+		if r.Secure {
+			scheme = "https"
+		}
+		u := &url.URL{Scheme: scheme, Host: r.Domain, Path: r.Path}
+		jar.SetCookies(u, []*http.Cookie{r.HTTPCookie()})
+	}
+	return nil
+}
+
+// ExportCookies returns every cookie stored by the Collector. It requires
+// a storage implementing storage.CookieStorage, see Collector.SetStorage.
+func (c *Collector) ExportCookies() ([]*storage.Cookie, error) {
+	if j, ok := c.backend.Client.Jar.(*cookieJarSerializer); ok {
+		if cs, ok := j.store.(storage.CookieStorage); ok {
+			return cs.AllCookieRecords()
+		}
+	}
+	return nil, ErrNoCookieStorage
+}
+
 // Clone creates an exact copy of a Collector without callbacks.
 // HTTP backend, robots.txt cache and cookie jar are shared
 // between collectors.
@@ -1424,13 +1789,21 @@ func (c *Collector) Clone() *Collector {
 	return &Collector{
 		AllowedDomains:         c.AllowedDomains,
 		AllowURLRevisit:        c.AllowURLRevisit,
+		RevisitAfter:           c.RevisitAfter,
+		RetryPolicy:            c.RetryPolicy,
+		DomainRevisitAfter:     c.DomainRevisitAfter,
 		CacheDir:               c.CacheDir,
 		CacheExpiration:        c.CacheExpiration,
+		HTTPCache:              c.HTTPCache,
 		DetectCharset:          c.DetectCharset,
 		DisallowedDomains:      c.DisallowedDomains,
 		ID:                     atomic.AddUint32(&collectorCounter, 1),
 		IgnoreRobotsTxt:        c.IgnoreRobotsTxt,
+		HonorCrawlDelay:        c.HonorCrawlDelay,
+		RobotsUserAgent:        c.RobotsUserAgent,
+		RobotsTTL:              c.RobotsTTL,
 		MaxBodySize:            c.MaxBodySize,
+		TruncatedBodyError:     c.TruncatedBodyError,
 		MaxDepth:               c.MaxDepth,
 		MaxRequests:            c.MaxRequests,
 		DisallowedURLFilters:   c.DisallowedURLFilters,
@@ -1442,6 +1815,7 @@ func (c *Collector) Clone() *Collector {
 		TraceHTTP:              c.TraceHTTP,
 		Context:                c.Context,
 		store:                  c.store,
+		cache:                  c.cache,
 		backend:                c.backend,
 		debugger:               c.debugger,
 		Async:                  c.Async,
@@ -1454,6 +1828,7 @@ func (c *Collector) Clone() *Collector {
 		requestCallbacks:       make([]RequestCallback, 0, 8),
 		responseCallbacks:      make([]ResponseCallback, 0, 8),
 		robotsMap:              c.robotsMap,
+		pendingVisits:          c.pendingVisits,
 		wg:                     &sync.WaitGroup{},
 	}
 }
@@ -1494,7 +1869,7 @@ func (c *Collector) checkRedirectFunc() func(req *http.Request, via []*http.Requ
 				defer body.Close()
 			}
 			uHash := requestHash(req.URL.String(), body)
-			visited, err := c.store.IsVisited(uHash)
+			visited, err := c.isVisited(uHash, req.URL)
 			if err != nil {
 				return err
 			}
@@ -1545,7 +1920,38 @@ func (c *Collector) parseSettingsFromEnv() {
 
 func (c *Collector) checkHasVisited(URL string, requestData map[string]string) (bool, error) {
 	hash := requestHash(URL, createFormReader(requestData))
-	return c.store.IsVisited(hash)
+	u, err := url.Parse(URL)
+	if err != nil {
+		return c.store.IsVisited(hash)
+	}
+	return c.isVisited(hash, u)
+}
+
+// isVisited reports whether the request is stored as visited. Visits
+// older than the revisit interval of the domain are treated as unvisited.
+func (c *Collector) isVisited(requestID uint64, u *url.URL) (bool, error) {
+	visited, err := c.store.IsVisited(requestID)
+	if err != nil || !visited {
+		return visited, err
+	}
+	interval := c.RevisitAfter
+	c.lock.RLock()
+	if d, ok := c.DomainRevisitAfter[u.Hostname()]; ok {
+		interval = d
+	}
+	c.lock.RUnlock()
+	if interval <= 0 {
+		return true, nil
+	}
+	s, ok := c.store.(storage.VisitTimeStorage)
+	if !ok {
+		return true, nil
+	}
+	t, visited, err := s.VisitedAt(requestID)
+	if err != nil || !visited {
+		return visited, err
+	}
+	return time.Since(t) < interval, nil
 }
 
 // SanitizeFileName replaces dangerous characters in a string
@@ -1609,11 +2015,24 @@ func isYesString(s string) bool {
 	return false
 }
 
-func createJar(s storage.Storage) http.CookieJar {
-	return &cookieJarSerializer{store: s, lock: &sync.RWMutex{}}
+func createJar(s storage.Storage, onError func(error)) http.CookieJar {
+	return &cookieJarSerializer{store: s, lock: &sync.RWMutex{}, onError: onError}
 }
 
 func (j *cookieJarSerializer) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	if cs, ok := j.store.(storage.CookieStorage); ok {
+		now := time.Now()
+		records := make([]*storage.Cookie, 0, len(cookies))
+		for _, c := range cookies {
+			if r := storage.NewCookie(u, c, now); r != nil {
+				records = append(records, r)
+			}
+		}
+		if err := cs.SetCookieRecords(records); err != nil && j.onError != nil {
+			j.onError(err)
+		}
+		return
+	}
 	j.lock.Lock()
 	defer j.lock.Unlock()
 	cookieStr := j.store.Cookies(u)
@@ -1631,6 +2050,17 @@ func (j *cookieJarSerializer) SetCookies(u *url.URL, cookies []*http.Cookie) {
 }
 
 func (j *cookieJarSerializer) Cookies(u *url.URL) []*http.Cookie {
+	if cs, ok := j.store.(storage.CookieStorage); ok {
+		records, err := storage.CookiesForURL(cs, u)
+		if err != nil {
+			return nil
+		}
+		cookies := make([]*http.Cookie, len(records))
+		for i, r := range records {
+			cookies[i] = &http.Cookie{Name: r.Name, Value: r.Value}
+		}
+		return cookies
+	}
 	cookies := storage.UnstringifyCookies(j.store.Cookies(u))
 	// Filter.
 	now := time.Now()
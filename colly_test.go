@@ -17,16 +17,23 @@ package colly
 import (
 	"bufio"
 	"bytes"
+	"compress/flate"
 	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -34,8 +41,11 @@ import (
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
+	"github.com/temoto/robotstxt"
 
+	"github.com/gocolly/colly/v2/cache"
 	"github.com/gocolly/colly/v2/debug"
+	"github.com/gocolly/colly/v2/storage"
 )
 
 var serverIndexResponse = []byte("hello world\n")
@@ -68,6 +78,10 @@ const testXML = `<?xml version="1.0" encoding="UTF-8"?>
 
 const custom404 = `404 not found`
 
+const streamTestSize = 5 << 20
+
+const encodingTestBody = "<html><body>encoded content</body></html>"
+
 func newUnstartedTestServer() *httptest.Server {
 	mux := http.NewServeMux()
 
@@ -314,6 +328,141 @@ y">link</a>
 		w.Write([]byte(`<!DOCTYPE html><html><body><h1>404 Not Found</h1></body></html>`))
 	})
 
+	var retryLock sync.Mutex
+	retryCalls := make(map[string]int)
+	mux.HandleFunc("/retry", func(w http.ResponseWriter, r *http.Request) {
+		// fails the first "fail" requests of each URL with "status"
+		q := r.URL.Query()
+		fail, _ := strconv.Atoi(q.Get("fail"))
+		status, _ := strconv.Atoi(q.Get("status"))
+		retryLock.Lock()
+		retryCalls[r.URL.RawQuery]++
+		calls := retryCalls[r.URL.RawQuery]
+		retryLock.Unlock()
+		body, _ := io.ReadAll(r.Body)
+		if calls <= fail {
+			if retryAfter := q.Get("retry_after"); retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(status)
+			return
+		}
+		w.Write(append([]byte("ok "), body...))
+	})
+
+	mux.HandleFunc("/cache/etag", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("etag body"))
+	})
+
+	mux.HandleFunc("/cache/last_modified", func(w http.ResponseWriter, r *http.Request) {
+		lastModified := "Mon, 02 Jan 2006 15:04:05 GMT"
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Last-Modified", lastModified)
+		if r.Header.Get("If-Modified-Since") == lastModified {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("last-modified body"))
+	})
+
+	mux.HandleFunc("/cache/fresh", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("fresh body"))
+	})
+
+	mux.HandleFunc("/cache/expires", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Expires", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat))
+		w.Write([]byte("expired body"))
+	})
+
+	mux.HandleFunc("/cache/no_store", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte("no-store body"))
+	})
+
+	mux.HandleFunc("/cache/vary", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte(r.Header.Get("Accept-Language")))
+	})
+
+	mux.HandleFunc("/cache/partial", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Range", "bytes 0-6/20")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte("partial"))
+	})
+
+	mux.HandleFunc("/cache/not_modified", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.WriteHeader(http.StatusNotModified)
+	})
+
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(bytes.Repeat([]byte{'x'}, streamTestSize))
+	})
+
+	mux.HandleFunc("/stream_gzip", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gw := gzip.NewWriter(w)
+		gw.Write(bytes.Repeat([]byte{'x'}, streamTestSize))
+		gw.Close()
+	})
+
+	mux.HandleFunc("/download/file.bin", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "file.bin", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), bytes.NewReader(downloadTestContent(n)))
+	})
+
+	mux.HandleFunc("/deflate", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "deflate")
+		zw := zlib.NewWriter(w)
+		zw.Write([]byte(encodingTestBody))
+		zw.Close()
+	})
+
+	mux.HandleFunc("/raw_deflate", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "deflate")
+		fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+		fw.Write([]byte(encodingTestBody))
+		fw.Close()
+	})
+
+	mux.HandleFunc("/stacked_encoding", func(w http.ResponseWriter, r *http.Request) {
+		var deflated bytes.Buffer
+		zw := zlib.NewWriter(&deflated)
+		zw.Write([]byte(encodingTestBody))
+		zw.Close()
+		w.Header().Set("Content-Encoding", "deflate, X-Gzip")
+		gw := gzip.NewWriter(w)
+		gw.Write(deflated.Bytes())
+		gw.Close()
+	})
+
+	mux.HandleFunc("/custom_encoding", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "x-upper")
+		w.Write([]byte(strings.ToUpper(encodingTestBody)))
+	})
+
+	mux.HandleFunc("/brotli", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "br")
+		w.Write([]byte{0x0b, 0x02, 0x80})
+	})
+
+	mux.HandleFunc("/bogus_encoding", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "utf-8")
+		w.Write([]byte(encodingTestBody))
+	})
+
 	return httptest.NewUnstartedServer(mux)
 }
 
@@ -323,6 +472,59 @@ func newTestServer() *httptest.Server {
 	return srv
 }
 
+// countingTransport counts the requests per path and the responses
+// per status code sent by a collector.
+type countingTransport struct {
+	lock     sync.Mutex
+	paths    map[string]int
+	statuses map[int]int
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := http.DefaultTransport.RoundTrip(req)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.paths == nil {
+		t.paths = make(map[string]int)
+		t.statuses = make(map[int]int)
+	}
+	t.paths[req.URL.Path]++
+	if res != nil {
+		t.statuses[res.StatusCode]++
+	}
+	return res, err
+}
+
+func (t *countingTransport) requests(path string) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.paths[path]
+}
+
+func (t *countingTransport) responses(status int) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.statuses[status]
+}
+
+// downloadTestContent returns the content of /download/file.bin?n=n
+func downloadTestContent(n int) []byte {
+	return bytes.Repeat([]byte("0123456789"), n)
+}
+
+type eventRecorder struct {
+	lock   sync.Mutex
+	events []*debug.Event
+}
+
+func (r *eventRecorder) Init() error { return nil }
+
+func (r *eventRecorder) Event(e *debug.Event) {
+	r.lock.Lock()
+	r.events = append(r.events, e)
+	r.lock.Unlock()
+}
+
 var newCollectorTests = map[string]func(*testing.T){
 	"UserAgent": func(t *testing.T) {
 		for _, ua := range []string{
@@ -681,6 +883,85 @@ func TestCollectorVisitResponseHeaders(t *testing.T) {
 	}
 }
 
+func TestOnResponseStream(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	for _, path := range []string{"/stream", "/stream_gzip"} {
+		c := NewCollector(MaxBodySize(1 << 20))
+		var n int64
+		c.OnResponseStream(func(r *Response, body io.Reader) error {
+			if r.Body != nil || r.StatusCode != http.StatusOK {
+				t.Errorf("unexpected response: %d %d", r.StatusCode, len(r.Body))
+			}
+			var err error
+			n, err = io.Copy(io.Discard, body)
+			return err
+		})
+		c.OnResponse(func(r *Response) {
+			t.Error("OnResponse called in streaming mode")
+		})
+		scraped := false
+		c.OnScraped(func(r *Response) {
+			scraped = true
+		})
+		c.OnError(func(r *Response, err error) {
+			t.Errorf("unexpected error: %v", err)
+		})
+		if err := c.Visit(ts.URL + path); err != nil {
+			t.Fatal(err)
+		}
+		if n != streamTestSize || !scraped {
+			t.Errorf("%s: streamed %d bytes, scraped %v", path, n, scraped)
+		}
+	}
+}
+
+func TestOnResponseStreamErrors(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	c := NewCollector(AllowURLRevisit())
+	errStream := errors.New("stream error")
+	called := 0
+	c.OnResponseStream(func(r *Response, body io.Reader) error {
+		called++
+		return errStream
+	})
+	var errs []error
+	c.OnError(func(r *Response, err error) {
+		errs = append(errs, err)
+	})
+	c.Visit(ts.URL + "/500")
+	c.Visit(ts.URL + "/stream")
+	if called != 1 || len(errs) != 2 || errs[1] != errStream {
+		t.Errorf("unexpected errors: %d calls, %v", called, errs)
+	}
+}
+
+func TestOnResponseStreamRegisterAsync(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	c := NewCollector(Async(true), AllowURLRevisit())
+	var streamed atomic.Int32
+	c.OnResponseStream(func(r *Response, body io.Reader) error {
+		streamed.Add(1)
+		c.OnResponseStream(func(r *Response, body io.Reader) error {
+			return nil
+		})
+		_, err := io.Copy(io.Discard, body)
+		return err
+	})
+	for i := 0; i < 4; i++ {
+		c.Visit(ts.URL + "/")
+	}
+	c.Wait()
+	if streamed.Load() != 4 {
+		t.Errorf("wrong number of streamed responses: %d", streamed.Load())
+	}
+}
+
 func TestCollectorOnHTML(t *testing.T) {
 	ts := newTestServer()
 	defer ts.Close()
@@ -782,6 +1063,47 @@ func TestCollectorURLRevisit(t *testing.T) {
 	}
 }
 
+func TestCollectorRevisitAfter(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	c := NewCollector(RevisitAfter(50 * time.Millisecond))
+
+	visitCount := 0
+
+	c.OnRequest(func(r *Request) {
+		visitCount++
+	})
+
+	c.Visit(ts.URL)
+	if err := c.Visit(ts.URL); err == nil {
+		t.Error("URL revisited before RevisitAfter elapsed")
+	}
+	if visited, _ := c.HasVisited(ts.URL); !visited {
+		t.Error("URL should be visited")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if visited, _ := c.HasVisited(ts.URL); visited {
+		t.Error("visit should be expired")
+	}
+	if err := c.Visit(ts.URL); err != nil {
+		t.Errorf("expired URL not revisited: %v", err)
+	}
+	if visitCount != 2 {
+		t.Errorf("wrong visit count: %d", visitCount)
+	}
+
+	u, _ := url.Parse(ts.URL)
+	c.SetDomainRevisitAfter(u.Hostname(), time.Hour)
+	time.Sleep(60 * time.Millisecond)
+
+	if err := c.Visit(ts.URL); err == nil {
+		t.Error("DomainRevisitAfter should override RevisitAfter")
+	}
+}
+
 func TestCollectorPostRevisit(t *testing.T) {
 	ts := newTestServer()
 	defer ts.Close()
@@ -1264,6 +1586,117 @@ func TestCollectorCookies(t *testing.T) {
 	}
 }
 
+func TestCollectorStructuredCookies(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	c := NewCollector()
+	s := &storage.FileStorage{Path: filepath.Join(t.TempDir(), "colly.log")}
+	if err := c.SetStorage(s); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := c.Visit(ts.URL + "/set_cookie"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Visit(ts.URL + "/check_cookie"); err != nil {
+		t.Fatalf("Failed to use previously set cookies: %s", err)
+	}
+	u, _ := url.Parse(ts.URL)
+	if cookies := s.Cookies(u); cookies != "test=testv" {
+		t.Errorf("storage and cookie jar differ: %q", cookies)
+	}
+
+	c.SetCookies("http://www.example.com/", []*http.Cookie{
+		{Name: "shared", Value: "1", Domain: "example.com"},
+	})
+	if cookies := c.Cookies("http://api.example.com/"); len(cookies) != 1 || cookies[0].Name != "shared" {
+		t.Errorf("domain cookie should be shared across subdomains, got %v", cookies)
+	}
+
+	err := c.ImportCookies([]*storage.Cookie{
+		{Name: "imported", Value: "2", Domain: "example.org", Path: "/", HostOnly: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cookies := c.Cookies("http://example.org/"); len(cookies) != 1 || cookies[0].Value != "2" {
+		t.Errorf("imported cookie not found, got %v", cookies)
+	}
+	if cookies := c.Cookies("http://www.example.org/"); len(cookies) != 0 {
+		t.Errorf("host-only cookie sent to subdomain: %v", cookies)
+	}
+
+	exported, err := c.ExportCookies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exported) != 3 {
+		t.Errorf("wrong number of exported cookies: %d", len(exported))
+	}
+
+	// the default storage keeps cookie records too
+	c = NewCollector()
+	if err := c.Visit(ts.URL + "/set_cookie"); err != nil {
+		t.Fatal(err)
+	}
+	exported, err = c.ExportCookies()
+	if err != nil || len(exported) != 1 || exported[0].Name != "test" {
+		t.Fatalf("unexpected exported cookies: %v %v", exported, err)
+	}
+	c = NewCollector()
+	if err := c.ImportCookies(exported); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Visit(ts.URL + "/check_cookie"); err != nil {
+		t.Errorf("imported cookies not sent: %s", err)
+	}
+
+	c = NewCollector()
+	if err := c.SetStorage(&storage.BloomStorage{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ExportCookies(); err != ErrNoCookieStorage {
+		t.Errorf("ExportCookies should fail without cookie storage, got %v", err)
+	}
+	if err := c.ImportCookies(exported); err != ErrNoCookieStorage {
+		t.Errorf("ImportCookies should fail without cookie storage, got %v", err)
+	}
+
+	recorder := &eventRecorder{}
+	c = NewCollector(Debugger(recorder))
+	if err := c.SetStorage(&failingCookieStorage{}); err != nil {
+		t.Fatal(err)
+	}
+	c.Visit(ts.URL + "/set_cookie")
+	found := false
+	for _, e := range recorder.events {
+		if e.Type == "cookieError" && e.Values["error"] == "cookie storage failed" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("cookie storage error not reported")
+	}
+}
+
+type failingCookieStorage struct {
+	storage.InMemoryStorage
+}
+
+func (s *failingCookieStorage) SetCookieRecords([]*storage.Cookie) error {
+	return errors.New("cookie storage failed")
+}
+
+func (s *failingCookieStorage) CookieRecords(string) ([]*storage.Cookie, error) {
+	return nil, nil
+}
+
+func (s *failingCookieStorage) AllCookieRecords() ([]*storage.Cookie, error) {
+	return nil, nil
+}
+
 func TestRobotsWhenAllowed(t *testing.T) {
 	ts := newTestServer()
 	defer ts.Close()
@@ -1352,45 +1785,446 @@ func TestConnectionErrorOnRobotsTxtResultsInError(t *testing.T) {
 	}
 }
 
-func TestEnvSettings(t *testing.T) {
-	ts := newTestServer()
-	defer ts.Close()
+func TestRobotsDelay(t *testing.T) {
+	body := []byte(`User-agent: *
+Crawl-delay: 1
 
-	os.Setenv("COLLY_USER_AGENT", "test")
-	defer os.Unsetenv("COLLY_USER_AGENT")
+User-agent: slowbot
+Crawl-delay: 2
+Request-rate: 1/5s # five seconds
 
-	c := NewCollector()
+User-agent: fastbot
+Request-rate: 30/1m 0600-0845
+`)
+	robot, err := robotstxt.FromBytes(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		userAgent string
+		delay     time.Duration
+	}{
+		{"colly", time.Second},
+		{"SlowBot/1.0", 5 * time.Second},
+		{"fastbot", 2 * time.Second},
+	}
+	for _, tt := range tests {
+		if d := robotsDelay(robot, body, tt.userAgent); d != tt.delay {
+			t.Errorf("unexpected delay of %q: %v", tt.userAgent, d)
+		}
+	}
 
-	valid := false
+	for _, v := range []string{"", "1", "0/5", "1/x", "1/-5"} {
+		if _, ok := parseRequestRate(v); ok {
+			t.Errorf("invalid request rate %q accepted", v)
+		}
+	}
+	if d, _ := parseRequestRate("1/2h"); d != 2*time.Hour {
+		t.Errorf("unexpected request rate delay: %v", d)
+	}
+	if d := robotsDelay(robot, []byte("User-agent: *\nRequest-rate: 1/1h\n"), "colly"); d != maxCrawlDelay {
+		t.Errorf("delay not capped: %v", d)
+	}
+}
 
-	c.OnResponse(func(resp *Response) {
-		if string(resp.Body) == "test" {
-			valid = true
+func TestCollectorHonorCrawlDelay(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			w.Write([]byte("User-agent: *\nRequest-rate: 10/1s\n"))
+			return
 		}
-	})
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
 
-	c.Visit(ts.URL + "/user_agent")
+	c := NewCollector(AllowURLRevisit(), Async(), HonorCrawlDelay())
+	c.IgnoreRobotsTxt = false
+	// the stricter robots.txt delay applies
+	if err := c.Limit(&LimitRule{DomainGlob: "*", Parallelism: 4, Delay: 20 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		c.Visit(ts.URL)
+	}
+	c.Wait()
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("5 requests with 100ms crawl delay finished in %v", elapsed)
+	}
 
-	if !valid {
-		t.Fatalf("Wrong user-agent from environment")
+	c = NewCollector(AllowURLRevisit(), Async())
+	c.IgnoreRobotsTxt = false
+	start = time.Now()
+	for i := 0; i < 5; i++ {
+		c.Visit(ts.URL)
+	}
+	c.Wait()
+	if elapsed := time.Since(start); elapsed >= 400*time.Millisecond {
+		t.Errorf("crawl delay applied without HonorCrawlDelay: %v", elapsed)
+	}
+
+	// robots.txt becoming unavailable drops the crawl delay
+	c = NewCollector(HonorCrawlDelay())
+	c.parseRobots("example.com", http.StatusOK, []byte("User-agent: *\nCrawl-delay: 1\n"), time.Now(), &robotsEntry{})
+	c.backend.crawlDelays.reserve("example.com")
+	d, cancel := c.backend.crawlDelays.reserve("example.com")
+	if d <= 0 {
+		t.Fatalf("crawl delay not set: %v", d)
+	}
+	// a cancelled wait gives its reservation back
+	cancel()
+	if d, _ := c.backend.crawlDelays.reserve("example.com"); d > time.Second {
+		t.Errorf("cancelled reservation kept: %v", d)
+	}
+	c.parseRobots("example.com", http.StatusNotFound, nil, time.Now(), &robotsEntry{})
+	if d, _ := c.backend.crawlDelays.reserve("example.com"); d != 0 {
+		t.Errorf("crawl delay kept after robots.txt became unavailable: %v", d)
+	}
+	if n := len(c.backend.crawlDelays.next); n != 0 {
+		t.Errorf("next requests of %d hosts kept after robots.txt became unavailable", n)
 	}
 }
 
-func TestUserAgent(t *testing.T) {
-	const exampleUserAgent1 = "Example/1.0"
-	const exampleUserAgent2 = "Example/2.0"
-	const defaultUserAgent = "colly - https://github.com/gocolly/colly"
+func TestRobotsTxtStatus(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusNotFound)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			if s := int(status.Load()); s != http.StatusOK {
+				w.WriteHeader(s)
+				return
+			}
+			w.Write([]byte(robotsFile))
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	transport := &countingTransport{}
+	c := NewCollector(AllowURLRevisit())
+	c.IgnoreRobotsTxt = false
+	c.WithTransport(transport)
+	if err := c.Visit(ts.URL + "/disallowed"); err != nil {
+		t.Errorf("missing robots.txt must allow everything: %v", err)
+	}
+
+	status.Store(http.StatusServiceUnavailable)
+	c = NewCollector(AllowURLRevisit())
+	c.IgnoreRobotsTxt = false
+	c.WithTransport(transport)
+	if err := c.Visit(ts.URL + "/allowed"); !errors.Is(err, ErrRobotsTxtBlocked) {
+		t.Errorf("unavailable robots.txt must disallow everything: %v", err)
+	}
+
+	// the host is disallowed until robots.txt is fetched again
+	status.Store(http.StatusOK)
+	if err := c.Visit(ts.URL + "/allowed"); !errors.Is(err, ErrRobotsTxtBlocked) {
+		t.Errorf("robots.txt fetched again before the retry delay: %v", err)
+	}
+	host := strings.TrimPrefix(ts.URL, "http://")
+	c.robotsMap[host].expires = time.Now()
+	if err := c.Visit(ts.URL + "/allowed"); err != nil {
+		t.Error(err)
+	}
+	if err := c.Visit(ts.URL + "/disallowed"); !errors.Is(err, ErrRobotsTxtBlocked) {
+		t.Errorf("expected ErrRobotsTxtBlocked, got %v", err)
+	}
+
+	// a previously fetched robots.txt is used while the host is unavailable
+	status.Store(http.StatusInternalServerError)
+	c.robotsMap[host].expires = time.Now()
+	if err := c.Visit(ts.URL + "/allowed"); err != nil {
+		t.Error(err)
+	}
+	if n := transport.requests("/robots.txt"); n != 4 {
+		t.Errorf("expected 4 robots.txt fetches, got %d", n)
+	}
+}
 
+func TestRobotsTxtCallbackVisit(t *testing.T) {
 	ts := newTestServer()
 	defer ts.Close()
 
-	var receivedUserAgent string
-
-	func() {
-		c := NewCollector()
-		c.OnResponse(func(resp *Response) {
-			receivedUserAgent = string(resp.Body)
-		})
+	c := NewCollector()
+	c.IgnoreRobotsTxt = false
+	// OnRequest isn't called for robots.txt, so visiting the host from
+	// it doesn't wait for the robots.txt fetch
+	c.OnRequest(func(r *Request) {
+		c.Visit(ts.URL + "/allowed")
+	})
+	done := make(chan error)
+	go func() {
+		done <- c.Visit(ts.URL + "/allowed")
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("visit from OnRequest blocked")
+	}
+}
+
+func TestRobotsTxtPipeline(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	cacheDir := t.TempDir()
+	transport := &countingTransport{}
+	recorder := &eventRecorder{}
+	c := NewCollector(CacheDir(cacheDir), Debugger(recorder))
+	c.IgnoreRobotsTxt = false
+	c.WithTransport(transport)
+	var requested []string
+	c.OnRequest(func(r *Request) {
+		requested = append(requested, r.URL.Path)
+	})
+	if err := c.Visit(ts.URL + "/allowed"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(requested, ",") != "/allowed" {
+		t.Errorf("unexpected OnRequest calls: %v", requested)
+	}
+	found := false
+	for _, e := range recorder.events {
+		if e.Type == "robots" && e.Values["url"] == ts.URL+"/robots.txt" && e.Values["status"] == "OK" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("no robots debugger event")
+	}
+
+	// robots.txt is served from the response cache
+	c = NewCollector(CacheDir(cacheDir))
+	c.IgnoreRobotsTxt = false
+	c.WithTransport(transport)
+	if err := c.Visit(ts.URL + "/disallowed"); !errors.Is(err, ErrRobotsTxtBlocked) {
+		t.Errorf("expected ErrRobotsTxtBlocked, got %v", err)
+	}
+	if n := transport.requests("/robots.txt"); n != 1 {
+		t.Errorf("expected 1 robots.txt fetch, got %d", n)
+	}
+}
+
+func TestRobotsTxtAsync(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	transport := &countingTransport{}
+	c := NewCollector(Async())
+	c.IgnoreRobotsTxt = false
+	c.WithTransport(transport)
+	var blocked, visited atomic.Int32
+	c.OnError(func(r *Response, err error) {
+		if errors.Is(err, ErrRobotsTxtBlocked) {
+			blocked.Add(1)
+		} else {
+			t.Error(err)
+		}
+	})
+	c.OnResponse(func(r *Response) {
+		visited.Add(1)
+	})
+	for i := 0; i < 5; i++ {
+		if err := c.Visit(fmt.Sprintf("%s/allowed/%d", ts.URL, i)); err != nil {
+			t.Error(err)
+		}
+		if err := c.Visit(fmt.Sprintf("%s/disallowed/%d", ts.URL, i)); err != nil {
+			t.Error(err)
+		}
+	}
+	c.Wait()
+	if blocked.Load() != 5 || visited.Load() != 5 {
+		t.Errorf("expected 5 blocked and 5 visited requests, got %d and %d", blocked.Load(), visited.Load())
+	}
+	if n := transport.requests("/robots.txt"); n != 1 {
+		t.Errorf("expected 1 robots.txt fetch, got %d", n)
+	}
+
+	// blocked requests are reported to OnError after robots.txt is
+	// cached as well, and they aren't stored as visited
+	for i := 0; i < 2; i++ {
+		if err := c.Visit(ts.URL + "/disallowed/0"); err != nil {
+			t.Error(err)
+		}
+		c.Wait()
+	}
+	if blocked.Load() != 7 {
+		t.Errorf("expected 7 blocked requests, got %d", blocked.Load())
+	}
+	if err := c.Visit(ts.URL + "/allowed/0"); !errors.As(err, new(*AlreadyVisitedError)) {
+		t.Errorf("expected AlreadyVisitedError, got %v", err)
+	}
+}
+
+func TestRobotsTxtAsyncDuplicateVisit(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	c := NewCollector(Async())
+	c.IgnoreRobotsTxt = false
+	var errs, visited atomic.Int32
+	c.OnError(func(r *Response, err error) {
+		errs.Add(1)
+	})
+	c.OnResponse(func(r *Response) {
+		visited.Add(1)
+	})
+	for i := 0; i < 3; i++ {
+		err := c.Visit(ts.URL + "/allowed/0")
+		if i == 0 && err != nil {
+			t.Error(err)
+		}
+		if i > 0 && !errors.As(err, new(*AlreadyVisitedError)) {
+			t.Errorf("visit %d: expected AlreadyVisitedError, got %v", i, err)
+		}
+	}
+	c.Wait()
+	if visited.Load() != 1 || errs.Load() != 0 {
+		t.Errorf("expected 1 response and no errors, got %d and %d", visited.Load(), errs.Load())
+	}
+
+	// the reservation of a blocked request is released
+	for i := 0; i < 2; i++ {
+		if err := c.Visit(ts.URL + "/disallowed/0"); err != nil {
+			t.Error(err)
+		}
+		c.Wait()
+	}
+	if errs.Load() != 2 {
+		t.Errorf("expected 2 blocked requests, got %d", errs.Load())
+	}
+}
+
+func TestRobotsUserAgent(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			w.Write([]byte("User-agent: mybot\nDisallow: /\n"))
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	const userAgent = "Mozilla/5.0 (compatible; mybot/1.0)"
+	c := NewCollector(UserAgent(userAgent))
+	c.IgnoreRobotsTxt = false
+	if err := c.Visit(ts.URL + "/a"); err != nil {
+		t.Errorf("the group of the product token matched the User-Agent: %v", err)
+	}
+
+	c = NewCollector(UserAgent(userAgent), RobotsUserAgent("MyBot"))
+	c.IgnoreRobotsTxt = false
+	if err := c.Visit(ts.URL + "/a"); !errors.Is(err, ErrRobotsTxtBlocked) {
+		t.Errorf("expected ErrRobotsTxtBlocked, got %v", err)
+	}
+}
+
+func TestRobotsTxtTTL(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	transport := &countingTransport{}
+	c := NewCollector(AllowURLRevisit(), RobotsTTL(50*time.Millisecond))
+	c.IgnoreRobotsTxt = false
+	c.WithTransport(transport)
+	c.Visit(ts.URL + "/allowed")
+	c.Visit(ts.URL + "/allowed")
+	if n := transport.requests("/robots.txt"); n != 1 {
+		t.Fatalf("expected 1 robots.txt fetch, got %d", n)
+	}
+	time.Sleep(60 * time.Millisecond)
+	c.Visit(ts.URL + "/allowed")
+	if n := transport.requests("/robots.txt"); n != 2 {
+		t.Errorf("expired robots.txt not fetched again, %d fetches", n)
+	}
+}
+
+func TestRobotsTxtStorage(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	path := filepath.Join(t.TempDir(), "colly.log")
+	transport := &countingTransport{}
+	newCollector := func(options ...CollectorOption) (*Collector, *storage.FileStorage) {
+		c := NewCollector(options...)
+		c.IgnoreRobotsTxt = false
+		c.WithTransport(transport)
+		s := &storage.FileStorage{Path: path}
+		if err := c.SetStorage(s); err != nil {
+			t.Fatal(err)
+		}
+		return c, s
+	}
+
+	c, s := newCollector()
+	if err := c.Visit(ts.URL + "/allowed"); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// the stored robots.txt is used after a restart
+	c, s = newCollector()
+	if err := c.Visit(ts.URL + "/disallowed"); !errors.Is(err, ErrRobotsTxtBlocked) {
+		t.Errorf("expected ErrRobotsTxtBlocked, got %v", err)
+	}
+	s.Close()
+	if n := transport.requests("/robots.txt"); n != 1 {
+		t.Errorf("expected 1 robots.txt fetch, got %d", n)
+	}
+
+	// expired robots.txt files are fetched again
+	time.Sleep(10 * time.Millisecond)
+	c, s = newCollector(RobotsTTL(5 * time.Millisecond))
+	defer s.Close()
+	c.Visit(ts.URL + "/allowed/2")
+	if n := transport.requests("/robots.txt"); n != 2 {
+		t.Errorf("expected 2 robots.txt fetches, got %d", n)
+	}
+}
+
+func TestEnvSettings(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	os.Setenv("COLLY_USER_AGENT", "test")
+	defer os.Unsetenv("COLLY_USER_AGENT")
+
+	c := NewCollector()
+
+	valid := false
+
+	c.OnResponse(func(resp *Response) {
+		if string(resp.Body) == "test" {
+			valid = true
+		}
+	})
+
+	c.Visit(ts.URL + "/user_agent")
+
+	if !valid {
+		t.Fatalf("Wrong user-agent from environment")
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	const exampleUserAgent1 = "Example/1.0"
+	const exampleUserAgent2 = "Example/2.0"
+	const defaultUserAgent = "colly - https://github.com/gocolly/colly"
+
+	ts := newTestServer()
+	defer ts.Close()
+
+	var receivedUserAgent string
+
+	func() {
+		c := NewCollector()
+		c.OnResponse(func(resp *Response) {
+			receivedUserAgent = string(resp.Body)
+		})
 		c.Visit(ts.URL + "/user_agent")
 		if got, want := receivedUserAgent, defaultUserAgent; got != want {
 			t.Errorf("mismatched User-Agent: got=%q want=%q", got, want)
@@ -1715,6 +2549,55 @@ func TestCollectorEmptyXMLGZ(t *testing.T) {
 	}
 }
 
+func TestContentDecoders(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	c := NewCollector(AllowURLRevisit())
+	var body string
+	c.OnResponse(func(r *Response) {
+		body = string(r.Body)
+	})
+	for _, path := range []string{"/deflate", "/raw_deflate", "/stacked_encoding"} {
+		body = ""
+		if err := c.Visit(ts.URL + path); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if body != encodingTestBody {
+			t.Errorf("%s: unexpected body %q", path, body)
+		}
+	}
+
+	if err := c.Visit(ts.URL + "/brotli"); !errors.Is(err, ErrUnsupportedContentEncoding) {
+		t.Errorf("expected ErrUnsupportedContentEncoding, got %v", err)
+	}
+
+	// unknown codings are ignored
+	body = ""
+	if err := c.Visit(ts.URL + "/bogus_encoding"); err != nil {
+		t.Fatal(err)
+	}
+	if body != encodingTestBody {
+		t.Errorf("unexpected body %q", body)
+	}
+
+	c2 := c.Clone()
+	c2.OnResponse(func(r *Response) {
+		body = string(r.Body)
+	})
+	c.RegisterContentDecoder("X-Upper", func(r io.Reader) (io.ReadCloser, error) {
+		b, err := io.ReadAll(r)
+		return io.NopCloser(bytes.NewReader(bytes.ToLower(b))), err
+	})
+	body = ""
+	if err := c2.Visit(ts.URL + "/custom_encoding"); err != nil {
+		t.Fatal(err)
+	}
+	if body != encodingTestBody {
+		t.Errorf("registered decoder not used: %q", body)
+	}
+}
+
 func TestCollectorVisitWithTrace(t *testing.T) {
 	ts := newTestServer()
 	defer ts.Close()
@@ -1751,6 +2634,39 @@ func TestCollectorVisitWithCheckHead(t *testing.T) {
 	}
 }
 
+func TestRequestChildPriority(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	c := NewCollector()
+	var priorities []string
+	c.OnRequest(func(r *Request) {
+		if r.URL.Path == "/" {
+			r.Priority = 3
+			return
+		}
+		priorities = append(priorities, r.URL.Path+":"+strconv.Itoa(r.Priority))
+	})
+	c.OnResponse(func(r *Response) {
+		if r.Request.URL.Path != "/" {
+			return
+		}
+		r.Request.Visit("/html")
+		r.Request.Post("/login", map[string]string{"name": "x"})
+		r.Request.PostRaw("/allowed", []byte("x"))
+		r.Request.PostMultipart("/callback_test", map[string][]byte{"name": []byte("x")})
+		if child, err := r.Request.New("GET", r.Request.AbsoluteURL("/xml"), nil); err != nil {
+			t.Error(err)
+		} else {
+			child.Do()
+		}
+	})
+	c.Visit(ts.URL + "/")
+	if s := strings.Join(priorities, ","); s != "/html:3,/login:3,/allowed:3,/callback_test:3,/xml:3" {
+		t.Errorf("unexpected child priorities: %s", s)
+	}
+}
+
 func TestCollectorDepth(t *testing.T) {
 	ts := newTestServer()
 	defer ts.Close()
@@ -2059,6 +2975,148 @@ func TestRedirectErrorRetry(t *testing.T) {
 	c.Visit(ts.URL + "/redirect")
 }
 
+func TestRetryPolicySucceeds(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	transport := &countingTransport{}
+	c := NewCollector(Retry(&RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}))
+	c.WithTransport(transport)
+	var attempt int
+	var body string
+	c.OnResponse(func(r *Response) {
+		attempt = r.Request.Attempt
+		body = string(r.Body)
+	})
+	c.OnError(func(r *Response, err error) {
+		t.Errorf("unexpected error: %v", err)
+	})
+	if err := c.Post(ts.URL+"/retry?fail=2&status=503", map[string]string{"a": "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if transport.requests("/retry") != 3 || attempt != 3 {
+		t.Errorf("expected 3 attempts, got %d calls and attempt %d", transport.requests("/retry"), attempt)
+	}
+	if body != "ok a=b" {
+		t.Errorf("request body not resent: %q", body)
+	}
+}
+
+func TestRetryPolicyFinalFailure(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	transport := &countingTransport{}
+	c := NewCollector(Retry(&RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}))
+	c.WithTransport(transport)
+	errors := 0
+	c.OnError(func(r *Response, err error) {
+		errors++
+		if r.Request.Attempt != 2 {
+			t.Errorf("expected attempt 2, got %d", r.Request.Attempt)
+		}
+	})
+	c.Visit(ts.URL + "/retry?fail=10&status=502")
+	if transport.requests("/retry") != 2 || errors != 1 {
+		t.Errorf("expected 2 calls and 1 error, got %d calls and %d errors", transport.requests("/retry"), errors)
+	}
+}
+
+func TestRetryPolicyStatusCodes(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	transport := &countingTransport{}
+	c := NewCollector(Retry(&RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}))
+	c.WithTransport(transport)
+	c.Visit(ts.URL + "/500")
+	if transport.requests("/500") != 1 {
+		t.Errorf("status 500 must not be retried by default, got %d calls", transport.requests("/500"))
+	}
+}
+
+func TestRetryPolicyRetryAfter(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	transport := &countingTransport{}
+	c := NewCollector(Retry(&RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}))
+	c.WithTransport(transport)
+	start := time.Now()
+	c.Visit(ts.URL + "/retry?fail=1&status=429&retry_after=1")
+	if transport.requests("/retry") != 2 {
+		t.Fatalf("expected 2 calls, got %d", transport.requests("/retry"))
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("Retry-After not honored, retried after %v", elapsed)
+	}
+}
+
+func TestRetryPolicyCache(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	transport := &countingTransport{}
+	cacheDir := t.TempDir()
+	c := NewCollector(CacheDir(cacheDir), AllowURLRevisit(), Retry(&RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}))
+	c.WithTransport(transport)
+	var body string
+	c.OnResponse(func(r *Response) {
+		body = string(r.Body)
+	})
+	for i := 0; i < 2; i++ {
+		body = ""
+		if err := c.Visit(ts.URL + "/retry?fail=2&status=429"); err != nil {
+			t.Fatal(err)
+		}
+		if body != "ok " {
+			t.Errorf("unexpected body: %q", body)
+		}
+	}
+	if n := transport.requests("/retry"); n != 3 {
+		t.Errorf("expected 3 requests, got %d", n)
+	}
+
+	// temporary failures are not cached without a RetryPolicy
+	c = NewCollector(CacheDir(cacheDir), AllowURLRevisit())
+	c.WithTransport(transport)
+	c.Visit(ts.URL + "/retry?fail=2&status=408&retry_after=1")
+	c.Visit(ts.URL + "/retry?fail=2&status=408&retry_after=1")
+	if n := transport.requests("/retry"); n != 5 {
+		t.Errorf("temporary failure served from the cache, %d requests", n)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := &RetryPolicy{MaxAttempts: 10, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	resp := &Response{StatusCode: http.StatusServiceUnavailable, Headers: &http.Header{}}
+	for attempt, expected := range []time.Duration{0, 100, 200, 400, 800, 1000, 1000} {
+		if attempt == 0 {
+			continue
+		}
+		d, ok := p.retry(attempt, resp, nil)
+		if !ok || d != expected*time.Millisecond {
+			t.Errorf("attempt %d: expected delay %v, got %v", attempt, expected*time.Millisecond, d)
+		}
+	}
+	if _, ok := p.retry(10, resp, nil); ok {
+		t.Error("retried after MaxAttempts")
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d, _ := p.retry(2, resp, nil)
+		if d < 100*time.Millisecond || d > 200*time.Millisecond {
+			t.Fatalf("jittered delay out of range: %v", d)
+		}
+	}
+
+	resp.Headers.Set("Retry-After", "30")
+	if d, _ := p.retry(1, resp, nil); d != time.Second {
+		t.Errorf("Retry-After must be limited by MaxDelay, got %v", d)
+	}
+}
+
 func TestCheckRequestHeadersFunc(t *testing.T) {
 	ts := newTestServer()
 	defer ts.Close()
@@ -2277,6 +3335,7 @@ func TestRequestMarshalRoundtripHost(t *testing.T) {
 		Method:    "GET",
 		URL:       u,
 		Host:      "vhost.example.com",
+		Priority:  7,
 		Ctx:       NewContext(),
 		Headers:   &http.Header{},
 		collector: c,
@@ -2292,4 +3351,299 @@ func TestRequestMarshalRoundtripHost(t *testing.T) {
 	if got.Host != "vhost.example.com" {
 		t.Errorf("Host not preserved: got %q want %q", got.Host, "vhost.example.com")
 	}
+	if got.Priority != 7 {
+		t.Errorf("Priority not preserved: got %d want %d", got.Priority, 7)
+	}
+}
+
+func TestHTTPCache(t *testing.T) {
+	tests := []struct {
+		path        string
+		requests    int
+		notModified int
+		body        string
+	}{
+		{"/cache/etag", 3, 2, "etag body"},
+		{"/cache/last_modified", 3, 2, "last-modified body"},
+		{"/cache/fresh", 1, 0, "fresh body"},
+		{"/cache/expires", 3, 0, "expired body"},
+		{"/cache/no_store", 3, 0, "no-store body"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			ts := newTestServer()
+			defer ts.Close()
+
+			transport := &countingTransport{}
+			c := NewCollector(CacheDir(t.TempDir()), HTTPCache(), AllowURLRevisit())
+			c.WithTransport(transport)
+			c.OnResponse(func(r *Response) {
+				if r.StatusCode != http.StatusOK || string(r.Body) != tt.body {
+					t.Errorf("unexpected response: %d %q", r.StatusCode, r.Body)
+				}
+			})
+			c.OnResponseHeaders(func(r *Response) {
+				if r.StatusCode != http.StatusOK {
+					t.Errorf("unexpected status in OnResponseHeaders: %d", r.StatusCode)
+				}
+			})
+			for i := 0; i < 3; i++ {
+				if err := c.Visit(ts.URL + tt.path); err != nil {
+					t.Fatal(err)
+				}
+			}
+			requests, notModified := transport.requests(tt.path), transport.responses(http.StatusNotModified)
+			if requests != tt.requests || notModified != tt.notModified {
+				t.Errorf("expected %d requests and %d revalidations, got %d and %d",
+					tt.requests, tt.notModified, requests, notModified)
+			}
+		})
+	}
+}
+
+func TestHTTPCacheVary(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	transport := &countingTransport{}
+	c := NewCollector(CacheDir(t.TempDir()), HTTPCache(), AllowURLRevisit())
+	c.WithTransport(transport)
+	var body string
+	c.OnResponse(func(r *Response) {
+		body = string(r.Body)
+	})
+	for _, lang := range []string{"en", "en", "de", "de"} {
+		hdr := http.Header{"Accept-Language": []string{lang}}
+		if err := c.Request("GET", ts.URL+"/cache/vary", nil, nil, hdr); err != nil {
+			t.Fatal(err)
+		}
+		if body != lang {
+			t.Errorf("expected body %q, got %q", lang, body)
+		}
+	}
+	if transport.requests("/cache/vary") != 2 {
+		t.Errorf("expected 2 requests, got %d", transport.requests("/cache/vary"))
+	}
+}
+
+func TestHTTPCacheIncompleteResponses(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	transport := &countingTransport{}
+	c := NewCollector(CacheDir(t.TempDir()), HTTPCache(), AllowURLRevisit(), ParseHTTPErrorResponse())
+	c.WithTransport(transport)
+	for _, path := range []string{"/cache/partial", "/cache/not_modified"} {
+		for i := 0; i < 2; i++ {
+			c.Visit(ts.URL + path)
+		}
+		if n := transport.requests(path); n != 2 {
+			t.Errorf("%s: expected 2 requests, got %d", path, n)
+		}
+	}
+}
+
+func TestHTTPCacheEntryFreshness(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	date := now.Add(-10 * time.Second)
+	e := &httpCacheEntry{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Date":          []string{date.UTC().Format(http.TimeFormat)},
+			"Last-Modified": []string{date.Add(-1000 * time.Second).UTC().Format(http.TimeFormat)},
+			"Age":           []string{"5"},
+		},
+		RequestTime:  now.Add(-time.Second),
+		ResponseTime: now,
+	}
+	if lifetime := e.freshnessLifetime(); lifetime != 100*time.Second {
+		t.Errorf("unexpected heuristic lifetime: %v", lifetime)
+	}
+	if age := e.age(now); age != 10*time.Second {
+		t.Errorf("unexpected age: %v", age)
+	}
+	if !e.fresh(cacheControl{}, now) {
+		t.Error("entry must be fresh")
+	}
+	if e.fresh(cacheControl{"max-age": "5"}, now) {
+		t.Error("request max-age not respected")
+	}
+	if e.fresh(cacheControl{"min-fresh": "95"}, now) {
+		t.Error("request min-fresh not respected")
+	}
+}
+
+func TestCollectorSetCache(t *testing.T) {
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte("cached"))
+	}))
+	defer ts.Close()
+
+	store := &cache.LRUCache{MaxSize: 1 << 20}
+	c := NewCollector(AllowURLRevisit())
+	c.SetCache(store)
+	c2 := c.Clone()
+	var body string
+	c2.OnResponse(func(r *Response) {
+		body = string(r.Body)
+	})
+	c.Visit(ts.URL)
+	c2.Visit(ts.URL)
+	if requests.Load() != 1 || body != "cached" {
+		t.Errorf("cache not shared by clone: %d requests, body %q", requests.Load(), body)
+	}
+	if store.Len() != 1 {
+		t.Errorf("expected 1 cached response, got %d", store.Len())
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	content := downloadTestContent(10000)
+	ts := newTestServer()
+	defer ts.Close()
+	sum := sha256.Sum256(content)
+
+	dir := t.TempDir()
+	d := &FileDownload{
+		URL:      ts.URL + "/download/file.bin?n=10000",
+		Path:     filepath.Join(dir, "file.bin"),
+		Checksum: hex.EncodeToString(sum[:]),
+	}
+	// an interrupted download of the same file
+	os.WriteFile(d.Path+".part", content[:40000], 0644)
+	os.WriteFile(d.Path+".part.json", []byte(`{"url":"`+d.URL+`","etag":"\"v1\""}`), 0644)
+
+	recorder := &eventRecorder{}
+	transport := &countingTransport{}
+	c := NewCollector(Debugger(recorder))
+	c.WithTransport(transport)
+	if err := c.Download(d); err != nil {
+		t.Fatal(err)
+	}
+	if transport.requests("/download/file.bin") != 1 || transport.responses(http.StatusPartialContent) != 1 {
+		t.Error("download not resumed")
+	}
+	data, err := os.ReadFile(d.Path)
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("unexpected file content: %v", err)
+	}
+	if _, err := os.Stat(d.Path + ".part.json"); !os.IsNotExist(err) {
+		t.Error("download state not removed")
+	}
+	last := recorder.events[len(recorder.events)-1]
+	if last.Type != "download" || last.Values["written"] != "100000" {
+		t.Errorf("unexpected event: %+v", last)
+	}
+}
+
+func TestDownloadChangedFile(t *testing.T) {
+	content := downloadTestContent(1000)
+	ts := newTestServer()
+	defer ts.Close()
+
+	dir := t.TempDir()
+	d := &FileDownload{URL: ts.URL + "/download/file.bin?n=1000", Path: filepath.Join(dir, "file.bin")}
+	os.WriteFile(d.Path+".part", []byte("stale content"), 0644)
+	os.WriteFile(d.Path+".part.json", []byte(`{"url":"`+d.URL+`","etag":"\"v0\""}`), 0644)
+
+	c := NewCollector()
+	if err := c.Download(d); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(d.Path)
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("unexpected file content: %v", err)
+	}
+}
+
+func TestDownloadChecksumMismatch(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	dir := t.TempDir()
+	d := &FileDownload{URL: ts.URL + "/download/file.bin?n=1", Path: filepath.Join(dir, "file.bin"), Checksum: "00"}
+	c := NewCollector()
+	if err := c.Download(d); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+	}
+	for _, p := range []string{d.Path, d.Path + ".part", d.Path + ".part.json"} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s not removed", p)
+		}
+	}
+}
+
+func TestDownloadIncomplete(t *testing.T) {
+	dir := t.TempDir()
+	d := &FileDownload{Path: filepath.Join(dir, "file.bin")}
+	os.WriteFile(d.Path+".part", []byte("partial"), 0644)
+	if err := d.verify(d.Path+".part", 100); !errors.Is(err, ErrDownloadIncomplete) {
+		t.Errorf("expected ErrDownloadIncomplete, got %v", err)
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	for _, tt := range []struct {
+		v            string
+		start, total int64
+		ok           bool
+	}{
+		{"bytes 100-199/1000", 100, 1000, true},
+		{"bytes 100-199/*", 100, -1, true},
+		{"bytes */1000", 0, 1000, true},
+		{"items 1-2/3", 0, 0, false},
+		{"bytes x-1/2", 0, 0, false},
+	} {
+		start, total, ok := parseContentRange(tt.v)
+		if start != tt.start || total != tt.total || ok != tt.ok {
+			t.Errorf("%q: got %d %d %v", tt.v, start, total, ok)
+		}
+	}
+}
+
+func TestCollectorTruncatedBody(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	cacheDir := t.TempDir()
+	c := NewCollector(MaxBodySize(1024), CacheDir(cacheDir))
+	truncated := false
+	c.OnResponse(func(r *Response) {
+		truncated = r.Truncated
+		if len(r.Body) != 1024 {
+			t.Errorf("unexpected body size: %d", len(r.Body))
+		}
+	})
+	if err := c.Visit(ts.URL + "/large_binary"); err != nil {
+		t.Fatal(err)
+	}
+	if !truncated {
+		t.Error("Response.Truncated not set")
+	}
+	entries, _ := os.ReadDir(cacheDir)
+	if len(entries) != 0 {
+		t.Error("truncated response cached")
+	}
+
+	c = NewCollector(MaxBodySize(1024), TruncatedBodyError())
+	c.OnResponse(func(r *Response) {
+		t.Error("OnResponse called for truncated response")
+	})
+	var onErr error
+	c.OnError(func(r *Response, err error) {
+		onErr = err
+	})
+	if err := c.Visit(ts.URL + "/large_binary"); !errors.Is(err, ErrBodyTruncated) || onErr != err {
+		t.Errorf("expected ErrBodyTruncated, got %v and %v", err, onErr)
+	}
+
+	c = NewCollector(MaxBodySize(1024))
+	c.OnResponse(func(r *Response) {
+		if r.Truncated {
+			t.Error("complete body marked as truncated")
+		}
+	})
+	c.Visit(ts.URL + "/html")
 }
@@ -0,0 +1,315 @@
+// Copyright 2018 Adam Tauber
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package colly
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// downloadProgressInterval is the minimum interval of the
+// downloadProgress debugger events of a download
+const downloadProgressInterval = time.Second
+
+// FileDownload describes a file download of Collector.Download
+type FileDownload struct {
+	// URL is the address of the file
+	URL string
+	// Path is the destination of the file. The file is downloaded to
+	// Path + ".part" and renamed to Path when it is complete.
+	Path string
+	// Checksum is the expected hex encoded digest of the file.
+	// It is not verified if it is empty.
+	Checksum string
+	// Hash creates the hash of Checksum. Defaults to sha256.New.
+	Hash func() hash.Hash
+	// Headers are additional headers of the request
+	Headers http.Header
+}
+
+// downloadState is stored next to a partial download. It contains the
+// validators of the partial file, which are sent in If-Range to resume
+// the download only if the file hasn't changed.
+type downloadState struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// validator returns the value of If-Range. Weak ETags can't be used.
+func (s *downloadState) validator() string {
+	if s.ETag != "" && !strings.HasPrefix(s.ETag, "W/") {
+		return s.ETag
+	}
+	return s.LastModified
+}
+
+// Download downloads a file to the disk. The response body is written
+// directly to the file, so files of any size can be downloaded.
+//
+// If a previous download of the file was interrupted, Download resumes it
+// with a Range request. The partial file is discarded if the server
+// doesn't support ranges or the file has changed. The size of the file is
+// verified against Content-Length or Content-Range and the checksum is
+// verified if it is set. Incomplete files are kept to be resumed by a
+// later call of Download, files with a bad checksum are removed.
+//
+// Download respects the domain and URL filters, robots.txt and the
+// LimitRules of the collector, but it doesn't call its callbacks.
+// Progress is reported by debugger events. Download is synchronous,
+// even if Async is set.
+func (c *Collector) Download(d *FileDownload) error {
+	parsedURL, err := url.Parse(d.URL)
+	if err != nil {
+		return err
+	}
+	if err := c.requestCheck(parsedURL, "GET", nil, 0, false, true); err != nil {
+		return err
+	}
+	partPath := d.Path + ".part"
+	statePath := partPath + ".json"
+
+	var offset int64
+	state := readDownloadState(statePath)
+	if info, err := os.Stat(partPath); err == nil && state != nil && state.URL == d.URL && state.validator() != "" {
+		offset = info.Size()
+	}
+
+	req, err := http.NewRequestWithContext(c.Context, "GET", parsedURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	if c.Headers != nil {
+		req.Header = c.Headers.Clone()
+	}
+	for k, v := range d.Headers {
+		req.Header[k] = v
+	}
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	// ranges have to be applied to the raw body
+	req.Header.Set("Accept-Encoding", "identity")
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", state.validator())
+	}
+
+	progress := &downloadProgress{c: c, id: c.requestCount.Add(1), url: d.URL}
+	acceptHeaders := func(*http.Request) bool { return true }
+	acceptResponse := func(*http.Request, int, http.Header) bool { return true }
+	err = c.backend.DoStream(req, false, acceptHeaders, acceptResponse, func(resp *Response, body io.Reader) error {
+		return c.writeDownload(resp, body, partPath, statePath, offset, progress)
+	})
+	if err != nil {
+		progress.report("downloadError", err)
+		return err
+	}
+	if err := d.verify(partPath, progress.total); err != nil {
+		progress.report("downloadError", err)
+		if errors.Is(err, ErrChecksumMismatch) {
+			os.Remove(partPath)
+			os.Remove(statePath)
+		}
+		return err
+	}
+	if err := os.Rename(partPath, d.Path); err != nil {
+		return err
+	}
+	os.Remove(statePath)
+	progress.report("download", nil)
+	return nil
+}
+
+// writeDownload writes the body of a download response to the partial file
+func (c *Collector) writeDownload(resp *Response, body io.Reader, partPath, statePath string, offset int64, progress *downloadProgress) error {
+	flags := os.O_WRONLY | os.O_CREATE
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		start, total, ok := parseContentRange(resp.Headers.Get("Content-Range"))
+		if !ok || start != offset {
+			os.Remove(statePath)
+			return fmt.Errorf("unexpected Content-Range %q", resp.Headers.Get("Content-Range"))
+		}
+		flags |= os.O_APPEND
+		progress.total = total
+	case resp.StatusCode == http.StatusOK:
+		offset = 0
+		flags |= os.O_TRUNC
+		progress.total = -1
+		if n, err := strconv.ParseInt(resp.Headers.Get("Content-Length"), 10, 64); err == nil {
+			progress.total = n
+		}
+		state := &downloadState{
+			URL:          progress.url,
+			ETag:         resp.Headers.Get("ETag"),
+			LastModified: resp.Headers.Get("Last-Modified"),
+		}
+		if err := writeDownloadState(statePath, state); err != nil {
+			return err
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// the partial file may be complete already
+		if _, total, ok := parseContentRange(resp.Headers.Get("Content-Range")); ok && total == offset {
+			progress.written, progress.total = offset, total
+			return nil
+		}
+		os.Remove(partPath)
+		os.Remove(statePath)
+		return errors.New(http.StatusText(resp.StatusCode))
+	default:
+		return errors.New(http.StatusText(resp.StatusCode))
+	}
+
+	f, err := os.OpenFile(partPath, flags, 0644)
+	if err != nil {
+		return err
+	}
+	progress.written = offset
+	_, err = io.Copy(f, io.TeeReader(body, progress))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// verify checks the size and the checksum of the downloaded file
+func (d *FileDownload) verify(partPath string, total int64) error {
+	info, err := os.Stat(partPath)
+	if err != nil {
+		return err
+	}
+	if total >= 0 && info.Size() != total {
+		return fmt.Errorf("%w: %d of %d bytes", ErrDownloadIncomplete, info.Size(), total)
+	}
+	if d.Checksum == "" {
+		return nil
+	}
+	newHash := d.Hash
+	if newHash == nil {
+		newHash = sha256.New
+	}
+	f, err := os.Open(partPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, d.Checksum) {
+		return fmt.Errorf("%w: %s", ErrChecksumMismatch, sum)
+	}
+	return nil
+}
+
+func readDownloadState(path string) *downloadState {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	state := &downloadState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil
+	}
+	return state
+}
+
+func writeDownloadState(path string, state *downloadState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// parseContentRange parses the first byte position and the complete
+// length of a Content-Range header. total is -1 if the length is unknown.
+func parseContentRange(v string) (start, total int64, ok bool) {
+	v, ok = strings.CutPrefix(v, "bytes ")
+	if !ok {
+		return 0, 0, false
+	}
+	r, size, ok := strings.Cut(v, "/")
+	if !ok {
+		return 0, 0, false
+	}
+	total = -1
+	if size != "*" {
+		n, err := strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		total = n
+	}
+	if r == "*" {
+		return 0, total, true
+	}
+	first, _, ok := strings.Cut(r, "-")
+	if !ok {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return start, total, true
+}
+
+// downloadProgress reports the progress of a download to the debugger
+type downloadProgress struct {
+	c        *Collector
+	id       uint32
+	url      string
+	written  int64
+	total    int64
+	reported time.Time
+}
+
+func (p *downloadProgress) Write(b []byte) (int, error) {
+	p.written += int64(len(b))
+	if time.Since(p.reported) >= downloadProgressInterval {
+		p.reported = time.Now()
+		p.report("downloadProgress", nil)
+	}
+	return len(b), nil
+}
+
+func (p *downloadProgress) report(eventType string, err error) {
+	if p.c.debugger == nil {
+		return
+	}
+	values := map[string]string{
+		"url":     p.url,
+		"written": strconv.FormatInt(p.written, 10),
+		"total":   strconv.FormatInt(p.total, 10),
+	}
+	if err != nil {
+		values["error"] = err.Error()
+	}
+	p.c.debugger.Event(createEvent(eventType, p.id, p.c.ID, values))
+}
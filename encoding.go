@@ -0,0 +1,169 @@
+// Copyright 2018 Adam Tauber
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package colly
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"strings"
+)
+
+// ContentDecoder creates a reader which decodes a response body
+// encoded with a Content-Encoding
+type ContentDecoder func(io.Reader) (io.ReadCloser, error)
+
+// defaultContentDecoders are the decoders available in every collector
+var defaultContentDecoders = map[string]ContentDecoder{
+	"gzip":    decodeGzip,
+	"x-gzip":  decodeGzip,
+	"deflate": decodeDeflate,
+}
+
+// compressionCodings are the registered compression codings without
+// default decoder. Responses using them fail with
+// ErrUnsupportedContentEncoding unless a decoder is registered, other
+// unknown codings are bogus values sent by misconfigured servers, e.g.
+// "utf-8", and they are ignored.
+var compressionCodings = map[string]bool{
+	"br":         true,
+	"zstd":       true,
+	"compress":   true,
+	"x-compress": true,
+}
+
+// decodeGzip decodes gzip bodies. Even if a response is declared as gzip
+// compressed, it doesn't mean that we get gzip compressed data back. We
+// might get an uncompressed error page instead, for example. So bodies
+// without the gzip magic bytes are returned unchanged.
+func decodeGzip(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	switch err {
+	case io.EOF:
+		// less than 2 bytes, do nothing
+		return io.NopCloser(br), nil
+	case nil:
+		// gzip magic, as specified in RFC 1952
+		if magic[0] == 0x1f && magic[1] == 0x8b {
+			return gzip.NewReader(br)
+		}
+		return io.NopCloser(br), nil
+	default:
+		return nil, err
+	}
+}
+
+// decodeDeflate decodes deflate bodies. The deflate Content-Encoding is
+// the zlib format (RFC 1950), but some servers send raw deflate data
+// (RFC 1951), so both are accepted.
+func decodeDeflate(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err == io.EOF {
+		return io.NopCloser(br), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+// RegisterContentDecoder registers a decoder of a Content-Encoding, e.g.
+// "br" or "zstd". It overrides the decoder of the encoding, if any.
+// Encodings are case-insensitive. The decoders are shared between
+// the clones of a collector.
+//
+// Note that a decoder doesn't make servers use the encoding, it has to
+// be requested by an Accept-Encoding request header.
+func (c *Collector) RegisterContentDecoder(encoding string, decoder ContentDecoder) {
+	c.backend.RegisterContentDecoder(encoding, decoder)
+}
+
+func (h *httpBackend) RegisterContentDecoder(encoding string, decoder ContentDecoder) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	decoders := maps.Clone(h.decoders)
+	if decoders == nil {
+		decoders = maps.Clone(defaultContentDecoders)
+	}
+	decoders[strings.ToLower(encoding)] = decoder
+	h.decoders = decoders
+}
+
+func (h *httpBackend) contentDecoder(encoding string) ContentDecoder {
+	h.lock.RLock()
+	decoders := h.decoders
+	h.lock.RUnlock()
+	if decoders == nil {
+		decoders = defaultContentDecoders
+	}
+	return decoders[encoding]
+}
+
+// decodeBody wraps body with the decoders of the content codings of res.
+// Bodies of .xml.gz files and of gzip content types are decoded as gzip
+// if the response has no Content-Encoding. The returned closers have to
+// be closed after the body is read.
+func (h *httpBackend) decodeBody(res *http.Response, finalRequest *http.Request, body io.Reader) (io.Reader, []io.Closer, error) {
+	var encodings []string
+	if !res.Uncompressed {
+		for _, v := range res.Header.Values("Content-Encoding") {
+			for _, e := range strings.Split(v, ",") {
+				e = strings.ToLower(strings.TrimSpace(e))
+				if e != "" && e != "identity" {
+					encodings = append(encodings, e)
+				}
+			}
+		}
+		if len(encodings) == 0 && (strings.Contains(strings.ToLower(res.Header.Get("Content-Type")), "gzip") || (strings.HasSuffix(strings.ToLower(finalRequest.URL.Path), ".xml.gz") && res.StatusCode >= 200 && res.StatusCode < 300)) {
+			encodings = []string{"gzip"}
+		}
+	}
+	var closers []io.Closer
+	// the codings are listed in the order they were applied
+	for i := len(encodings) - 1; i >= 0; i-- {
+		decoder := h.contentDecoder(encodings[i])
+		if decoder == nil {
+			if !compressionCodings[encodings[i]] {
+				continue
+			}
+			closeAll(closers)
+			return nil, nil, fmt.Errorf("%w: %s", ErrUnsupportedContentEncoding, encodings[i])
+		}
+		r, err := decoder(body)
+		if err != nil {
+			closeAll(closers)
+			return nil, nil, err
+		}
+		closers = append(closers, r)
+		body = r
+	}
+	return body, closers, nil
+}
+
+func closeAll(closers []io.Closer) {
+	for _, c := range closers {
+		c.Close()
+	}
+}
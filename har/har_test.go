@@ -0,0 +1,129 @@
+package har
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gocolly/colly/v2"
+)
+
+func newTestServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: r.FormValue("user"), Path: "/", HttpOnly: true})
+		http.Redirect(w, r, "/account?tab=profile", http.StatusSeeOther)
+	})
+	mux.HandleFunc("/account", func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie("session")
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<p>hello " + cookie.Value + "</p>"))
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestRecorder(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	rec := &Recorder{}
+	c := colly.NewCollector()
+	rec.Attach(c)
+	if err := c.Post(ts.URL+"/login", map[string]string{"user": "colly"}); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "session.har")
+	if err := rec.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &HAR{}
+	if err := json.Unmarshal(data, h); err != nil {
+		t.Fatal(err)
+	}
+	if h.Log.Version != "1.2" || len(h.Log.Entries) != 2 {
+		t.Fatalf("unexpected log: %s", data)
+	}
+
+	login := h.Log.Entries[0]
+	if login.Request.Method != "POST" || login.Request.PostData == nil || len(login.Request.PostData.Params) != 1 || login.Request.PostData.Params[0].Value != "colly" {
+		t.Errorf("unexpected login request: %+v", login.Request)
+	}
+	if login.Response.Status != http.StatusSeeOther || login.Response.RedirectURL != ts.URL+"/account?tab=profile" {
+		t.Errorf("unexpected login response: %d %q", login.Response.Status, login.Response.RedirectURL)
+	}
+	if len(login.Response.Cookies) != 1 || login.Response.Cookies[0].Name != "session" || !login.Response.Cookies[0].HTTPOnly {
+		t.Errorf("unexpected response cookies: %+v", login.Response.Cookies)
+	}
+	if login.ServerIPAddress != "127.0.0.1" || login.Timings.Connect < 0 || login.Timings.Wait < 0 || login.Timings.DNS != -1 {
+		t.Errorf("unexpected timings: %+v %q", login.Timings, login.ServerIPAddress)
+	}
+
+	account := h.Log.Entries[1]
+	if len(account.Request.Cookies) != 1 || account.Request.Cookies[0].Value != "colly" {
+		t.Errorf("cookie jar cookies not recorded: %+v", account.Request.Cookies)
+	}
+	if len(account.Request.QueryString) != 1 || account.Request.QueryString[0].Name != "tab" {
+		t.Errorf("unexpected query string: %+v", account.Request.QueryString)
+	}
+	if account.Connection != login.Connection || account.Timings.Connect != -1 {
+		t.Errorf("connection not reused: %+v", account.Timings)
+	}
+	content := account.Response.Content
+	if content.Text != "<p>hello colly</p>" || content.Size != len(content.Text) || account.Response.BodySize != content.Size {
+		t.Errorf("unexpected content: %+v", content)
+	}
+
+	rec.Reset()
+	if len(rec.HAR().Log.Entries) != 0 {
+		t.Error("entries not removed")
+	}
+}
+
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestRecorderError(t *testing.T) {
+	rec := &Recorder{Transport: failingTransport{}}
+	c := colly.NewCollector()
+	rec.Attach(c)
+	if err := c.Visit("http://example.com/"); err == nil {
+		t.Fatal("expected error")
+	}
+	entries := rec.HAR().Log.Entries
+	if len(entries) != 1 || entries[0].Response.Status != 0 || entries[0].Comment == "" {
+		t.Errorf("failed request not recorded: %+v", entries)
+	}
+}
+
+func TestRecorderAttach(t *testing.T) {
+	c := colly.NewCollector()
+	c.WithTransport(failingTransport{})
+	rec := &Recorder{}
+	rec.Attach(c)
+	rec.Attach(c)
+	if c.Transport() != rec {
+		t.Fatal("recorder not attached")
+	}
+	c.Visit("http://example.com/")
+	entries := rec.HAR().Log.Entries
+	if len(entries) != 1 || entries[0].Comment != "connection refused" {
+		t.Errorf("transport of the collector not wrapped: %+v", entries)
+	}
+}
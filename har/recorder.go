@@ -0,0 +1,414 @@
+// Copyright 2018 Adam Tauber
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package har
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gocolly/colly/v2"
+	"github.com/gocolly/colly/v2/internal/reqbody"
+)
+
+// Recorder is an http.RoundTripper which records every exchange as a HAR
+// entry. Requests are recorded as they are sent, so the entries contain
+// the cookies added by the cookie jar and every hop of a redirect chain.
+// The timings are measured with the same client trace hooks as
+// colly.HTTPTrace.
+//
+// An entry is recorded when its response body is read to the end or
+// closed. Recorder is safe for concurrent use.
+type Recorder struct {
+	// Transport sends the requests. Attach sets it to the transport of
+	// the collector, http.DefaultTransport is used if it is nil.
+	Transport http.RoundTripper
+	// MaxContentSize limits the size of the recorded response bodies.
+	// Longer bodies are recorded without text. 0 means unlimited and
+	// a negative value disables the recording of bodies.
+	MaxContentSize int
+	lock           sync.Mutex
+	entries        []*Entry
+}
+
+// Attach makes c send its requests through r. If r has no Transport, it
+// wraps the current transport of c, so its proxy, TLS and dial settings
+// are kept. Attach has to be called after the transport of c is
+// configured, because SetClient, SetProxy, SetProxyFunc and
+// WithTransport replace the recorder.
+func (r *Recorder) Attach(c *colly.Collector) {
+	if t := c.Transport(); r.Transport == nil && t != http.RoundTripper(r) {
+		r.Transport = t
+	}
+	c.WithTransport(r)
+}
+
+// HAR returns the entries recorded so far ordered by their start times
+func (r *Recorder) HAR() *HAR {
+	r.lock.Lock()
+	entries := append([]*Entry(nil), r.entries...)
+	r.lock.Unlock()
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].StartedDateTime < entries[j].StartedDateTime
+	})
+	return &HAR{Log: &Log{
+		Version: "1.2",
+		Creator: &Creator{Name: "colly", Version: "2"},
+		Entries: entries,
+	}}
+}
+
+// Reset removes the recorded entries
+func (r *Recorder) Reset() {
+	r.lock.Lock()
+	r.entries = nil
+	r.lock.Unlock()
+}
+
+// Write writes the HAR of the recorded entries to w as JSON
+func (r *Recorder) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r.HAR())
+}
+
+// WriteFile writes the HAR of the recorded entries to a file
+func (r *Recorder) WriteFile(path string) error {
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+func (r *Recorder) add(e *Entry) {
+	r.lock.Lock()
+	r.entries = append(r.entries, e)
+	r.lock.Unlock()
+}
+
+// RoundTrip implements http.RoundTripper
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := r.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	reqBody, err := reqbody.Read(req)
+	if err != nil {
+		return nil, err
+	}
+	t := &timer{start: time.Now()}
+	out := req.WithContext(httptrace.WithClientTrace(req.Context(), t.trace()))
+	if reqBody != nil {
+		out.Body = io.NopCloser(bytes.NewReader(reqBody))
+	}
+	entry := &Entry{
+		StartedDateTime: t.start.Format("2006-01-02T15:04:05.000Z07:00"),
+		Request:         newRequest(req, reqBody),
+	}
+	res, err := transport.RoundTrip(out)
+	if err != nil {
+		entry.Response = &Response{
+			Cookies: []*Cookie{},
+			Headers: []*NameValue{},
+			Content: &Content{},
+		}
+		entry.Comment = err.Error()
+		r.finish(entry, t)
+		return nil, err
+	}
+	entry.Request.HTTPVersion = res.Proto
+	entry.Response = newResponse(res)
+	res.Body = &body{ReadCloser: res.Body, done: func(b []byte, size int) {
+		entry.Response.BodySize = size
+		if res.Uncompressed {
+			entry.Response.BodySize = -1
+		}
+		entry.Response.Content.Size = size
+		r.content(entry.Response.Content, b, size)
+		r.finish(entry, t)
+	}, record: r.MaxContentSize >= 0, limit: r.MaxContentSize}
+	return res, nil
+}
+
+func (r *Recorder) finish(e *Entry, t *timer) {
+	e.Timings, e.Time = t.timings(time.Now())
+	t.lock.Lock()
+	e.ServerIPAddress, e.Connection = t.ip, t.conn
+	t.lock.Unlock()
+	r.add(e)
+}
+
+func (r *Recorder) content(c *Content, b []byte, size int) {
+	if b == nil || (r.MaxContentSize > 0 && size > r.MaxContentSize) {
+		return
+	}
+	if isText(c.MimeType) && utf8.Valid(b) {
+		c.Text = string(b)
+		return
+	}
+	c.Text = base64.StdEncoding.EncodeToString(b)
+	c.Encoding = "base64"
+}
+
+func newRequest(req *http.Request, reqBody []byte) *Request {
+	r := &Request{
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		HTTPVersion: "HTTP/1.1",
+		Cookies:     []*Cookie{},
+		Headers:     headers(req.Header),
+		QueryString: queryString(req.URL.RawQuery),
+		BodySize:    len(reqBody),
+	}
+	for _, c := range req.Cookies() {
+		r.Cookies = append(r.Cookies, &Cookie{Name: c.Name, Value: c.Value})
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	r.Headers = append([]*NameValue{{"Host", host}}, r.Headers...)
+	r.HeadersSize = len(req.Method) + len(req.URL.RequestURI()) + len(" HTTP/1.1\r\n") + headersSize(r.Headers)
+	if reqBody != nil {
+		mimeType := req.Header.Get("Content-Type")
+		r.PostData = &PostData{MimeType: mimeType, Text: string(reqBody)}
+		if mt, _, _ := mime.ParseMediaType(mimeType); mt == "application/x-www-form-urlencoded" {
+			r.PostData.Params = queryString(string(reqBody))
+		}
+	}
+	return r
+}
+
+func newResponse(res *http.Response) *Response {
+	statusText := http.StatusText(res.StatusCode)
+	if _, text, ok := strings.Cut(res.Status, " "); ok {
+		statusText = text
+	}
+	r := &Response{
+		Status:      res.StatusCode,
+		StatusText:  statusText,
+		HTTPVersion: res.Proto,
+		Cookies:     []*Cookie{},
+		Headers:     headers(res.Header),
+		Content:     &Content{MimeType: res.Header.Get("Content-Type")},
+	}
+	for _, c := range res.Cookies() {
+		cookie := &Cookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			HTTPOnly: c.HttpOnly,
+			Secure:   c.Secure,
+		}
+		if !c.Expires.IsZero() {
+			cookie.Expires = c.Expires.UTC().Format(time.RFC3339)
+		}
+		r.Cookies = append(r.Cookies, cookie)
+	}
+	if location := res.Header.Get("Location"); location != "" {
+		if u, err := res.Request.URL.Parse(location); err == nil {
+			r.RedirectURL = u.String()
+		} else {
+			r.RedirectURL = location
+		}
+	}
+	r.HeadersSize = len(res.Proto) + 1 + len(res.Status) + 2 + headersSize(r.Headers)
+	return r
+}
+
+// headers returns the headers of h ordered by name
+func headers(h http.Header) []*NameValue {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	nvs := []*NameValue{}
+	for _, name := range names {
+		for _, v := range h[name] {
+			nvs = append(nvs, &NameValue{name, v})
+		}
+	}
+	return nvs
+}
+
+// headersSize returns the size of a header block including the empty
+// line at its end
+func headersSize(nvs []*NameValue) int {
+	size := 2
+	for _, nv := range nvs {
+		size += len(nv.Name) + len(nv.Value) + 4
+	}
+	return size
+}
+
+// queryString returns the parameters of a query in their order
+func queryString(query string) []*NameValue {
+	nvs := []*NameValue{}
+	for _, param := range strings.Split(query, "&") {
+		if param == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(param, "=")
+		if n, err := url.QueryUnescape(name); err == nil {
+			name = n
+		}
+		if v, err := url.QueryUnescape(value); err == nil {
+			value = v
+		}
+		nvs = append(nvs, &NameValue{name, value})
+	}
+	return nvs
+}
+
+func isText(mimeType string) bool {
+	mt, _, _ := mime.ParseMediaType(mimeType)
+	return strings.HasPrefix(mt, "text/") || strings.HasSuffix(mt, "json") || strings.HasSuffix(mt, "xml") || strings.HasSuffix(mt, "javascript") || mt == "application/x-www-form-urlencoded"
+}
+
+// body records a response body while it is read. The entry is completed
+// when the body is read to the end or closed.
+type body struct {
+	io.ReadCloser
+	buf    bytes.Buffer
+	size   int
+	record bool
+	limit  int
+	once   sync.Once
+	done   func(b []byte, size int)
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.size += n
+	if b.record && (b.limit == 0 || b.buf.Len()+n <= b.limit) {
+		b.buf.Write(p[:n])
+	} else {
+		b.record = false
+	}
+	if err == io.EOF {
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *body) Close() error {
+	b.finish()
+	return b.ReadCloser.Close()
+}
+
+func (b *body) finish() {
+	b.once.Do(func() {
+		var content []byte
+		if b.record {
+			content = b.buf.Bytes()
+		}
+		b.done(content, b.size)
+	})
+}
+
+// timer measures the phases of an exchange
+type timer struct {
+	lock                      sync.Mutex
+	start                     time.Time
+	dnsStart, dnsDone         time.Time
+	connectStart, connectDone time.Time
+	tlsStart, tlsDone         time.Time
+	gotConn, wroteRequest     time.Time
+	firstByte                 time.Time
+	ip, conn                  string
+}
+
+func (t *timer) set(v *time.Time) {
+	t.lock.Lock()
+	if v.IsZero() {
+		*v = time.Now()
+	}
+	t.lock.Unlock()
+}
+
+func (t *timer) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart:     func(httptrace.DNSStartInfo) { t.set(&t.dnsStart) },
+		DNSDone:      func(httptrace.DNSDoneInfo) { t.set(&t.dnsDone) },
+		ConnectStart: func(network, addr string) { t.set(&t.connectStart) },
+		ConnectDone: func(network, addr string, err error) {
+			if err == nil {
+				t.set(&t.connectDone)
+			}
+		},
+		TLSHandshakeStart: func() { t.set(&t.tlsStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { t.set(&t.tlsDone) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.set(&t.gotConn)
+			t.lock.Lock()
+			if host, _, err := net.SplitHostPort(info.Conn.RemoteAddr().String()); err == nil {
+				t.ip = host
+			}
+			if _, port, err := net.SplitHostPort(info.Conn.LocalAddr().String()); err == nil {
+				t.conn = port
+			}
+			t.lock.Unlock()
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { t.set(&t.wroteRequest) },
+		GotFirstResponseByte: func() { t.set(&t.firstByte) },
+	}
+}
+
+// timings returns the timings of the phases and the total time
+func (t *timer) timings(end time.Time) (*Timings, float64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	ms := func(from, to time.Time) float64 {
+		if from.IsZero() || to.IsZero() {
+			return -1
+		}
+		return float64(to.Sub(from)) / float64(time.Millisecond)
+	}
+	timings := &Timings{
+		DNS:     ms(t.dnsStart, t.dnsDone),
+		Connect: ms(t.connectStart, t.connectDone),
+		SSL:     ms(t.tlsStart, t.tlsDone),
+		Send:    ms(t.gotConn, t.wroteRequest),
+		Wait:    ms(t.wroteRequest, t.firstByte),
+		Receive: ms(t.firstByte, end),
+	}
+	// blocked is the time spent waiting for a connection, without the
+	// time spent resolving and connecting
+	timings.Blocked = ms(t.start, t.gotConn)
+	if timings.Blocked >= 0 {
+		timings.Blocked = max(timings.Blocked-max(timings.DNS, 0)-max(timings.Connect, 0), 0)
+	}
+	total := 0.0
+	for _, d := range []float64{timings.Blocked, timings.DNS, timings.Connect, timings.Send, timings.Wait, timings.Receive} {
+		total += max(d, 0)
+	}
+	return timings, total
+}
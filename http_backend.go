@@ -15,29 +15,30 @@
 package colly
 
 import (
-	"bufio"
-	"crypto/sha1"
+	"bytes"
+	"context"
 	"encoding/gob"
-	"encoding/hex"
 	"io"
 	"math/rand"
 	"net/http"
-	"os"
-	"path"
 	"regexp"
-	"strings"
 	"sync"
 	"time"
 
-	"compress/gzip"
-
 	"github.com/gobwas/glob"
+
+	"github.com/gocolly/colly/v2/cache"
 )
 
 type httpBackend struct {
 	LimitRules []*LimitRule
 	Client     *http.Client
 	lock       *sync.RWMutex
+	decoders   map[string]ContentDecoder
+	// circuitBreaker is set by Collector.SetCircuitBreaker
+	circuitBreaker *CircuitBreaker
+	// crawlDelays are the delays of robots.txt files
+	crawlDelays crawlDelays
 }
 
 type checkResponseHeadersFunc func(req *http.Request, statusCode int, header http.Header) bool
@@ -49,6 +50,17 @@ type checkRequestHeadersFunc func(req *http.Request) bool
 // There can be two kind of limitations:
 //   - Parallelism: Set limit for the number of concurrent requests to matching domains
 //   - Delay: Wait specified amount of time between requests (parallelism is 1 in this case)
+//
+// Rate limits the number of requests per second to the matching domains
+// with a token bucket, independently of Parallelism. Requests wait for
+// a token before they acquire a connection slot.
+//
+// Adaptive rules adjust the delay and the parallelism of every matching
+// host separately, starting from Delay and Parallelism, based on the
+// observed response latency and on 429 and 503 responses. Parallelism
+// limits each matching host instead of all of them together in this
+// case. The state of a host is dropped after it has been idle for 10
+// minutes.
 type LimitRule struct {
 	// DomainRegexp is a regular expression to match against domains
 	DomainRegexp string
@@ -58,12 +70,39 @@ type LimitRule struct {
 	Delay time.Duration
 	// RandomDelay is the extra randomized duration to wait added to Delay before creating a new request
 	RandomDelay time.Duration
-	// Parallelism is the number of the maximum allowed concurrent requests of the matching domains
-	Parallelism    int
+	// Parallelism is the number of the maximum allowed concurrent requests of the matching domains.
+	// It is the initial parallelism of each matching host if Adaptive is set.
+	Parallelism int
+	// Rate is the maximum number of requests per second to the matching
+	// domains. 0 means no rate limit.
+	Rate float64
+	// Burst is the number of requests which can be made at once above
+	// Rate. Defaults to 1.
+	Burst int
+	// Adaptive enables the automatic adjustment of the delay and the
+	// parallelism of the matching hosts
+	Adaptive bool
+	// MinDelay is the lower bound of the adaptive delay
+	MinDelay time.Duration
+	// MaxDelay is the upper bound of the adaptive delay. Defaults to 1 minute.
+	MaxDelay time.Duration
+	// MaxParallelism is the upper bound of the adaptive parallelism.
+	// Defaults to Parallelism, so only the delay is increased.
+	MaxParallelism int
+	// TargetLatency is the time to first response byte above which the
+	// adaptive parallelism is decreased. Defaults to 1 second.
+	TargetLatency  time.Duration
 	waitChan       chan bool
 	compiledRegexp *regexp.Regexp
 	compiledGlob   glob.Glob
 	lock           sync.Mutex
+	hosts          map[string]*hostThrottle
+	hostsLock      sync.Mutex
+	hostsCond      *sync.Cond
+	hostsEvicted   time.Time
+	tokens         float64
+	tokensUpdated  time.Time
+	tokensLock     sync.Mutex
 }
 
 // Init initializes the private members of LimitRule.
@@ -102,6 +141,9 @@ func (r *LimitRule) Init() error {
 	if !hasPattern {
 		return ErrNoPattern
 	}
+	if r.Adaptive {
+		r.initAdaptive()
+	}
 	r.waitChan = make(chan bool, max(r.Parallelism, 1))
 	return nil
 }
@@ -112,14 +154,28 @@ func (r *LimitRule) Init() error {
 // must be re-initialized via Init before use.
 func (r *LimitRule) Clone() *LimitRule {
 	return &LimitRule{
-		DomainRegexp: r.DomainRegexp,
-		DomainGlob:   r.DomainGlob,
-		Delay:        r.Delay,
-		RandomDelay:  r.RandomDelay,
-		Parallelism:  r.Parallelism,
+		DomainRegexp:   r.DomainRegexp,
+		DomainGlob:     r.DomainGlob,
+		Delay:          r.Delay,
+		RandomDelay:    r.RandomDelay,
+		Parallelism:    r.Parallelism,
+		Rate:           r.Rate,
+		Burst:          r.Burst,
+		Adaptive:       r.Adaptive,
+		MinDelay:       r.MinDelay,
+		MaxDelay:       r.MaxDelay,
+		MaxParallelism: r.MaxParallelism,
+		TargetLatency:  r.TargetLatency,
 	}
 }
 
+func (r *LimitRule) randomDelay() time.Duration {
+	if r.RandomDelay == 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(r.RandomDelay)))
+}
+
 func (h *httpBackend) Init(jar http.CookieJar) {
 	h.Client = &http.Client{
 		Jar:     jar,
@@ -154,73 +210,164 @@ func (h *httpBackend) GetMatchingRule(domain string) *LimitRule {
 	return nil
 }
 
-func (h *httpBackend) Cache(request *http.Request, bodySize int, checkRequestHeadersFunc checkRequestHeadersFunc, checkResponseHeadersFunc checkResponseHeadersFunc, cacheDir string, cacheExpiration time.Duration) (*Response, error) {
-	if cacheDir == "" || request.Method != "GET" || request.Header.Get("Cache-Control") == "no-cache" {
+func (h *httpBackend) Cache(request *http.Request, bodySize int, checkRequestHeadersFunc checkRequestHeadersFunc, checkResponseHeadersFunc checkResponseHeadersFunc, store cache.Cache, cacheExpiration time.Duration, retryable func(*Response) bool) (*Response, error) {
+	if store == nil || request.Method != "GET" || request.Header.Get("Cache-Control") == "no-cache" {
 		return h.Do(request, bodySize, checkRequestHeadersFunc, checkResponseHeadersFunc)
 	}
-	sum := sha1.Sum([]byte(request.URL.String()))
-	hash := hex.EncodeToString(sum[:])
-	dir := path.Join(cacheDir, hash[:2])
-	filename := path.Join(dir, hash)
+	key := cache.Key(request.URL.String())
 
-	if fileInfo, err := os.Stat(filename); err == nil && cacheExpiration > 0 {
-		if time.Since(fileInfo.ModTime()) > cacheExpiration {
-			_ = os.Remove(filename)
-		}
-	}
-
-	if file, err := os.Open(filename); err == nil {
-		resp := new(Response)
-		err := gob.NewDecoder(file).Decode(resp)
-		file.Close()
-		checkResponseHeadersFunc(request, resp.StatusCode, *resp.Headers)
-		if resp.StatusCode < 500 {
-			return resp, err
+	if data, stored, err := store.Get(key); err == nil {
+		if cacheExpiration > 0 && time.Since(stored) > cacheExpiration {
+			_ = store.Delete(key)
+		} else {
+			resp := new(Response)
+			if err := gob.NewDecoder(bytes.NewReader(data)).Decode(resp); err == nil && resp.Headers != nil &&
+				resp.StatusCode < 500 && !temporaryFailure(resp, retryable) {
+				checkResponseHeadersFunc(request, resp.StatusCode, *resp.Headers)
+				return resp, nil
+			}
 		}
 	}
 	resp, err := h.Do(request, bodySize, checkRequestHeadersFunc, checkResponseHeadersFunc)
-	if err != nil || resp.StatusCode >= 500 {
+	if err != nil || resp.StatusCode >= 500 || resp.Truncated || temporaryFailure(resp, retryable) {
 		return resp, err
 	}
-	if _, err := os.Stat(dir); err != nil {
-		if err := os.MkdirAll(dir, 0750); err != nil {
-			return resp, err
-		}
-	}
-	file, err := os.Create(filename + "~")
-	if err != nil {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(resp); err != nil {
 		return resp, err
 	}
-	if err := gob.NewEncoder(file).Encode(resp); err != nil {
-		file.Close()
-		return resp, err
-	}
-	file.Close()
-	return resp, os.Rename(filename+"~", filename)
+	return resp, store.Set(key, buf.Bytes())
 }
 
 func (h *httpBackend) Do(request *http.Request, bodySize int, checkRequestHeadersFunc checkRequestHeadersFunc, checkResponseHeadersFunc checkResponseHeadersFunc) (*Response, error) {
+	var response *Response
+	var bodyLimit *limitedReader
+	if bodySize > 0 {
+		bodyLimit = &limitedReader{n: int64(bodySize)}
+	}
+	err := h.do(request, bodyLimit, true, checkRequestHeadersFunc, checkResponseHeadersFunc, func(res *http.Response, bodyReader io.Reader) error {
+		body, err := io.ReadAll(bodyReader)
+		truncated := bodyLimit != nil && bodyLimit.truncated
+		// a compressed body cut at the limit ends unexpectedly
+		if err != nil && !truncated {
+			return err
+		}
+		response = &Response{
+			StatusCode: res.StatusCode,
+			Body:       body,
+			Headers:    &res.Header,
+			Truncated:  truncated,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// DoStream sends the request like Do, but it passes the body to
+// handleBody instead of reading it into the Response. The body is not
+// limited in size and it is only decompressed if decode is true. The
+// connection slot of the matching LimitRule is held until handleBody
+// returns.
+func (h *httpBackend) DoStream(request *http.Request, decode bool, checkRequestHeadersFunc checkRequestHeadersFunc, checkResponseHeadersFunc checkResponseHeadersFunc, handleBody func(*Response, io.Reader) error) error {
+	return h.do(request, nil, decode, checkRequestHeadersFunc, checkResponseHeadersFunc, func(res *http.Response, bodyReader io.Reader) error {
+		return handleBody(&Response{
+			StatusCode: res.StatusCode,
+			Headers:    &res.Header,
+		}, bodyReader)
+	})
+}
+
+// do sends the request respecting the matching LimitRule and passes the
+// response with its body to handleBody. The raw body is read through
+// bodyLimit, unless it is nil. gzip bodies are decompressed if decode
+// is true.
+func (h *httpBackend) do(request *http.Request, bodyLimit *limitedReader, decode bool, checkRequestHeadersFunc checkRequestHeadersFunc, checkResponseHeadersFunc checkResponseHeadersFunc, handleBody func(*http.Response, io.Reader) error) error {
+	h.lock.RLock()
+	breaker := h.circuitBreaker
+	h.lock.RUnlock()
+	if breaker != nil {
+		// fail fast without waiting for the LimitRule
+		if err := breaker.check(request.URL.Host); err != nil {
+			return err
+		}
+	}
+	if d, cancel := h.crawlDelays.reserve(request.URL.Host); d > 0 {
+		if err := sleepContext(request.Context(), d); err != nil {
+			cancel()
+			return err
+		}
+	}
 	r := h.GetMatchingRule(request.URL.Host)
-	if r != nil {
+	if r != nil && r.Rate > 0 {
+		if err := sleepContext(request.Context(), r.reserve()); err != nil {
+			return err
+		}
+	}
+	if r != nil && r.Adaptive {
+		host := request.URL.Host
+		r.acquireHost(host)
+		defer func(r *LimitRule) {
+			time.Sleep(r.hostDelay(host) + r.randomDelay())
+			r.releaseHost(host)
+		}(r)
+	} else if r != nil {
 		r.waitChan <- true
 		defer func(r *LimitRule) {
-			randomDelay := time.Duration(0)
-			if r.RandomDelay != 0 {
-				randomDelay = time.Duration(rand.Int63n(int64(r.RandomDelay)))
-			}
-			time.Sleep(r.Delay + randomDelay)
+			time.Sleep(r.Delay + r.randomDelay())
 			<-r.waitChan
 		}(r)
 	}
+	var circuitDone func(statusCode int, err error)
+	if breaker != nil {
+		// the circuit may have opened while the request was waiting
+		done, err := breaker.allow(request.URL.Host)
+		if err != nil {
+			return err
+		}
+		circuitDone = done
+	}
 	if !checkRequestHeadersFunc(request) {
-		return nil, ErrAbortedBeforeRequest
+		if circuitDone != nil {
+			// release the probe of a half-open circuit
+			circuitDone(0, context.Canceled)
+		}
+		return ErrAbortedBeforeRequest
+	}
+	var hTrace *HTTPTrace
+	if r != nil && r.Adaptive {
+		hTrace = &HTTPTrace{}
+		request = hTrace.WithTrace(request)
 	}
 	res, err := h.Client.Do(request)
+	statusCode := 0
+	if res != nil {
+		statusCode = res.StatusCode
+	}
+	if hTrace != nil {
+		r.observe(request.URL.Host, hTrace.FirstByteDuration, statusCode, err)
+	}
 	if err != nil {
-		return nil, err
+		if circuitDone != nil {
+			circuitDone(statusCode, err)
+		}
+		return err
 	}
 	defer res.Body.Close()
 
+	var bodyReader io.Reader = res.Body
+	if circuitDone != nil {
+		// the result is recorded after the body is read, so body read
+		// timeouts and resets are failures too
+		body := &errorRecorder{r: res.Body}
+		bodyReader = body
+		defer func() {
+			circuitDone(statusCode, body.err)
+		}()
+	}
+
 	finalRequest := request
 	if res.Request != nil {
 		finalRequest = res.Request
@@ -228,46 +375,65 @@ func (h *httpBackend) Do(request *http.Request, bodySize int, checkRequestHeader
 	if !checkResponseHeadersFunc(finalRequest, res.StatusCode, res.Header) {
 		// closing res.Body (see defer above) without reading it aborts
 		// the download
-		return nil, ErrAbortedAfterHeaders
+		return ErrAbortedAfterHeaders
 	}
 
-	var bodyReader io.Reader = res.Body
-	if bodySize > 0 {
-		bodyReader = io.LimitReader(bodyReader, int64(bodySize))
-	}
-	contentEncoding := strings.ToLower(res.Header.Get("Content-Encoding"))
-	if !res.Uncompressed && (strings.Contains(contentEncoding, "gzip") || (contentEncoding == "" && strings.Contains(strings.ToLower(res.Header.Get("Content-Type")), "gzip")) || (strings.HasSuffix(strings.ToLower(finalRequest.URL.Path), ".xml.gz") && res.StatusCode >= 200 && res.StatusCode < 300)) {
-		// Even if URL contains .xml.gz, it doesn't mean that we get gzip
-		// compressed data back. We might get 404 error page instead,
-		// for example. So check gzip magic bytes.
-		bufReader := bufio.NewReader(bodyReader)
-		bodyReader = bufReader
-		magic, err := bufReader.Peek(2)
-		switch err {
-		case io.EOF:
-			// less than 2 bytes, do nothing
-		case nil:
-			// gzip magic, as specified in RFC 1952
-			if magic[0] == 0x1f && magic[1] == 0x8b {
-				bodyReader, err = gzip.NewReader(bufReader)
-				if err != nil {
-					return nil, err
-				}
-				defer bodyReader.(*gzip.Reader).Close()
+	if bodyLimit != nil {
+		bodyLimit.r = bodyReader
+		bodyReader = bodyLimit
+	}
+	if decode {
+		decoded, closers, err := h.decodeBody(res, finalRequest, bodyReader)
+		if err != nil {
+			return err
+		}
+		defer closeAll(closers)
+		bodyReader = decoded
+	}
+	return handleBody(res, bodyReader)
+}
+
+// limitedReader reads at most n bytes like io.LimitReader, and records
+// if the underlying reader had more data
+type limitedReader struct {
+	r         io.Reader
+	n         int64
+	truncated bool
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		var b [1]byte
+		for {
+			n, err := l.r.Read(b[:])
+			if n > 0 {
+				l.truncated = true
+			}
+			if n > 0 || err != nil {
+				return 0, io.EOF
 			}
-		default:
-			return nil, err
 		}
 	}
-	body, err := io.ReadAll(bodyReader)
-	if err != nil {
-		return nil, err
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// errorRecorder records the first error other than io.EOF returned by r
+type errorRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errorRecorder) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF && e.err == nil {
+		e.err = err
 	}
-	return &Response{
-		StatusCode: res.StatusCode,
-		Body:       body,
-		Headers:    &res.Header,
-	}, nil
+	return n, err
 }
 
 func (h *httpBackend) Limit(rule *LimitRule) error {
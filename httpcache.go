@@ -0,0 +1,310 @@
+// Copyright 2018 Adam Tauber
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package colly
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocolly/colly/v2/cache"
+)
+
+// maxHeuristicFreshness limits the freshness lifetime calculated
+// from Last-Modified
+const maxHeuristicFreshness = 24 * time.Hour
+
+// heuristicallyCacheable are the status codes which can be cached
+// without explicit freshness information (RFC 9110 15.1)
+var heuristicallyCacheable = []int{200, 203, 204, 300, 301, 308, 404, 405, 410, 414, 501}
+
+// httpCacheEntry is a response stored by the HTTP cache mode
+type httpCacheEntry struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// RequestTime and ResponseTime are the times when the request of
+	// the response was sent and when the response was received
+	RequestTime  time.Time
+	ResponseTime time.Time
+	// Vary contains the values of the request headers listed in
+	// the Vary header of the response
+	Vary http.Header
+}
+
+// cacheControl contains the directives of a Cache-Control header
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
+			}
+			name, value, _ := strings.Cut(d, "=")
+			cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	v, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	s, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || s < 0 {
+		return 0, false
+	}
+	return time.Duration(s) * time.Second, true
+}
+
+// httpCacheKeySuffix is appended to the keys of the HTTP cache mode,
+// because its entries have a different format than the ones of Cache
+const httpCacheKeySuffix = ".http"
+
+// HTTPCache is the HTTP caching mode of Cache. It follows RFC 9111 as a
+// private cache: freshness is calculated from Cache-Control, Expires,
+// Date, Age and Last-Modified, responses are selected by Vary and stale
+// responses are revalidated with If-None-Match and If-Modified-Since.
+func (h *httpBackend) HTTPCache(request *http.Request, bodySize int, checkRequestHeadersFunc checkRequestHeadersFunc, checkResponseHeadersFunc checkResponseHeadersFunc, store cache.Cache, retryable func(*Response) bool) (*Response, error) {
+	if store == nil || request.Method != "GET" {
+		return h.Do(request, bodySize, checkRequestHeadersFunc, checkResponseHeadersFunc)
+	}
+	key := cache.Key(request.URL.String()) + httpCacheKeySuffix
+	reqCC := parseCacheControl(request.Header)
+
+	entry := readHTTPCacheEntry(store, key)
+	if entry != nil && (!entry.matches(request) || temporaryFailure(&Response{StatusCode: entry.StatusCode, Headers: &entry.Header}, retryable)) {
+		entry = nil
+	}
+	if entry != nil && entry.fresh(reqCC, time.Now()) {
+		resp := entry.response(time.Now())
+		checkResponseHeadersFunc(request, resp.StatusCode, *resp.Headers)
+		return resp, nil
+	}
+
+	if entry != nil {
+		request = entry.conditional(request)
+		check := checkResponseHeadersFunc
+		checkResponseHeadersFunc = func(req *http.Request, statusCode int, header http.Header) bool {
+			if statusCode == http.StatusNotModified {
+				return check(req, entry.StatusCode, entry.merge(header))
+			}
+			return check(req, statusCode, header)
+		}
+	}
+	requestTime := time.Now()
+	resp, err := h.Do(request, bodySize, checkRequestHeadersFunc, checkResponseHeadersFunc)
+	responseTime := time.Now()
+	if err != nil {
+		return resp, err
+	}
+	if entry != nil && resp.StatusCode == http.StatusNotModified {
+		entry.Header = entry.merge(*resp.Headers)
+		entry.RequestTime, entry.ResponseTime = requestTime, responseTime
+		resp = entry.response(responseTime)
+		return resp, writeHTTPCacheEntry(store, key, entry)
+	}
+	if !storable(reqCC, resp) || temporaryFailure(resp, retryable) {
+		if entry != nil {
+			_ = store.Delete(key)
+		}
+		return resp, nil
+	}
+	entry = &httpCacheEntry{
+		StatusCode:   resp.StatusCode,
+		Header:       *resp.Headers,
+		Body:         resp.Body,
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+		Vary:         varyHeaders(request.Header, *resp.Headers),
+	}
+	return resp, writeHTTPCacheEntry(store, key, entry)
+}
+
+func readHTTPCacheEntry(store cache.Cache, key string) *httpCacheEntry {
+	data, _, err := store.Get(key)
+	if err != nil {
+		return nil
+	}
+	entry := &httpCacheEntry{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(entry); err != nil {
+		return nil
+	}
+	return entry
+}
+
+func writeHTTPCacheEntry(store cache.Cache, key string, entry *httpCacheEntry) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(entry); err != nil {
+		return err
+	}
+	return store.Set(key, buf.Bytes())
+}
+
+// storable returns true if resp can be stored by a private cache
+func storable(reqCC cacheControl, resp *Response) bool {
+	respCC := parseCacheControl(*resp.Headers)
+	if resp.Truncated || reqCC.has("no-store") || respCC.has("no-store") || resp.Headers.Get("Vary") == "*" {
+		return false
+	}
+	if resp.StatusCode >= 500 && resp.StatusCode != http.StatusNotImplemented {
+		return false
+	}
+	// partial and not modified responses don't hold the full representation
+	if resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+	if respCC.has("max-age") || respCC.has("no-cache") || resp.Headers.Get("Expires") != "" {
+		return true
+	}
+	return slices.Contains(heuristicallyCacheable, resp.StatusCode)
+}
+
+func varyHeaders(reqHeader, respHeader http.Header) http.Header {
+	vary := http.Header{}
+	for _, v := range respHeader.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name != "" {
+				vary[name] = reqHeader.Values(name)
+			}
+		}
+	}
+	return vary
+}
+
+// matches returns true if the entry was stored for a request with the
+// same values of the headers listed in Vary
+func (e *httpCacheEntry) matches(request *http.Request) bool {
+	for name, values := range e.Vary {
+		if !slices.Equal(values, request.Header.Values(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// freshnessLifetime calculates the freshness lifetime of the entry
+// (RFC 9111 4.2.1)
+func (e *httpCacheEntry) freshnessLifetime() time.Duration {
+	cc := parseCacheControl(e.Header)
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+	date, err := http.ParseTime(e.Header.Get("Date"))
+	if err != nil {
+		date = e.ResponseTime
+	}
+	if v := e.Header.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			return 0
+		}
+		return max(expires.Sub(date), 0)
+	}
+	if !slices.Contains(heuristicallyCacheable, e.StatusCode) {
+		return 0
+	}
+	if lastModified, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil && lastModified.Before(date) {
+		return min(date.Sub(lastModified)/10, maxHeuristicFreshness)
+	}
+	return 0
+}
+
+// age calculates the current age of the entry (RFC 9111 4.2.3)
+func (e *httpCacheEntry) age(now time.Time) time.Duration {
+	apparentAge := time.Duration(0)
+	if date, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		apparentAge = max(e.ResponseTime.Sub(date), 0)
+	}
+	ageValue := time.Duration(0)
+	if s, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && s > 0 {
+		ageValue = time.Duration(s) * time.Second
+	}
+	responseDelay := e.ResponseTime.Sub(e.RequestTime)
+	correctedInitialAge := max(apparentAge, ageValue+responseDelay)
+	return correctedInitialAge + now.Sub(e.ResponseTime)
+}
+
+// fresh returns true if the entry can be served without revalidation
+func (e *httpCacheEntry) fresh(reqCC cacheControl, now time.Time) bool {
+	if reqCC.has("no-cache") || parseCacheControl(e.Header).has("no-cache") {
+		return false
+	}
+	lifetime := e.freshnessLifetime()
+	if d, ok := reqCC.seconds("max-age"); ok {
+		lifetime = min(lifetime, d)
+	}
+	age := e.age(now)
+	if d, ok := reqCC.seconds("min-fresh"); ok {
+		age += d
+	}
+	return lifetime > age
+}
+
+// conditional returns a copy of request with the validators of the entry
+func (e *httpCacheEntry) conditional(request *http.Request) *http.Request {
+	etag := e.Header.Get("ETag")
+	lastModified := e.Header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return request
+	}
+	r := request.WithContext(request.Context())
+	r.Header = request.Header.Clone()
+	if etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		r.Header.Set("If-Modified-Since", lastModified)
+	}
+	return r
+}
+
+// merge returns the headers of the entry updated with the headers of
+// a 304 response (RFC 9111 3.2)
+func (e *httpCacheEntry) merge(header http.Header) http.Header {
+	merged := e.Header.Clone()
+	for name, values := range header {
+		if name == "Content-Length" || name == "Content-Encoding" || name == "Transfer-Encoding" {
+			continue
+		}
+		merged[name] = values
+	}
+	return merged
+}
+
+func (e *httpCacheEntry) response(now time.Time) *Response {
+	header := e.Header.Clone()
+	header.Set("Age", strconv.FormatInt(int64(e.age(now)/time.Second), 10))
+	return &Response{
+		StatusCode: e.StatusCode,
+		Body:       e.Body,
+		Headers:    &header,
+	}
+}
@@ -0,0 +1,406 @@
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/gocolly/colly/v2"
+)
+
+const (
+	journalMagic = "COLLYQ01"
+
+	opAdd byte = 1
+	opAck byte = 2
+
+	journalHeaderSize = 8
+	journalOpSize     = 9
+	maxJournalRecord  = 64 << 20
+
+	defaultJournalCompactMin = 1 << 14
+)
+
+// ErrCorruptJournal is returned by FileQueueStorage.Init if the journal
+// is not a FileQueueStorage journal
+var ErrCorruptJournal = errors.New("queue: corrupt journal file")
+
+// FileQueueStorage is a durable implementation of the AckStorage
+// interface which keeps the queue in a journal file on the disk.
+// Requests are leased by the Queue and only removed from the journal
+// after they are processed, so requests which were in flight when the
+// process stopped or crashed are returned again after restart.
+// This gives at-least-once processing of the queued requests.
+// Requests are acknowledged when Request.Do returns, which is before
+// the response is processed if the Collector is Async, so use a
+// synchronous Collector with FileQueueStorage.
+//
+// Only the positions of the requests are kept in memory, the serialized
+// requests are read back from the journal when they are leased.
+type FileQueueStorage struct {
+	// Path is the location of the journal file
+	Path string
+	// MaxSize defines the capacity of the queue.
+	// New requests are discarded if the queue size reaches MaxSize
+	MaxSize int
+	// Sync makes every journal write durable with fsync. Without Sync
+	// the queue survives process crashes but not operating system
+	// crashes or power loss.
+	Sync bool
+	// CompactMinRecords is the minimum number of acknowledged requests
+	// before the journal gets compacted. Defaults to 16384.
+	CompactMinRecords int
+
+	lock    *sync.Mutex
+	file    *os.File
+	size    int64
+	nextID  uint64
+	pending *list.List
+	leased  map[uint64]journalItem
+	acked   int
+}
+
+type journalItem struct {
+	id     uint64
+	offset int64
+	length int
+}
+
+// Init implements Storage.Init() function. It opens or creates
+// the journal and recovers the queued and leased requests.
+func (q *FileQueueStorage) Init() error {
+	if q.lock == nil {
+		q.lock = &sync.Mutex{}
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.file != nil {
+		return nil
+	}
+	if q.CompactMinRecords <= 0 {
+		q.CompactMinRecords = defaultJournalCompactMin
+	}
+	if dir := filepath.Dir(q.Path); dir != "" {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(q.Path, os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	if err := q.replay(f); err != nil {
+		f.Close()
+		return err
+	}
+	q.file = f
+	return nil
+}
+
+// Close closes the journal file
+func (q *FileQueueStorage) Close() error {
+	if q.lock == nil {
+		return nil
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.file == nil {
+		return nil
+	}
+	err := q.file.Close()
+	q.file = nil
+	return err
+}
+
+// AddRequest implements Storage.AddRequest() function
+func (q *FileQueueStorage) AddRequest(r []byte) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	// Discard URLs if size limit exceeded
+	if q.MaxSize > 0 && q.pending.Len()+len(q.leased) >= q.MaxSize {
+		return colly.ErrQueueFull
+	}
+	id := q.nextID
+	offset, err := q.write(opAdd, id, r)
+	if err != nil {
+		return err
+	}
+	if err := q.sync(); err != nil {
+		return err
+	}
+	q.nextID++
+	q.pending.PushBack(journalItem{id: id, offset: offset, length: len(r)})
+	return nil
+}
+
+// GetRequest implements Storage.GetRequest() function.
+// The returned request is removed from the queue immediately.
+func (q *FileQueueStorage) GetRequest() ([]byte, error) {
+	id, r, err := q.LeaseRequest()
+	if err != nil || r == nil {
+		return r, err
+	}
+	return r, q.Ack(id)
+}
+
+// LeaseRequest implements AckStorage.LeaseRequest() function
+func (q *FileQueueStorage) LeaseRequest() (uint64, []byte, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	e := q.pending.Front()
+	if e == nil {
+		return 0, nil, nil
+	}
+	item := e.Value.(journalItem)
+	r := make([]byte, item.length)
+	if _, err := q.file.ReadAt(r, item.offset); err != nil {
+		return 0, nil, err
+	}
+	q.pending.Remove(e)
+	q.leased[item.id] = item
+	return item.id, r, nil
+}
+
+// Ack implements AckStorage.Ack() function
+func (q *FileQueueStorage) Ack(id uint64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, ok := q.leased[id]; !ok {
+		return nil
+	}
+	if _, err := q.write(opAck, id, nil); err != nil {
+		return err
+	}
+	if err := q.sync(); err != nil {
+		return err
+	}
+	delete(q.leased, id)
+	q.acked++
+	if q.acked >= q.CompactMinRecords && q.acked > q.pending.Len()+len(q.leased) {
+		return q.compact()
+	}
+	return nil
+}
+
+// QueueSize implements Storage.QueueSize() function.
+// Leased requests are not included.
+func (q *FileQueueStorage) QueueSize() (int, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.pending.Len(), nil
+}
+
+func (q *FileQueueStorage) replay(f *os.File) error {
+	q.pending = list.New()
+	q.leased = make(map[uint64]journalItem)
+	q.acked = 0
+	q.nextID = 1
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		if _, err := f.WriteString(journalMagic); err != nil {
+			return err
+		}
+		q.size = int64(len(journalMagic))
+		return f.Sync()
+	}
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(journalMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != journalMagic {
+		return ErrCorruptJournal
+	}
+	offset := int64(len(magic))
+	items := make(map[uint64]*list.Element)
+	header := make([]byte, journalHeaderSize)
+	for info.Size()-offset >= journalHeaderSize {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return err
+		}
+		size := binary.BigEndian.Uint32(header)
+		if size < journalOpSize || size > maxJournalRecord {
+			// a zero filled tail is left by a crash, anything else
+			// can't be skipped
+			if zeroTail(header, r) {
+				break
+			}
+			return ErrCorruptJournal
+		}
+		end := offset + journalHeaderSize + int64(size)
+		if end > info.Size() {
+			break
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return err
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			if end == info.Size() {
+				// torn last record
+				break
+			}
+			// skip the corrupted record
+			offset = end
+			continue
+		}
+		id := binary.BigEndian.Uint64(payload[1:])
+		switch payload[0] {
+		case opAdd:
+			items[id] = q.pending.PushBack(journalItem{
+				id:     id,
+				offset: offset + journalHeaderSize + journalOpSize,
+				length: int(size) - journalOpSize,
+			})
+			q.nextID = max(q.nextID, id+1)
+		case opAck:
+			if e, ok := items[id]; ok {
+				q.pending.Remove(e)
+				delete(items, id)
+			}
+			q.acked++
+		}
+		offset = end
+	}
+	// Drop the torn tail of the journal, if any.
+	if offset != info.Size() {
+		if err := f.Truncate(offset); err != nil {
+			return err
+		}
+	}
+	q.size = offset
+	return nil
+}
+
+// write appends a record to the journal and returns the offset of its data
+func (q *FileQueueStorage) write(op byte, id uint64, data []byte) (int64, error) {
+	if q.file == nil {
+		return 0, os.ErrClosed
+	}
+	b := make([]byte, journalHeaderSize+journalOpSize+len(data))
+	payload := b[journalHeaderSize:]
+	payload[0] = op
+	binary.BigEndian.PutUint64(payload[1:], id)
+	copy(payload[journalOpSize:], data)
+	binary.BigEndian.PutUint32(b, uint32(len(payload)))
+	binary.BigEndian.PutUint32(b[4:], crc32.ChecksumIEEE(payload))
+	if _, err := q.file.WriteAt(b, q.size); err != nil {
+		return 0, err
+	}
+	offset := q.size + journalHeaderSize + journalOpSize
+	q.size += int64(len(b))
+	return offset, nil
+}
+
+func (q *FileQueueStorage) sync() error {
+	if !q.Sync {
+		return nil
+	}
+	return q.file.Sync()
+}
+
+// compact rewrites the journal without the acknowledged requests.
+// Leased requests are kept in front of the pending ones.
+func (q *FileQueueStorage) compact() error {
+	tmpName := q.Path + ".compact"
+	tmp, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	old, oldSize := q.file, q.size
+	q.file, q.size = tmp, 0
+	pending := list.New()
+	leased := make(map[uint64]journalItem, len(q.leased))
+	err = q.rewrite(old, leased, pending)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpName, q.Path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		q.file, q.size = old, oldSize
+		return err
+	}
+	syncDir(filepath.Dir(q.Path))
+	old.Close()
+	q.pending = pending
+	q.leased = leased
+	q.acked = 0
+	return nil
+}
+
+func (q *FileQueueStorage) rewrite(old *os.File, leased map[uint64]journalItem, pending *list.List) error {
+	if _, err := q.file.WriteString(journalMagic); err != nil {
+		return err
+	}
+	q.size = int64(len(journalMagic))
+	copyItem := func(item journalItem) (journalItem, error) {
+		data := make([]byte, item.length)
+		if _, err := old.ReadAt(data, item.offset); err != nil {
+			return item, err
+		}
+		offset, err := q.write(opAdd, item.id, data)
+		item.offset = offset
+		return item, err
+	}
+	ids := make([]uint64, 0, len(q.leased))
+	for id := range q.leased {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		item, err := copyItem(q.leased[id])
+		if err != nil {
+			return err
+		}
+		leased[item.id] = item
+	}
+	for e := q.pending.Front(); e != nil; e = e.Next() {
+		item, err := copyItem(e.Value.(journalItem))
+		if err != nil {
+			return err
+		}
+		pending.PushBack(item)
+	}
+	return nil
+}
+
+// zeroTail returns true if header and the rest of r contain only zeros
+func zeroTail(header []byte, r io.Reader) bool {
+	if len(bytes.Trim(header, "\x00")) != 0 {
+		return false
+	}
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := r.Read(buf)
+		if len(bytes.Trim(buf[:n], "\x00")) != 0 {
+			return false
+		}
+		if err != nil {
+			return err == io.EOF
+		}
+	}
+}
+
+// syncDir makes a rename durable by syncing the parent directory.
+// Errors are ignored, some platforms don't support syncing directories.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
@@ -0,0 +1,121 @@
+package queue
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/gocolly/colly/v2"
+)
+
+// HostStorage is implemented by storages which partition the queued
+// requests by host. Queue uses it to skip hosts which can't accept new
+// requests because the slots of their LimitRule are taken.
+type HostStorage interface {
+	Storage
+	// GetHostRequest pops the next request of a host for which available
+	// returns true. It returns nil if there is no such request.
+	GetHostRequest(available func(host string) bool) ([]byte, error)
+}
+
+// HostQueueStorage is an in-memory implementation of the HostStorage
+// interface. It keeps a FIFO queue per host and returns requests
+// round-robin across the hosts, so a single host with many queued
+// requests can't starve the others.
+type HostQueueStorage struct {
+	// MaxSize defines the capacity of the queue.
+	// New requests are discarded if the queue size reaches MaxSize
+	MaxSize int
+	lock    *sync.Mutex
+	hosts   map[string]*hostQueue
+	ring    []string
+	next    int
+	size    int
+}
+
+type hostQueue struct {
+	first *inMemoryQueueItem
+	last  *inMemoryQueueItem
+}
+
+// Init implements Storage.Init() function
+func (q *HostQueueStorage) Init() error {
+	q.lock = &sync.Mutex{}
+	q.hosts = make(map[string]*hostQueue)
+	return nil
+}
+
+// AddRequest implements Storage.AddRequest() function
+func (q *HostQueueStorage) AddRequest(r []byte) error {
+	// Requests which can't be decoded are queued with an empty host,
+	// the queue reports them when they are loaded.
+	var sr struct{ URL string }
+	var host string
+	if json.Unmarshal(r, &sr) == nil {
+		host = requestHost(sr.URL)
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	// Discard URLs if size limit exceeded
+	if q.MaxSize > 0 && q.size >= q.MaxSize {
+		return colly.ErrQueueFull
+	}
+	hq, ok := q.hosts[host]
+	if !ok {
+		hq = &hostQueue{}
+		q.hosts[host] = hq
+		q.ring = append(q.ring, host)
+	}
+	i := &inMemoryQueueItem{Request: r}
+	if hq.first == nil {
+		hq.first = i
+	} else {
+		hq.last.Next = i
+	}
+	hq.last = i
+	q.size++
+	return nil
+}
+
+// GetRequest implements Storage.GetRequest() function
+func (q *HostQueueStorage) GetRequest() ([]byte, error) {
+	return q.GetHostRequest(func(string) bool { return true })
+}
+
+// GetHostRequest implements HostStorage.GetHostRequest() function
+func (q *HostQueueStorage) GetHostRequest(available func(host string) bool) ([]byte, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for n := 0; n < len(q.ring); n++ {
+		i := (q.next + n) % len(q.ring)
+		host := q.ring[i]
+		if !available(host) {
+			continue
+		}
+		hq := q.hosts[host]
+		r := hq.first.Request
+		hq.first = hq.first.Next
+		q.size--
+		if hq.first == nil {
+			delete(q.hosts, host)
+			q.ring = append(q.ring[:i], q.ring[i+1:]...)
+			q.next = i
+		} else {
+			q.next = i + 1
+		}
+		if len(q.ring) > 0 {
+			q.next %= len(q.ring)
+		} else {
+			q.next = 0
+		}
+		return r, nil
+	}
+	return nil, nil
+}
+
+// QueueSize implements Storage.QueueSize() function
+func (q *HostQueueStorage) QueueSize() (int, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.size, nil
+}
@@ -0,0 +1,93 @@
+package queue
+
+import (
+	"container/heap"
+	"encoding/json"
+	"sync"
+
+	"github.com/gocolly/colly/v2"
+)
+
+// PriorityQueueStorage is an in-memory implementation of the Storage
+// interface which returns requests in the order of their
+// colly.Request.Priority. Requests with the same priority are returned
+// in FIFO order.
+type PriorityQueueStorage struct {
+	// MaxSize defines the capacity of the queue.
+	// New requests are discarded if the queue size reaches MaxSize
+	MaxSize int
+	lock    *sync.Mutex
+	items   priorityItems
+	seq     uint64
+}
+
+type priorityItem struct {
+	Request  []byte
+	priority int
+	seq      uint64
+}
+
+type priorityItems []*priorityItem
+
+// Init implements Storage.Init() function
+func (q *PriorityQueueStorage) Init() error {
+	q.lock = &sync.Mutex{}
+	return nil
+}
+
+// AddRequest implements Storage.AddRequest() function
+func (q *PriorityQueueStorage) AddRequest(r []byte) error {
+	// Requests which can't be decoded get the default priority,
+	// the queue reports them when they are loaded.
+	var p struct{ Priority int }
+	json.Unmarshal(r, &p)
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	// Discard URLs if size limit exceeded
+	if q.MaxSize > 0 && len(q.items) >= q.MaxSize {
+		return colly.ErrQueueFull
+	}
+	q.seq++
+	heap.Push(&q.items, &priorityItem{Request: r, priority: p.Priority, seq: q.seq})
+	return nil
+}
+
+// GetRequest implements Storage.GetRequest() function
+func (q *PriorityQueueStorage) GetRequest() ([]byte, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.items) == 0 {
+		return nil, nil
+	}
+	return heap.Pop(&q.items).(*priorityItem).Request, nil
+}
+
+// QueueSize implements Storage.QueueSize() function
+func (q *PriorityQueueStorage) QueueSize() (int, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.items), nil
+}
+
+func (h priorityItems) Len() int { return len(h) }
+
+func (h priorityItems) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h priorityItems) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *priorityItems) Push(x interface{}) { *h = append(*h, x.(*priorityItem)) }
+
+func (h *priorityItems) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
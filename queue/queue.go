@@ -1,8 +1,10 @@
 package queue
 
 import (
+	"errors"
 	"net/url"
 	"sync"
+	"time"
 
 	whatwgUrl "github.com/nlnwa/whatwg-url/url"
 
@@ -11,6 +13,12 @@ import (
 
 const stop = true
 
+// saturationPollInterval is the time to wait before checking the
+// LimitRules again if every queued host is saturated
+const saturationPollInterval = 10 * time.Millisecond
+
+var errEmptyQueue = errors.New("queue: no request to lease")
+
 var urlParser = whatwgUrl.NewParser(whatwgUrl.WithPercentEncodeSinglePercentSign())
 
 // Storage is the interface of the queue's storage backend
@@ -27,6 +35,19 @@ type Storage interface {
 	QueueSize() (int, error)
 }
 
+// AckStorage is implemented by storages which lease requests instead
+// of removing them when they are returned. Queue acknowledges a leased
+// request after it is processed, unacknowledged requests can be
+// recovered by the storage, e.g. after a crash.
+type AckStorage interface {
+	Storage
+	// LeaseRequest returns the next request of the queue and its lease
+	// ID, or a nil request if the queue is empty
+	LeaseRequest() (uint64, []byte, error)
+	// Ack removes a processed request from the storage
+	Ack(id uint64) error
+}
+
 // Queue is a request queue which uses a Collector to consume
 // requests in multiple threads
 type Queue struct {
@@ -141,7 +162,7 @@ func (q *Queue) Run(c *colly.Collector) error {
 	q.mut.Unlock()
 
 	requestc := make(chan *colly.Request)
-	complete, errc := make(chan struct{}), make(chan error, 1)
+	complete, errc := make(chan *colly.Request), make(chan error, 1)
 	for i := 0; i < q.Threads; i++ {
 		go independentRunner(requestc, complete)
 	}
@@ -150,15 +171,43 @@ func (q *Queue) Run(c *colly.Collector) error {
 	return <-errc
 }
 
-// Stop will stop the running queue
+// Stop will stop the running queue. Run returns after the requests
+// in progress are completed.
 func (q *Queue) Stop() {
 	q.mut.Lock()
 	q.running = false
 	q.mut.Unlock()
 }
 
-func (q *Queue) loop(c *colly.Collector, requestc chan<- *colly.Request, complete <-chan struct{}, errc chan<- error) {
+func (q *Queue) loop(c *colly.Collector, requestc chan<- *colly.Request, complete <-chan *colly.Request, errc chan<- error) {
 	var active int
+	// inflight counts the dispatched requests per host which
+	// may not hold a slot of their LimitRule yet
+	inflight := make(map[string]int)
+	available := func(host string) bool {
+		limit, used := c.DomainLimit(host)
+		return limit == 0 || (used < limit && inflight[host] < limit)
+	}
+	hs, partitioned := q.storage.(HostStorage)
+	// hosts holds the inflight keys of the dispatched requests
+	hosts := make(map[*colly.Request]string)
+	// leases holds the lease IDs of the dispatched requests
+	leases := make(map[*colly.Request]uint64)
+	as, leasing := q.storage.(AckStorage)
+	// done releases the slot of a completed request and acknowledges it
+	done := func(r *colly.Request) error {
+		active--
+		host := hosts[r]
+		delete(hosts, r)
+		if inflight[host]--; inflight[host] <= 0 {
+			delete(inflight, host)
+		}
+		if id, ok := leases[r]; ok {
+			delete(leases, r)
+			return as.Ack(id)
+		}
+		return nil
+	}
 	for {
 		size, err := q.storage.QueueSize()
 		if err != nil {
@@ -169,18 +218,39 @@ func (q *Queue) loop(c *colly.Collector, requestc chan<- *colly.Request, complet
 			// Terminate when
 			//   1. No active requests
 			//   2. Empty queue
+			// A stopped queue waits for the dispatched requests, so
+			// they aren't processed again by the next run.
+			for active > 0 {
+				if err := done(<-complete); err != nil {
+					errc <- err
+					return
+				}
+			}
 			errc <- nil
 			break
 		}
 		sent := requestc
 		var req *colly.Request
+		var poll <-chan time.Time
 		if size > 0 {
-			req, err = q.loadRequest(c)
+			if partitioned {
+				req, err = q.loadHostRequest(c, hs, available)
+			} else if leasing {
+				req, err = q.leaseRequest(c, as, leases)
+			} else {
+				req, err = q.loadRequest(c)
+			}
 			if err != nil {
 				// ignore an error returned by GetRequest() or
 				// UnmarshalRequest()
 				continue
 			}
+			if req == nil {
+				// every host with queued requests is saturated,
+				// wait for a free slot
+				sent = nil
+				poll = time.After(saturationPollInterval)
+			}
 		} else {
 			sent = nil
 		}
@@ -189,25 +259,47 @@ func (q *Queue) loop(c *colly.Collector, requestc chan<- *colly.Request, complet
 			select {
 			case sent <- req:
 				active++
+				host := requestHost(req.URL.String())
+				hosts[req] = host
+				inflight[host]++
 				break Sent
 			case <-q.wake:
 				if sent == nil {
 					break Sent
 				}
-			case <-complete:
-				active--
-				if sent == nil && active == 0 {
+			case r := <-complete:
+				if err := done(r); err != nil {
+					errc <- err
+					return
+				}
+				if sent == nil && (active == 0 || poll != nil) {
 					break Sent
 				}
+			case <-poll:
+				break Sent
 			}
 		}
 	}
 }
 
-func independentRunner(requestc <-chan *colly.Request, complete chan<- struct{}) {
+// requestHost returns the host of URL as the Collector sees it when the
+// request is sent. It is the key of the HostStorage partitions.
+func requestHost(URL string) string {
+	u, err := urlParser.Parse(URL)
+	if err != nil {
+		return ""
+	}
+	u2, err := url.Parse(u.Href(false))
+	if err != nil {
+		return ""
+	}
+	return u2.Host
+}
+
+func independentRunner(requestc <-chan *colly.Request, complete chan<- *colly.Request) {
 	for req := range requestc {
 		req.Do()
-		complete <- struct{}{}
+		complete <- req
 	}
 }
 
@@ -221,6 +313,36 @@ func (q *Queue) loadRequest(c *colly.Collector) (*colly.Request, error) {
 	return c.UnmarshalRequest(copied)
 }
 
+func (q *Queue) loadHostRequest(c *colly.Collector, hs HostStorage, available func(string) bool) (*colly.Request, error) {
+	buf, err := hs.GetHostRequest(available)
+	if err != nil || buf == nil {
+		return nil, err
+	}
+	copied := make([]byte, len(buf))
+	copy(copied, buf)
+	return c.UnmarshalRequest(copied)
+}
+
+func (q *Queue) leaseRequest(c *colly.Collector, as AckStorage, leases map[*colly.Request]uint64) (*colly.Request, error) {
+	id, buf, err := as.LeaseRequest()
+	if err != nil {
+		return nil, err
+	}
+	if buf == nil {
+		return nil, errEmptyQueue
+	}
+	copied := make([]byte, len(buf))
+	copy(copied, buf)
+	req, err := c.UnmarshalRequest(copied)
+	if err != nil {
+		// the request will never be processed, drop its lease
+		as.Ack(id)
+		return nil, err
+	}
+	leases[req] = id
+	return req, nil
+}
+
 // Init implements Storage.Init() function
 func (q *InMemoryQueueStorage) Init() error {
 	q.lock = &sync.RWMutex{}
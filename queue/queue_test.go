@@ -1,9 +1,16 @@
 package queue
 
 import (
+	"encoding/json"
+	"fmt"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -75,6 +82,341 @@ func TestQueue(t *testing.T) {
 	}
 }
 
+func TestPriorityQueue(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(serverHandler))
+	defer server.Close()
+
+	storage := &PriorityQueueStorage{MaxSize: 5}
+	q, err := New(1, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := colly.NewCollector(colly.AllowURLRevisit())
+	for i, p := range []int{0, 2, 1, 2, 0} {
+		u, _ := url.Parse(fmt.Sprintf("%s/delay?t=0s&n=%d", server.URL, i))
+		if err := q.AddRequest(&colly.Request{URL: u, Method: "GET", Priority: p}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.AddURL(server.URL + "/delay?t=0s"); err != colly.ErrQueueFull {
+		t.Fatalf("MaxSize not enforced, got %v", err)
+	}
+
+	var order, priorities []string
+	c.OnRequest(func(r *colly.Request) {
+		order = append(order, r.URL.Query().Get("n"))
+		child, err := r.New("GET", r.AbsoluteURL("/"), nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if child.Priority != r.Priority {
+			t.Errorf("New dropped priority: got %d want %d", child.Priority, r.Priority)
+		}
+	})
+	c.OnResponse(func(r *colly.Response) {
+		priorities = append(priorities, strconv.Itoa(r.Request.Priority))
+	})
+	if err := q.Run(c); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(order, ","); got != "1,3,2,0,4" {
+		t.Errorf("wrong processing order: %s", got)
+	}
+	if got := strings.Join(priorities, ","); got != "2,2,1,0,0" {
+		t.Errorf("wrong request priorities: %s", got)
+	}
+}
+
+func TestHostQueueStorageRoundRobin(t *testing.T) {
+	storage := &HostQueueStorage{}
+	if err := storage.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []string{"http://a/1", "http://a/2", "http://a/3", "http://b/1", "http://c/1", "http://b/2"} {
+		r, _ := json.Marshal(map[string]string{"URL": u})
+		storage.AddRequest(r)
+	}
+	next := func(available func(string) bool) string {
+		r, _ := storage.GetHostRequest(available)
+		if r == nil {
+			return ""
+		}
+		var sr struct{ URL string }
+		json.Unmarshal(r, &sr)
+		return sr.URL
+	}
+	all := func(string) bool { return true }
+	notA := func(host string) bool { return host != "a" }
+	var order []string
+	order = append(order, next(all), next(all), next(notA), next(notA), next(notA), next(all), next(all))
+	want := "http://a/1,http://b/1,http://c/1,http://b/2,,http://a/2,http://a/3"
+	if got := strings.Join(order, ","); got != want {
+		t.Errorf("wrong order:\n got %s\nwant %s", got, want)
+	}
+	if size, _ := storage.QueueSize(); size != 0 {
+		t.Errorf("queue should be empty, got %d", size)
+	}
+}
+
+func TestHostQueueStorageHostKey(t *testing.T) {
+	storage := &HostQueueStorage{}
+	if err := storage.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []string{"http://Example.COM/1", "http://example.com:80/2", "http://example.com/3"} {
+		r, _ := json.Marshal(map[string]string{"URL": u})
+		storage.AddRequest(r)
+	}
+	var hosts []string
+	storage.GetHostRequest(func(host string) bool {
+		hosts = append(hosts, host)
+		return false
+	})
+	if got := strings.Join(hosts, ","); got != "example.com" {
+		t.Errorf("requests should be partitioned by the normalized host, got %q", got)
+	}
+}
+
+func TestHostQueueFairness(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+
+	c := colly.NewCollector(colly.AllowURLRevisit())
+	slowURL, _ := url.Parse(slow.URL)
+	c.Limit(&colly.LimitRule{DomainGlob: slowURL.Host, Parallelism: 1})
+
+	q, err := New(4, &HostQueueStorage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		q.AddURL(fmt.Sprintf("%s/%d", slow.URL, i))
+	}
+	for i := 0; i < 4; i++ {
+		q.AddURL(fmt.Sprintf("%s/%d", fast.URL, i))
+	}
+
+	var lock sync.Mutex
+	var order []string
+	c.OnResponse(func(r *colly.Response) {
+		lock.Lock()
+		order = append(order, r.Request.URL.Host)
+		lock.Unlock()
+	})
+	if err := q.Run(c); err != nil {
+		t.Fatal(err)
+	}
+	if len(order) != 8 {
+		t.Fatalf("wrong number of responses: %d", len(order))
+	}
+	// the fast host is served while the slow one holds its only slot
+	lastFast := 0
+	for i, host := range order {
+		if host != slowURL.Host {
+			lastFast = i
+		}
+	}
+	slowBefore := 0
+	for _, host := range order[:lastFast] {
+		if host == slowURL.Host {
+			slowBefore++
+		}
+	}
+	if slowBefore > 1 {
+		t.Errorf("requests of the fast host waited for the saturated host: %v", order)
+	}
+}
+
+func TestFileQueueStorageRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.journal")
+	storage := &FileQueueStorage{Path: path, CompactMinRecords: 2}
+	if err := storage.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []string{"a", "b", "c", "d"} {
+		if err := storage.AddRequest([]byte(r)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	id, r, _ := storage.LeaseRequest()
+	if string(r) != "a" {
+		t.Fatalf("wrong leased request: %q", r)
+	}
+	storage.Ack(id)
+	r, _ = storage.GetRequest()
+	if string(r) != "b" {
+		t.Fatalf("wrong request: %q", r)
+	}
+	// compaction is triggered by the second ack
+	if _, r, _ = storage.LeaseRequest(); string(r) != "c" {
+		t.Fatalf("wrong leased request: %q", r)
+	}
+	if size, _ := storage.QueueSize(); size != 1 {
+		t.Errorf("leased requests should not be counted, got size %d", size)
+	}
+	// simulate a crash with "c" in flight
+	storage.Close()
+
+	storage = &FileQueueStorage{Path: path}
+	if err := storage.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if size, _ := storage.QueueSize(); size != 2 {
+		t.Fatalf("wrong queue size after recovery: %d", size)
+	}
+	for _, want := range []string{"c", "d"} {
+		if r, _ := storage.GetRequest(); string(r) != want {
+			t.Errorf("wrong request after recovery: got %q, want %q", r, want)
+		}
+	}
+}
+
+func TestFileQueueStorageCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.journal")
+	storage := &FileQueueStorage{Path: path}
+	if err := storage.Init(); err != nil {
+		t.Fatal(err)
+	}
+	storage.AddRequest([]byte("a"))
+	storage.AddRequest([]byte("b"))
+	storage.GetRequest()
+	storage.AddRequest([]byte("c"))
+	storage.Close()
+
+	data, _ := os.ReadFile(path)
+	// flip the data byte of the add record of "b"
+	record := journalHeaderSize + journalOpSize + 1
+	data[len(journalMagic)+record+journalHeaderSize+journalOpSize] ^= 0xff
+	if err := os.WriteFile(path, data, 0640); err != nil {
+		t.Fatal(err)
+	}
+	storage = &FileQueueStorage{Path: path}
+	if err := storage.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := storage.QueueSize(); size != 1 {
+		t.Errorf("wrong queue size after a corrupted record: %d", size)
+	}
+	if r, _ := storage.GetRequest(); string(r) != "c" {
+		t.Errorf("records after the corrupted one should be kept, got %q", r)
+	}
+	storage.Close()
+
+	// a corrupted length can't be skipped
+	data, _ = os.ReadFile(path)
+	data[len(journalMagic)] = 0xff
+	if err := os.WriteFile(path, data, 0640); err != nil {
+		t.Fatal(err)
+	}
+	storage = &FileQueueStorage{Path: path}
+	if err := storage.Init(); err != ErrCorruptJournal {
+		t.Errorf("expected ErrCorruptJournal, got %v", err)
+	}
+}
+
+func TestFileQueue(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(serverHandler))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "queue.journal")
+	storage := &FileQueueStorage{Path: path}
+	q, err := New(4, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		q.AddURL(fmt.Sprintf("%s/delay?t=0s&n=%d", server.URL, i))
+	}
+	var requests uint32
+	c := colly.NewCollector()
+	c.OnResponse(func(r *colly.Response) {
+		atomic.AddUint32(&requests, 1)
+	})
+	if err := q.Run(c); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 20 {
+		t.Errorf("wrong number of requests: %d", requests)
+	}
+	storage.Close()
+
+	storage = &FileQueueStorage{Path: path}
+	if err := storage.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if size, _ := storage.QueueSize(); size != 0 || len(storage.leased) != 0 {
+		t.Errorf("processed requests should be acknowledged, got size %d", size)
+	}
+}
+
+func TestFileQueueStop(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(serverHandler))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "queue.journal")
+	storage := &FileQueueStorage{Path: path}
+	q, err := New(2, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.AddURL(server.URL + "/delay?t=0s&n=0")
+	for i := 1; i < 5; i++ {
+		q.AddURL(fmt.Sprintf("%s/delay?t=50ms&n=%d", server.URL, i))
+	}
+	var lock sync.Mutex
+	processed := make(map[string]bool)
+	c := colly.NewCollector()
+	c.OnResponse(func(r *colly.Response) {
+		n := r.Request.URL.Query().Get("n")
+		lock.Lock()
+		processed[n] = true
+		lock.Unlock()
+		if n == "0" {
+			q.Stop()
+		}
+	})
+	if err := q.Run(c); err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	done := len(processed)
+	lock.Unlock()
+	// the request in progress when the queue stopped is completed
+	if done < 2 || done == 5 {
+		t.Fatalf("unexpected number of processed requests: %d", done)
+	}
+	storage.Close()
+
+	storage = &FileQueueStorage{Path: path}
+	if err := storage.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if size, _ := storage.QueueSize(); size != 5-done {
+		t.Errorf("expected %d requests after stop, got %d", 5-done, size)
+	}
+	for {
+		r, _ := storage.GetRequest()
+		if r == nil {
+			break
+		}
+		req, err := c.UnmarshalRequest(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if processed[req.URL.Query().Get("n")] {
+			t.Errorf("processed request returned to the queue: %s", req.URL)
+		}
+	}
+}
+
 func serverHandler(w http.ResponseWriter, req *http.Request) {
 	if !serverRoute(w, req) {
 		shutdown(w)
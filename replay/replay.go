@@ -0,0 +1,266 @@
+// Copyright 2018 Adam Tauber
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package replay implements an http.RoundTripper which records HTTP
+// exchanges to fixture files and replays them, so collectors can be
+// tested offline and deterministically.
+//
+// Record the fixtures once with a real site:
+//
+//	c.WithTransport(&replay.Transport{Dir: "testdata/fixtures", Mode: replay.Record})
+//
+// and replay them in tests:
+//
+//	c.WithTransport(&replay.Transport{Dir: "testdata/fixtures"})
+package replay
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gocolly/colly/v2/internal/reqbody"
+)
+
+// Mode is the operation mode of a Transport
+type Mode int
+
+const (
+	// Replay serves the recorded exchanges and fails on unrecorded requests
+	Replay Mode = iota
+	// Record sends the requests and records the exchanges, overwriting
+	// the previous recordings
+	Record
+	// ReplayOrRecord serves the recorded exchanges and records the
+	// unrecorded ones
+	ReplayOrRecord
+)
+
+// ErrNotRecorded is returned in Replay mode for requests without recording
+var ErrNotRecorded = errors.New("replay: request not recorded")
+
+// DefaultRedactHeaders are the headers redacted by a Transport without
+// RedactHeaders, so credentials don't end up in committed fixtures.
+// Set-Cookie isn't redacted by default, so the replayed responses set
+// their cookies.
+var DefaultRedactHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+
+// redacted replaces the values of redacted headers in the fixtures
+const redacted = "REDACTED"
+
+// Transport is an http.RoundTripper which records and replays HTTP
+// exchanges. Every exchange is stored in a JSON file in Dir. Redirects are
+// recorded as separate exchanges, because the client follows them with
+// new requests.
+//
+// Exchanges are matched by method, URL, request body and the headers
+// listed in MatchHeaders.
+type Transport struct {
+	// Dir is the fixture directory
+	Dir string
+	// Mode is the operation mode of the transport. Defaults to Replay.
+	Mode Mode
+	// Transport sends the requests in Record mode.
+	// Defaults to http.DefaultTransport.
+	Transport http.RoundTripper
+	// MatchHeaders are the request headers which distinguish exchanges
+	MatchHeaders []string
+	// RedactHeaders are the request and response headers whose values are
+	// replaced by "REDACTED" in the fixtures. DefaultRedactHeaders are used
+	// if it is nil, set it to an empty slice to record every header.
+	// Add Set-Cookie to redact session cookies, note that redacted
+	// Set-Cookie headers aren't replayed as cookies.
+	RedactHeaders []string
+}
+
+// exchange is the fixture file format
+type exchange struct {
+	Request  recordedRequest  `json:"request"`
+	Response recordedResponse `json:"response"`
+}
+
+type recordedRequest struct {
+	Method  string      `json:"method"`
+	URL     string      `json:"url"`
+	Headers http.Header `json:"headers,omitempty"`
+	Body    body        `json:"body"`
+}
+
+type recordedResponse struct {
+	StatusCode   int         `json:"status_code"`
+	Headers      http.Header `json:"headers,omitempty"`
+	Body         body        `json:"body"`
+	Uncompressed bool        `json:"uncompressed,omitempty"`
+}
+
+// body is stored as a string if it is valid UTF-8, base64 encoded otherwise
+type body struct {
+	Text   string `json:"text,omitempty"`
+	Base64 string `json:"base64,omitempty"`
+}
+
+func newBody(b []byte) body {
+	if utf8.Valid(b) {
+		return body{Text: string(b)}
+	}
+	return body{Base64: base64.StdEncoding.EncodeToString(b)}
+}
+
+func (b body) bytes() ([]byte, error) {
+	if b.Base64 != "" {
+		return base64.StdEncoding.DecodeString(b.Base64)
+	}
+	return []byte(b.Text), nil
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqBody, err := reqbody.Read(req)
+	if err != nil {
+		return nil, err
+	}
+	filename := t.filename(req, reqBody)
+	if t.Mode != Record {
+		res, err := t.replay(req, filename)
+		if err == nil || t.Mode == Replay || !errors.Is(err, ErrNotRecorded) {
+			return res, err
+		}
+	}
+	return t.record(req, reqBody, filename)
+}
+
+func (t *Transport) replay(req *http.Request, filename string) (*http.Response, error) {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s %s", ErrNotRecorded, req.Method, req.URL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	e := &exchange{}
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, fmt.Errorf("replay: invalid fixture %s: %w", filename, err)
+	}
+	b, err := e.Response.Body.bytes()
+	if err != nil {
+		return nil, err
+	}
+	header := e.Response.Headers
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.Response.StatusCode, http.StatusText(e.Response.StatusCode)),
+		StatusCode:    e.Response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(b)),
+		ContentLength: int64(len(b)),
+		Uncompressed:  e.Response.Uncompressed,
+		Request:       req,
+	}, nil
+}
+
+func (t *Transport) record(req *http.Request, reqBody []byte, filename string) (*http.Response, error) {
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	out := req.Clone(req.Context())
+	if req.Body != nil {
+		out.Body = io.NopCloser(bytes.NewReader(reqBody))
+	}
+	res, err := transport.RoundTrip(out)
+	if err != nil {
+		return nil, err
+	}
+	resBody, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(resBody))
+	res.Request = req
+
+	e := &exchange{
+		Request: recordedRequest{
+			Method:  req.Method,
+			URL:     req.URL.String(),
+			Headers: t.redact(req.Header),
+			Body:    newBody(reqBody),
+		},
+		Response: recordedResponse{
+			StatusCode:   res.StatusCode,
+			Headers:      t.redact(res.Header),
+			Body:         newBody(resBody),
+			Uncompressed: res.Uncompressed,
+		},
+	}
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(t.Dir, 0750); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// redact returns a copy of header without the values of RedactHeaders
+func (t *Transport) redact(header http.Header) http.Header {
+	names := t.RedactHeaders
+	if names == nil {
+		names = DefaultRedactHeaders
+	}
+	header = header.Clone()
+	for _, name := range names {
+		values := header.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+		for i := range values {
+			values[i] = redacted
+		}
+		header[http.CanonicalHeaderKey(name)] = values
+	}
+	return header
+}
+
+// filename returns the fixture file of the exchange of req
+func (t *Transport) filename(req *http.Request, reqBody []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s %s\n", req.Method, req.URL.String())
+	for _, name := range t.MatchHeaders {
+		fmt.Fprintf(h, "%s: %s\n", http.CanonicalHeaderKey(name), strings.Join(req.Header.Values(name), ", "))
+	}
+	h.Write(reqBody)
+	host := strings.NewReplacer(":", "_", "/", "_").Replace(req.URL.Host)
+	return filepath.Join(t.Dir, host+"-"+hex.EncodeToString(h.Sum(nil))+".json")
+}
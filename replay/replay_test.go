@@ -0,0 +1,163 @@
+package replay
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gocolly/colly/v2"
+)
+
+func newTestServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><body><a href="/redirect">next</a></body></html>`))
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/target", http.StatusFound)
+	})
+	mux.HandleFunc("/target", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><body><p>target</p></body></html>`))
+	})
+	mux.HandleFunc("/post", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		w.Write([]byte("posted " + r.FormValue("name")))
+	})
+	mux.HandleFunc("/binary", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte{0xff, 0x00, 0xfe})
+	})
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret"})
+		w.Header().Set("X-Token", "token")
+		w.Write([]byte("ok"))
+	})
+	return httptest.NewServer(mux)
+}
+
+func crawl(t *testing.T, transport http.RoundTripper, u string) []string {
+	var results []string
+	c := colly.NewCollector()
+	c.WithTransport(transport)
+	c.OnHTML("a[href]", func(e *colly.HTMLElement) {
+		e.Request.Visit(e.Attr("href"))
+	})
+	c.OnHTML("p", func(e *colly.HTMLElement) {
+		results = append(results, e.Request.URL.Path+" "+e.Text)
+	})
+	c.OnResponse(func(r *colly.Response) {
+		if r.Request.URL.Path != "/" && r.Request.URL.Path != "/target" {
+			results = append(results, r.Request.URL.Path+" "+string(r.Body))
+		}
+	})
+	c.OnError(func(r *colly.Response, err error) {
+		t.Errorf("unexpected error: %v", err)
+	})
+	if err := c.Visit(u + "/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Post(u+"/post", map[string]string{"name": "colly"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Visit(u + "/binary"); err != nil {
+		t.Fatal(err)
+	}
+	return results
+}
+
+func TestRecordReplay(t *testing.T) {
+	ts := newTestServer()
+	dir := t.TempDir()
+	recorded := crawl(t, &Transport{Dir: dir, Mode: Record}, ts.URL)
+	ts.Close()
+
+	files, _ := os.ReadDir(dir)
+	// index, redirect, redirect target, post, binary
+	if len(files) != 5 {
+		t.Errorf("expected 5 fixtures, got %d", len(files))
+	}
+
+	replayed := crawl(t, &Transport{Dir: dir}, ts.URL)
+	if len(recorded) != 3 || len(replayed) != len(recorded) {
+		t.Fatalf("unexpected results: %q %q", recorded, replayed)
+	}
+	for i := range recorded {
+		if recorded[i] != replayed[i] {
+			t.Errorf("replayed %q, recorded %q", replayed[i], recorded[i])
+		}
+	}
+	if replayed[0] != "/target target" || replayed[1] != "/post posted colly" {
+		t.Errorf("unexpected results: %q", replayed)
+	}
+}
+
+func TestReplayNotRecorded(t *testing.T) {
+	c := colly.NewCollector()
+	c.WithTransport(&Transport{Dir: t.TempDir()})
+	var onErr error
+	c.OnError(func(r *colly.Response, err error) {
+		onErr = err
+	})
+	c.Visit("http://example.com/")
+	if !errors.Is(onErr, ErrNotRecorded) {
+		t.Errorf("expected ErrNotRecorded, got %v", onErr)
+	}
+}
+
+func TestReplayOrRecord(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+	dir := t.TempDir()
+	transport := &Transport{Dir: dir, Mode: ReplayOrRecord}
+	req, _ := http.NewRequest("GET", ts.URL+"/target", nil)
+	res, err := transport.RoundTrip(req)
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected response: %v", err)
+	}
+	ts.Close()
+	res, err = transport.RoundTrip(req)
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("recorded exchange not replayed: %v", err)
+	}
+}
+
+func TestRecordRedactHeaders(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	for _, tt := range []struct {
+		redactHeaders []string
+		secrets       []string
+		recorded      []string
+	}{
+		{nil, []string{"password"}, []string{"token", "secret"}},
+		{[]string{"Authorization", "Set-Cookie"}, []string{"password", "secret"}, []string{"token"}},
+		{[]string{"X-Token"}, []string{"token"}, []string{"secret", "password"}},
+	} {
+		dir := t.TempDir()
+		transport := &Transport{Dir: dir, Mode: Record, RedactHeaders: tt.redactHeaders}
+		req, _ := http.NewRequest("GET", ts.URL+"/login", nil)
+		req.Header.Set("Authorization", "Basic password")
+		if _, err := transport.RoundTrip(req); err != nil {
+			t.Fatal(err)
+		}
+		files, _ := os.ReadDir(dir)
+		if len(files) != 1 {
+			t.Fatalf("expected 1 fixture, got %d", len(files))
+		}
+		data, _ := os.ReadFile(filepath.Join(dir, files[0].Name()))
+		for _, secret := range tt.secrets {
+			if strings.Contains(string(data), secret) {
+				t.Errorf("%v: %q recorded", tt.redactHeaders, secret)
+			}
+		}
+		for _, v := range tt.recorded {
+			if !strings.Contains(string(data), v) {
+				t.Errorf("%v: %q not recorded", tt.redactHeaders, v)
+			}
+		}
+	}
+}
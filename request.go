@@ -43,6 +43,15 @@ type Request struct {
 	// Leave it blank to allow automatic character encoding of the response body.
 	// It is empty by default and it can be set in OnRequest callback.
 	ResponseCharacterEncoding string
+	// Priority is the scheduling priority of the request in queues
+	// supporting it, see queue.PriorityQueueStorage. Requests with higher
+	// priority are processed first. Requests created by Visit, Post,
+	// PostRaw, PostMultipart and New inherit the priority.
+	Priority int
+	// Attempt is the number of the current attempt of the request,
+	// starting from 1. It is increased by the automatic retries of
+	// Collector.RetryPolicy.
+	Attempt int
 	// ID is the Unique identifier of the request
 	ID        uint32
 	collector *Collector
@@ -53,14 +62,15 @@ type Request struct {
 }
 
 type serializableRequest struct {
-	URL     string
-	Method  string
-	Depth   int
-	Body    []byte
-	ID      uint32
-	Ctx     map[string]interface{}
-	Headers http.Header
-	Host    string
+	URL      string
+	Method   string
+	Depth    int
+	Body     []byte
+	ID       uint32
+	Ctx      map[string]interface{}
+	Headers  http.Header
+	Host     string
+	Priority int
 }
 
 // New creates a new request with the context of the original request
@@ -81,6 +91,7 @@ func (r *Request) New(method, URL string, body io.Reader) (*Request, error) {
 		Headers:   &http.Header{},
 		Host:      r.Host,
 		ID:        r.collector.requestCount.Add(1),
+		Priority:  r.Priority,
 		collector: r.collector,
 	}, nil
 }
@@ -120,7 +131,7 @@ func (r *Request) AbsoluteURL(u string) string {
 // request and preserves the Context of the previous request.
 // Visit also calls the previously provided callbacks
 func (r *Request) Visit(URL string) error {
-	return r.collector.scrape(r.AbsoluteURL(URL), "GET", r.Depth+1, nil, r.Ctx, nil, true)
+	return r.collector.scrape(r.AbsoluteURL(URL), "GET", r.Depth+1, r.Priority, nil, r.Ctx, nil, true)
 }
 
 // HasVisited checks if the provided URL has been visited
@@ -132,14 +143,14 @@ func (r *Request) HasVisited(URL string) (bool, error) {
 // of the previous request.
 // Post also calls the previously provided callbacks
 func (r *Request) Post(URL string, requestData map[string]string) error {
-	return r.collector.scrape(r.AbsoluteURL(URL), "POST", r.Depth+1, createFormReader(requestData), r.Ctx, nil, true)
+	return r.collector.scrape(r.AbsoluteURL(URL), "POST", r.Depth+1, r.Priority, createFormReader(requestData), r.Ctx, nil, true)
 }
 
 // PostRaw starts a collector job by creating a POST request with raw binary data.
 // PostRaw preserves the Context of the previous request
 // and calls the previously provided callbacks
 func (r *Request) PostRaw(URL string, requestData []byte) error {
-	return r.collector.scrape(r.AbsoluteURL(URL), "POST", r.Depth+1, bytes.NewReader(requestData), r.Ctx, nil, true)
+	return r.collector.scrape(r.AbsoluteURL(URL), "POST", r.Depth+1, r.Priority, bytes.NewReader(requestData), r.Ctx, nil, true)
 }
 
 // PostMultipart starts a collector job by creating a Multipart POST request
@@ -150,7 +161,7 @@ func (r *Request) PostMultipart(URL string, requestData map[string][]byte) error
 	hdr := http.Header{}
 	hdr.Set("Content-Type", "multipart/form-data; boundary="+boundary)
 	hdr.Set("User-Agent", r.collector.UserAgent)
-	return r.collector.scrape(r.AbsoluteURL(URL), "POST", r.Depth+1, createMultipartReader(boundary, requestData), r.Ctx, hdr, true)
+	return r.collector.scrape(r.AbsoluteURL(URL), "POST", r.Depth+1, r.Priority, createMultipartReader(boundary, requestData), r.Ctx, hdr, true)
 }
 
 // Retry submits HTTP request again with the same parameters
@@ -159,12 +170,12 @@ func (r *Request) Retry() error {
 	if _, ok := r.Body.(io.ReadSeeker); r.Body != nil && !ok {
 		return ErrRetryBodyUnseekable
 	}
-	return r.collector.scrape(r.URL.String(), r.Method, r.Depth, r.Body, r.Ctx, *r.Headers, false)
+	return r.collector.scrape(r.URL.String(), r.Method, r.Depth, r.Priority, r.Body, r.Ctx, *r.Headers, false)
 }
 
 // Do submits the request
 func (r *Request) Do() error {
-	return r.collector.scrape(r.URL.String(), r.Method, r.Depth, r.Body, r.Ctx, *r.Headers, !r.collector.AllowURLRevisit)
+	return r.collector.scrape(r.URL.String(), r.Method, r.Depth, r.Priority, r.Body, r.Ctx, *r.Headers, !r.collector.AllowURLRevisit)
 }
 
 // Marshal serializes the Request
@@ -185,13 +196,14 @@ func (r *Request) Marshal() ([]byte, error) {
 		}
 	}
 	sr := &serializableRequest{
-		URL:    r.URL.String(),
-		Host:   r.Host,
-		Method: r.Method,
-		Depth:  r.Depth,
-		Body:   body,
-		ID:     r.ID,
-		Ctx:    ctx,
+		URL:      r.URL.String(),
+		Host:     r.Host,
+		Method:   r.Method,
+		Depth:    r.Depth,
+		Body:     body,
+		ID:       r.ID,
+		Ctx:      ctx,
+		Priority: r.Priority,
 	}
 	if r.Headers != nil {
 		sr.Headers = *r.Headers
@@ -42,6 +42,8 @@ type Response struct {
 	// Trace contains the HTTPTrace for the request. Will only be set by the
 	// collector if Collector.TraceHTTP is set to true.
 	Trace *HTTPTrace
+	// Truncated is true if the body was cut at Collector.MaxBodySize
+	Truncated bool
 }
 
 // Save writes response body to disk
@@ -0,0 +1,211 @@
+// Copyright 2018 Adam Tauber
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package colly
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultRetryStatusCodes are the response status codes retried by a
+// RetryPolicy without StatusCodes
+var DefaultRetryStatusCodes = []int{
+	http.StatusTooManyRequests,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+const defaultRetryBaseDelay = time.Second
+
+// RetryPolicy configures the automatic retry of failed requests.
+// Retries happen inside the collector before the response is
+// processed, so OnResponse, OnHTML, OnXML and OnError callbacks
+// only see the final attempt. Request.Attempt contains the number
+// of the current attempt.
+//
+// The delay before the nth retry is BaseDelay * 2^(n-1), limited by
+// MaxDelay. If the response has a Retry-After header requesting a
+// longer delay, the header is honored.
+//
+// Responses with retryable status codes are neither stored in nor
+// served from the cache, so every attempt reaches the server.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts of a request
+	// including the first one
+	MaxAttempts int
+	// StatusCodes are the response status codes which are retried.
+	// DefaultRetryStatusCodes are used if it is nil.
+	StatusCodes []int
+	// RetryError decides if a failed request has to be retried. By
+	// default timeouts and connection errors are retried.
+	RetryError func(error) bool
+	// BaseDelay is the delay before the first retry. Defaults to 1 second.
+	BaseDelay time.Duration
+	// MaxDelay limits the delay between attempts, including the delay
+	// requested by Retry-After. 0 means no limit.
+	MaxDelay time.Duration
+	// Jitter is the randomized fraction of the delay, between 0 and 1.
+	// E.g. with 0.5 the delay is randomly reduced by up to 50%, which
+	// prevents requests failing together from being retried together.
+	Jitter float64
+	// IgnoreRetryAfter disables honoring the Retry-After response header
+	IgnoreRetryAfter bool
+}
+
+// Retry sets the policy of the automatic retries of failed requests.
+func Retry(policy *RetryPolicy) CollectorOption {
+	return func(c *Collector) {
+		c.RetryPolicy = policy
+	}
+}
+
+// retry returns true and the delay before the next attempt if the
+// result of the given attempt has to be retried
+func (p *RetryPolicy) retry(attempt int, resp *Response, err error) (time.Duration, bool) {
+	if attempt >= p.MaxAttempts || !p.retryable(resp, err) {
+		return 0, false
+	}
+	base := p.BaseDelay
+	if base <= 0 {
+		base = defaultRetryBaseDelay
+	}
+	delay := base
+	for i := 1; i < attempt && (p.MaxDelay <= 0 || delay < p.MaxDelay) && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		delay -= time.Duration(rand.Float64() * min(p.Jitter, 1) * float64(delay))
+	}
+	if !p.IgnoreRetryAfter && resp != nil && resp.Headers != nil {
+		if d, ok := parseRetryAfter(resp.Headers.Get("Retry-After")); ok && d > delay {
+			delay = d
+			if p.MaxDelay > 0 && delay > p.MaxDelay {
+				delay = p.MaxDelay
+			}
+		}
+	}
+	return delay, true
+}
+
+func (p *RetryPolicy) retryable(resp *Response, err error) bool {
+	if err != nil {
+		if errors.Is(err, ErrAbortedBeforeRequest) || errors.Is(err, ErrAbortedAfterHeaders) ||
+			errors.Is(err, context.Canceled) {
+			return false
+		}
+		if p.RetryError != nil {
+			return p.RetryError(err)
+		}
+		return IsRetryableError(err)
+	}
+	if resp == nil {
+		return false
+	}
+	codes := p.StatusCodes
+	if codes == nil {
+		codes = DefaultRetryStatusCodes
+	}
+	return slices.Contains(codes, resp.StatusCode)
+}
+
+// temporaryFailure returns true if resp reports a temporary failure or
+// if it is retryable, so it must not be stored by the caches
+func temporaryFailure(resp *Response, retryable func(*Response) bool) bool {
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusRequestTimeout, http.StatusServiceUnavailable:
+		if resp.Headers != nil && resp.Headers.Get("Retry-After") != "" {
+			return true
+		}
+	}
+	return retryable != nil && retryable(resp)
+}
+
+// IsRetryableError returns true for timeouts and connection errors,
+// which are worth retrying
+func IsRetryableError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
+
+// parseRetryAfter parses the value of a Retry-After header,
+// which is either a number of seconds or an HTTP date
+func parseRetryAfter(v string) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if s, err := strconv.Atoi(v); err == nil {
+		if s < 0 {
+			return 0, false
+		}
+		return time.Duration(s) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	return max(time.Until(t), 0), true
+}
+
+// rewindRequest returns a copy of req which can be sent again
+func rewindRequest(req *http.Request) (*http.Request, bool) {
+	r := req.Clone(req.Context())
+	if req.Body == nil || req.Body == http.NoBody {
+		return r, true
+	}
+	if req.GetBody == nil {
+		return nil, false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, false
+	}
+	r.Body = body
+	return r, true
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
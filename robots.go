@@ -0,0 +1,434 @@
+// Copyright 2018 Adam Tauber
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package colly
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/temoto/robotstxt"
+
+	"github.com/gocolly/colly/v2/cache"
+	"github.com/gocolly/colly/v2/storage"
+)
+
+const (
+	// defaultRobotsTTL is the default of Collector.RobotsTTL
+	defaultRobotsTTL = 24 * time.Hour
+	// robotsUnavailableTTL is the time after which the robots.txt file
+	// of a host is fetched again if it was unavailable
+	robotsUnavailableTTL = time.Minute
+	// robotsMaxSize is the parsed size of robots.txt files (RFC 9309 2.5)
+	robotsMaxSize = 500 << 10
+)
+
+// robotsEntry is a cached robots.txt file of a host
+type robotsEntry struct {
+	robot *robotstxt.RobotsData
+	// err is the error of an unavailable robots.txt file. Hosts with
+	// unavailable robots.txt are disallowed until the file is fetched
+	// again successfully.
+	err     error
+	expires time.Time
+	// done is closed when the robots.txt file is fetched
+	done chan struct{}
+}
+
+// checkRobots returns ErrRobotsTxtBlocked if the robots.txt file of the
+// host of u disallows u. robots.txt files are fetched through the backend
+// like other requests, so LimitRules, the response cache, OnRequest
+// callbacks and the debugger apply. The files are cached for RobotsTTL
+// and persisted by storages implementing storage.RobotsStorage.
+//
+// Like RFC 9309 specifies, hosts are allowed if their robots.txt file
+// doesn't exist (4xx), and they are disallowed temporarily if the file is
+// unavailable (5xx or network error). If a previously fetched file is
+// unavailable, it is used until the host recovers.
+func (c *Collector) checkRobots(u *url.URL) error {
+	entry := c.robotsEntry(u)
+	if entry.robot == nil {
+		return fmt.Errorf("%w: robots.txt unavailable: %v", ErrRobotsTxtBlocked, entry.err)
+	}
+	uaGroup := entry.robot.FindGroup(c.robotsUserAgent())
+	if uaGroup == nil {
+		return nil
+	}
+
+	eu := u.EscapedPath()
+	if u.RawQuery != "" {
+		eu += "?" + u.Query().Encode()
+	}
+	if !uaGroup.Test(eu) {
+		return ErrRobotsTxtBlocked
+	}
+	return nil
+}
+
+// RobotsSitemaps returns the sitemaps listed in the robots.txt file of
+// the host of siteURL. The robots.txt file is fetched and cached like by
+// robots.txt checks, even if IgnoreRobotsTxt is set.
+func (c *Collector) RobotsSitemaps(siteURL string) ([]string, error) {
+	u, err := url.Parse(siteURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, ErrMissingURL
+	}
+	entry := c.robotsEntry(u)
+	if entry.robot == nil {
+		return nil, entry.err
+	}
+	return slices.Clone(entry.robot.Sitemaps), nil
+}
+
+// robotsEntry returns the cached robots.txt file of the host of u or
+// fetches it. Concurrent requests to a host wait for a single fetch.
+func (c *Collector) robotsEntry(u *url.URL) *robotsEntry {
+	c.lock.Lock()
+	entry := c.robotsMap[u.Host]
+	if entry != nil {
+		select {
+		case <-entry.done:
+			if time.Now().Before(entry.expires) {
+				c.lock.Unlock()
+				return entry
+			}
+		default:
+			c.lock.Unlock()
+			<-entry.done
+			return entry
+		}
+	}
+	prev := entry
+	entry = &robotsEntry{done: make(chan struct{})}
+	c.robotsMap[u.Host] = entry
+	c.lock.Unlock()
+
+	if prev != nil || !c.loadRobots(u.Host, entry) {
+		c.fetchRobots(u, entry, prev)
+	}
+	close(entry.done)
+	return entry
+}
+
+// robotsUserAgent returns the product token of the robots.txt groups
+func (c *Collector) robotsUserAgent() string {
+	if c.RobotsUserAgent != "" {
+		return c.RobotsUserAgent
+	}
+	return c.UserAgent
+}
+
+func (c *Collector) robotsTTL() time.Duration {
+	if c.RobotsTTL <= 0 {
+		return defaultRobotsTTL
+	}
+	return c.RobotsTTL
+}
+
+// loadRobots loads the robots.txt file of host from the storage into
+// entry. It returns false if the storage has no unexpired file.
+func (c *Collector) loadRobots(host string, entry *robotsEntry) bool {
+	rs, ok := c.store.(storage.RobotsStorage)
+	if !ok {
+		return false
+	}
+	r, err := rs.Robots(host)
+	if err != nil || r == nil || time.Since(r.Fetched) >= c.robotsTTL() {
+		return false
+	}
+	return c.parseRobots(host, r.StatusCode, r.Body, r.Fetched, entry) == nil
+}
+
+// parseRobots parses a robots.txt response into entry. Non 2xx responses
+// allow everything and drop the crawl delay of host.
+func (c *Collector) parseRobots(host string, statusCode int, body []byte, fetched time.Time, entry *robotsEntry) error {
+	if statusCode >= 200 && statusCode < 300 {
+		robot, err := robotstxt.FromBytes(body)
+		if err != nil {
+			return err
+		}
+		entry.robot = robot
+		if c.HonorCrawlDelay {
+			c.backend.crawlDelays.set(host, robotsDelay(robot, body, c.robotsUserAgent()))
+		}
+	} else {
+		entry.robot, _ = robotstxt.FromStatusAndBytes(http.StatusNotFound, nil)
+		if c.HonorCrawlDelay {
+			c.backend.crawlDelays.set(host, 0)
+		}
+	}
+	entry.expires = fetched.Add(c.robotsTTL())
+	return nil
+}
+
+// fetchRobots fetches the robots.txt file of the host of u into entry
+func (c *Collector) fetchRobots(u *url.URL, entry, prev *robotsEntry) {
+	robotsURL := &url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/robots.txt"}
+	req, err := http.NewRequestWithContext(c.Context, "GET", robotsURL.String(), nil)
+	if err != nil {
+		entry.err, entry.expires = err, time.Now()
+		return
+	}
+	if c.Headers != nil {
+		req.Header = c.Headers.Clone()
+	}
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	// The Go HTTP API ignores "Host" in the headers, preferring the client
+	// to use the Host field on Request.
+	if hostHeader := req.Header.Get("Host"); hostHeader != "" {
+		req.Host = hostHeader
+	}
+	request := &Request{
+		URL:       req.URL,
+		Headers:   &req.Header,
+		Host:      req.Host,
+		Ctx:       NewContext(),
+		Method:    "GET",
+		collector: c,
+		ID:        c.requestCount.Add(1),
+		Attempt:   1,
+	}
+	// OnRequest callbacks aren't called, a callback visiting the host
+	// would wait for this fetch forever
+	if c.debugger != nil {
+		c.debugger.Event(createEvent("request", request.ID, c.ID, map[string]string{
+			"url": request.URL.String(),
+		}))
+	}
+
+	store := c.cache
+	if store == nil && c.CacheDir != "" {
+		store = &cache.DirCache{Path: c.CacheDir}
+	}
+	acceptHeaders := func(*http.Request) bool { return true }
+	acceptResponse := func(*http.Request, int, http.Header) bool { return true }
+	var resp *Response
+	if c.HTTPCache {
+		resp, err = c.backend.HTTPCache(req, robotsMaxSize, acceptHeaders, acceptResponse, store, nil)
+	} else {
+		resp, err = c.backend.Cache(req, robotsMaxSize, acceptHeaders, acceptResponse, store, c.robotsTTL(), nil)
+	}
+	if proxyURL, ok := req.Context().Value(ProxyURLKey).(string); ok {
+		request.ProxyURL = proxyURL
+	}
+
+	statusCode := 0
+	if resp != nil {
+		statusCode = resp.StatusCode
+	}
+	if err == nil && statusCode >= 500 {
+		err = fmt.Errorf("%d %s", statusCode, http.StatusText(statusCode))
+	}
+	if err == nil {
+		// 3xx responses are the result of too many redirects, which
+		// makes robots.txt unavailable (RFC 9309 2.3.1.3) like 4xx
+		fetched := time.Now()
+		err = c.parseRobots(u.Host, statusCode, resp.Body, fetched, entry)
+		if rs, ok := c.store.(storage.RobotsStorage); ok && err == nil {
+			rs.SetRobots(&storage.Robots{
+				Host:       u.Host,
+				StatusCode: statusCode,
+				Body:       resp.Body,
+				Fetched:    fetched,
+			})
+		}
+	}
+	if err != nil {
+		// unreachable robots.txt (RFC 9309 2.3.1.4)
+		entry.err = err
+		entry.expires = time.Now().Add(robotsUnavailableTTL)
+		if prev != nil && prev.robot != nil {
+			entry.robot = prev.robot
+		}
+	}
+	c.handleOnRobots(request, statusCode, entry)
+}
+
+func (c *Collector) handleOnRobots(r *Request, statusCode int, entry *robotsEntry) {
+	if c.debugger == nil {
+		return
+	}
+	values := map[string]string{
+		"url":    r.URL.String(),
+		"status": http.StatusText(statusCode),
+	}
+	if r.ProxyURL != "" {
+		values["proxy"] = r.ProxyURL
+	}
+	if entry.err != nil {
+		values["error"] = entry.err.Error()
+	}
+	c.debugger.Event(createEvent("robots", r.ID, c.ID, values))
+}
+
+// maxCrawlDelay limits the delays of robots.txt files, so a single host
+// can't stall a crawl
+const maxCrawlDelay = time.Minute
+
+// robotsDelay returns the delay between the requests of userAgent to a
+// host, which is the stricter of the Crawl-delay and the Request-rate of
+// the matching group of its robots.txt file
+func robotsDelay(robot *robotstxt.RobotsData, body []byte, userAgent string) time.Duration {
+	var delay time.Duration
+	if group := robot.FindGroup(userAgent); group != nil {
+		delay = group.CrawlDelay
+	}
+	delay = max(delay, requestRateDelay(body, userAgent))
+	return min(delay, maxCrawlDelay)
+}
+
+// requestRateDelay parses the Request-rate directive of the group of
+// userAgent in a robots.txt file and returns the delay between two
+// requests. Groups are matched like in robotstxt.FindGroup. The time of
+// day ranges of the directive are ignored.
+func requestRateDelay(body []byte, userAgent string) time.Duration {
+	userAgent = strings.ToLower(userAgent)
+	var agents []string
+	inAgents := false
+	matchLen := 0
+	var delay time.Duration
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		if key == "user-agent" {
+			if !inAgents {
+				agents = agents[:0]
+			}
+			agents = append(agents, strings.ToLower(value))
+			inAgents = true
+			continue
+		}
+		inAgents = false
+		if key != "request-rate" && key != "requestrate" {
+			continue
+		}
+		d, ok := parseRequestRate(value)
+		if !ok {
+			continue
+		}
+		l := 0
+		for _, a := range agents {
+			if a == "*" {
+				l = max(l, 1)
+			} else if strings.HasPrefix(userAgent, a) {
+				l = max(l, len(a))
+			}
+		}
+		switch {
+		case l > matchLen:
+			matchLen, delay = l, d
+		case l > 0 && l == matchLen:
+			delay = max(delay, d)
+		}
+	}
+	return delay
+}
+
+// parseRequestRate parses a request rate like "1/5" or "10/1m" and
+// returns the delay between two requests
+func parseRequestRate(v string) (time.Duration, bool) {
+	v, _, _ = strings.Cut(v, " ")
+	requests, window, ok := strings.Cut(v, "/")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(requests)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	unit := time.Second
+	switch {
+	case strings.HasSuffix(window, "s"):
+		window = strings.TrimSuffix(window, "s")
+	case strings.HasSuffix(window, "m"):
+		window, unit = strings.TrimSuffix(window, "m"), time.Minute
+	case strings.HasSuffix(window, "h"):
+		window, unit = strings.TrimSuffix(window, "h"), time.Hour
+	}
+	w, err := strconv.ParseFloat(window, 64)
+	if err != nil || w <= 0 {
+		return 0, false
+	}
+	return time.Duration(w * float64(unit) / float64(n)), true
+}
+
+// crawlDelays spaces the requests to hosts by the delays of their
+// robots.txt files
+type crawlDelays struct {
+	lock   sync.Mutex
+	delays map[string]time.Duration
+	// next is the earliest time of the next request to a host
+	next map[string]time.Time
+}
+
+func (d *crawlDelays) set(host string, delay time.Duration) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.delays == nil {
+		d.delays = make(map[string]time.Duration)
+		d.next = make(map[string]time.Time)
+	}
+	if delay <= 0 {
+		delete(d.delays, host)
+		delete(d.next, host)
+		return
+	}
+	d.delays[host] = delay
+}
+
+// reserve reserves the next request to host and returns the time to
+// wait before sending it and a function which gives the reservation
+// back if the request is not sent
+func (d *crawlDelays) reserve(host string) (time.Duration, func()) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delay, ok := d.delays[host]
+	if !ok {
+		return 0, func() {}
+	}
+	now := time.Now()
+	next := d.next[host]
+	if next.Before(now) {
+		next = now
+	}
+	end := next.Add(delay)
+	d.next[host] = end
+	return next.Sub(now), func() {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		// later reservations keep their time
+		if t, ok := d.next[host]; ok && t.Equal(end) {
+			d.next[host] = next
+		}
+	}
+}
@@ -0,0 +1,332 @@
+// Copyright 2018 Adam Tauber
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sitemap discovers and reads the sitemaps of sites.
+//
+//	s := sitemap.New(c)
+//	s.OnURL(func(u *sitemap.URL) {
+//		fmt.Println(u.Loc, u.LastMod)
+//	})
+//	s.Crawl("https://example.com/")
+//
+// Sitemaps are discovered from the Sitemap lines of robots.txt and
+// sitemap indexes are followed recursively. XML sitemaps (compressed or
+// not) and text sitemaps are supported.
+package sitemap
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"errors"
+	"io"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html/charset"
+
+	"github.com/gocolly/colly/v2"
+	"github.com/gocolly/colly/v2/queue"
+)
+
+// Context keys of the sitemap fields of enqueued requests
+const (
+	LastModKey    = "sitemap_lastmod"
+	ChangeFreqKey = "sitemap_changefreq"
+	PriorityKey   = "sitemap_priority"
+)
+
+// maxSitemapSize is the maximum uncompressed size of sitemaps
+// (sitemaps.org protocol)
+const maxSitemapSize = 50 << 20
+
+// ErrMaxDepth is returned if sitemap indexes are nested deeper than
+// Sitemaps.MaxDepth
+var ErrMaxDepth = errors.New("sitemap: max depth of sitemap indexes reached")
+
+// URL is an entry of a sitemap
+type URL struct {
+	// Loc is the URL of the page
+	Loc string
+	// LastMod is the last modification time of the page.
+	// It is zero if the sitemap doesn't specify it.
+	LastMod time.Time
+	// ChangeFreq is the expected change frequency of the page,
+	// e.g. "daily". It is empty if the sitemap doesn't specify it.
+	ChangeFreq string
+	// Priority is the priority of the page between 0 and 1.
+	// Defaults to 0.5.
+	Priority float64
+	// Sitemap is the URL of the sitemap of the entry
+	Sitemap string
+}
+
+// Sitemaps reads sitemaps with a collector
+type Sitemaps struct {
+	// Since skips the URLs and the sitemaps of indexes which weren't
+	// modified after Since, e.g. the time of the last crawl. Entries
+	// without last modification time are never skipped.
+	Since time.Time
+	// MaxDepth is the maximum depth of nested sitemap indexes.
+	// Defaults to 5.
+	MaxDepth int
+	// Queue enqueues the URLs, if it is set. The sitemap fields are stored
+	// in the context of the requests with the keys LastModKey,
+	// ChangeFreqKey and PriorityKey. The priority of the requests is the
+	// priority of the URLs scaled to 0-100, so queue.PriorityQueueStorage
+	// returns the more important pages first.
+	Queue     *queue.Queue
+	collector *colly.Collector
+	callbacks []func(*URL)
+}
+
+// New creates a Sitemaps which fetches the sitemaps with clones of c.
+// The clones share the backend of c, so its LimitRules, robots.txt
+// handling, caching and debugger apply.
+func New(c *colly.Collector) *Sitemaps {
+	return &Sitemaps{collector: c}
+}
+
+// OnURL registers a function which is called with every URL read from
+// the sitemaps which isn't skipped by Since
+func (s *Sitemaps) OnURL(f func(*URL)) {
+	s.callbacks = append(s.callbacks, f)
+}
+
+// Discover returns the sitemaps of the site of siteURL. They are read from
+// the robots.txt file of the site, or /sitemap.xml if it lists none.
+func (s *Sitemaps) Discover(siteURL string) ([]string, error) {
+	sitemaps, err := s.collector.RobotsSitemaps(siteURL)
+	if err != nil {
+		return nil, err
+	}
+	if len(sitemaps) > 0 {
+		return sitemaps, nil
+	}
+	u, err := url.Parse(siteURL)
+	if err != nil {
+		return nil, err
+	}
+	return []string{(&url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/sitemap.xml"}).String()}, nil
+}
+
+// Crawl reads all sitemaps of the site of siteURL. It returns the first
+// error of the sitemaps, but reads the others anyway.
+func (s *Sitemaps) Crawl(siteURL string) error {
+	sitemaps, err := s.Discover(siteURL)
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for _, sitemap := range sitemaps {
+		if rerr := s.read(sitemap, 0, seen); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// Read reads a sitemap or a sitemap index
+func (s *Sitemaps) Read(sitemapURL string) error {
+	return s.read(sitemapURL, 0, make(map[string]bool))
+}
+
+func (s *Sitemaps) read(sitemapURL string, depth int, seen map[string]bool) error {
+	if seen[sitemapURL] {
+		return nil
+	}
+	seen[sitemapURL] = true
+	maxDepth := s.MaxDepth
+	if maxDepth <= 0 {
+		maxDepth = 5
+	}
+	if depth > maxDepth {
+		return ErrMaxDepth
+	}
+	body, err := s.fetch(sitemapURL)
+	if err != nil {
+		return err
+	}
+	urls, sitemaps, err := parse(body)
+	if err != nil {
+		return err
+	}
+	for _, u := range urls {
+		u.Sitemap = sitemapURL
+		if !s.modified(u.LastMod) {
+			continue
+		}
+		if err := s.handleURL(u); err != nil {
+			return err
+		}
+	}
+	for _, sm := range sitemaps {
+		if !s.modified(sm.LastMod) {
+			continue
+		}
+		if rerr := s.read(sm.Loc, depth+1, seen); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+func (s *Sitemaps) modified(lastMod time.Time) bool {
+	return s.Since.IsZero() || lastMod.IsZero() || lastMod.After(s.Since)
+}
+
+func (s *Sitemaps) handleURL(u *URL) error {
+	for _, f := range s.callbacks {
+		f(u)
+	}
+	if s.Queue == nil {
+		return nil
+	}
+	parsed, err := url.Parse(u.Loc)
+	if err != nil {
+		return err
+	}
+	ctx := colly.NewContext()
+	if !u.LastMod.IsZero() {
+		ctx.Put(LastModKey, u.LastMod.Format(time.RFC3339))
+	}
+	if u.ChangeFreq != "" {
+		ctx.Put(ChangeFreqKey, u.ChangeFreq)
+	}
+	ctx.Put(PriorityKey, strconv.FormatFloat(u.Priority, 'f', -1, 64))
+	return s.Queue.AddRequest(&colly.Request{
+		URL:      parsed,
+		Method:   "GET",
+		Ctx:      ctx,
+		Priority: int(math.Round(u.Priority * 100)),
+	})
+}
+
+func (s *Sitemaps) fetch(sitemapURL string) ([]byte, error) {
+	var body []byte
+	c := s.collector.Clone()
+	c.AllowURLRevisit = true
+	c.MaxBodySize = maxSitemapSize
+	c.Async = false
+	c.OnResponse(func(r *colly.Response) {
+		body = r.Body
+	})
+	if err := c.Visit(sitemapURL); err != nil {
+		return nil, err
+	}
+	// sitemaps which aren't served as .xml.gz or with a gzip content type
+	// are still compressed
+	if len(body) >= 2 && body[0] == 0x1f && body[1] == 0x8b {
+		gr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		return io.ReadAll(io.LimitReader(gr, maxSitemapSize))
+	}
+	return body, nil
+}
+
+// xmlEntry is an url entry of a sitemap or a sitemap entry of an index
+type xmlEntry struct {
+	Loc        string `xml:"loc"`
+	LastMod    string `xml:"lastmod"`
+	ChangeFreq string `xml:"changefreq"`
+	Priority   string `xml:"priority"`
+}
+
+// parse parses an XML or text sitemap. It returns the URLs of a sitemap
+// and the sitemaps of a sitemap index.
+func parse(body []byte) (urls []*URL, sitemaps []*URL, err error) {
+	trimmed := bytes.TrimLeft(body, "\ufeff \t\r\n")
+	if !bytes.HasPrefix(trimmed, []byte("<")) {
+		return parseText(trimmed), nil, nil
+	}
+	d := xml.NewDecoder(bytes.NewReader(trimmed))
+	d.CharsetReader = charset.NewReaderLabel
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			return urls, sitemaps, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		start, ok := t.(xml.StartElement)
+		if !ok || (start.Name.Local != "url" && start.Name.Local != "sitemap") {
+			continue
+		}
+		e := &xmlEntry{}
+		if err := d.DecodeElement(e, &start); err != nil {
+			return nil, nil, err
+		}
+		u := e.url()
+		if u.Loc == "" {
+			continue
+		}
+		if start.Name.Local == "url" {
+			urls = append(urls, u)
+		} else {
+			sitemaps = append(sitemaps, u)
+		}
+	}
+}
+
+func (e *xmlEntry) url() *URL {
+	u := &URL{
+		Loc:        strings.TrimSpace(e.Loc),
+		LastMod:    parseLastMod(strings.TrimSpace(e.LastMod)),
+		ChangeFreq: strings.ToLower(strings.TrimSpace(e.ChangeFreq)),
+		Priority:   0.5,
+	}
+	if p, err := strconv.ParseFloat(strings.TrimSpace(e.Priority), 64); err == nil && p >= 0 && p <= 1 {
+		u.Priority = p
+	}
+	return u
+}
+
+// parseText parses a text sitemap, which contains an URL per line
+func parseText(body []byte) []*URL {
+	var urls []*URL
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "http://") || strings.HasPrefix(line, "https://") {
+			urls = append(urls, &URL{Loc: line, Priority: 0.5})
+		}
+	}
+	return urls
+}
+
+// lastModFormats are the W3C Datetime formats of lastmod
+var lastModFormats = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02",
+	"2006-01",
+	"2006",
+}
+
+func parseLastMod(v string) time.Time {
+	for _, layout := range lastModFormats {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
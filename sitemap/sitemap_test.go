@@ -0,0 +1,202 @@
+package sitemap
+
+import (
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gocolly/colly/v2"
+	"github.com/gocolly/colly/v2/queue"
+)
+
+type testServer struct {
+	*httptest.Server
+	lock    sync.Mutex
+	fetched []string
+}
+
+func newTestServer(robots bool) *testServer {
+	ts := &testServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		if !robots {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("User-agent: *\nAllow: /\nSitemap: " + ts.URL + "/sitemap_index.xml\n"))
+	})
+	xmlHandler := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			ts.lock.Lock()
+			ts.fetched = append(ts.fetched, r.URL.Path)
+			ts.lock.Unlock()
+			body := strings.ReplaceAll(body, "URL", ts.URL)
+			if strings.HasSuffix(r.URL.Path, ".gz") {
+				gw := gzip.NewWriter(w)
+				gw.Write([]byte(body))
+				gw.Close()
+				return
+			}
+			w.Write([]byte(body))
+		}
+	}
+	mux.HandleFunc("/sitemap_index.xml", xmlHandler(`<?xml version="1.0" encoding="UTF-8"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>URL/sitemap1.xml.gz</loc><lastmod>2024-05-01</lastmod></sitemap>
+  <sitemap><loc>URL/sitemap2.txt</loc></sitemap>
+  <sitemap><loc>URL/old.xml</loc><lastmod>2020-01-01T00:00:00Z</lastmod></sitemap>
+  <sitemap><loc>URL/sitemap_index.xml</loc></sitemap>
+</sitemapindex>`))
+	mux.HandleFunc("/sitemap1.xml.gz", xmlHandler(`<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url>
+    <loc>URL/a</loc>
+    <lastmod>2023-06-01</lastmod>
+    <changefreq>Daily</changefreq>
+    <priority>0.8</priority>
+  </url>
+  <url>
+    <loc> URL/b </loc>
+    <lastmod>2024-05-01T10:00:00+02:00</lastmod>
+  </url>
+</urlset>`))
+	mux.HandleFunc("/sitemap2.txt", xmlHandler("URL/c\n\nURL/d\n"))
+	mux.HandleFunc("/old.xml", xmlHandler(`<urlset><url><loc>URL/e</loc><lastmod>2020-01-01</lastmod></url></urlset>`))
+	mux.HandleFunc("/sitemap.xml", xmlHandler(`<urlset><url><loc>URL/f</loc></url></urlset>`))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	ts.Server = httptest.NewServer(mux)
+	return ts
+}
+
+func TestCrawl(t *testing.T) {
+	ts := newTestServer(true)
+	defer ts.Close()
+
+	q, _ := queue.New(1, &queue.PriorityQueueStorage{})
+	s := New(colly.NewCollector())
+	s.Queue = q
+	urls := make(map[string]*URL)
+	s.OnURL(func(u *URL) {
+		urls[strings.TrimPrefix(u.Loc, ts.URL)] = u
+	})
+	if err := s.Crawl(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 5 {
+		t.Fatalf("expected 5 URLs, got %d", len(urls))
+	}
+	a := urls["/a"]
+	if !a.LastMod.Equal(time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)) || a.ChangeFreq != "daily" || a.Priority != 0.8 || a.Sitemap != ts.URL+"/sitemap1.xml.gz" {
+		t.Errorf("unexpected URL: %+v", a)
+	}
+	if b := urls["/b"]; b == nil || !b.LastMod.Equal(time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)) || b.Priority != 0.5 {
+		t.Errorf("unexpected URL: %+v", b)
+	}
+	if c := urls["/c"]; c == nil || !c.LastMod.IsZero() || c.Sitemap != ts.URL+"/sitemap2.txt" {
+		t.Errorf("unexpected URL: %+v", c)
+	}
+	sort.Strings(ts.fetched)
+	if strings.Join(ts.fetched, ",") != "/old.xml,/sitemap1.xml.gz,/sitemap2.txt,/sitemap_index.xml" {
+		t.Errorf("unexpected sitemap fetches: %v", ts.fetched)
+	}
+
+	c := colly.NewCollector()
+	var visited []string
+	c.OnResponse(func(r *colly.Response) {
+		visited = append(visited, r.Request.URL.Path+":"+strconv.Itoa(r.Request.Priority))
+	})
+	if err := q.Run(c); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(visited, ",") != "/a:80,/b:50,/c:50,/d:50,/e:50" {
+		t.Errorf("unexpected priorities: %v", visited)
+	}
+}
+
+func TestCrawlSince(t *testing.T) {
+	ts := newTestServer(true)
+	defer ts.Close()
+
+	q, _ := queue.New(1, &queue.InMemoryQueueStorage{MaxSize: 100})
+	s := New(colly.NewCollector())
+	s.Since = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.Queue = q
+	if err := s.Crawl(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range ts.fetched {
+		if path == "/old.xml" {
+			t.Error("unmodified sitemap fetched")
+		}
+	}
+
+	c := colly.NewCollector()
+	visited := make(map[string]string)
+	c.OnResponse(func(r *colly.Response) {
+		visited[r.Request.URL.Path] = r.Ctx.Get(LastModKey) + " " + r.Ctx.Get(PriorityKey) + " " + strconv.Itoa(r.Request.Priority)
+	})
+	if err := q.Run(c); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"/b": "2024-05-01T10:00:00+02:00 0.5 50",
+		"/c": " 0.5 50",
+		"/d": " 0.5 50",
+	}
+	if len(visited) != len(expected) {
+		t.Fatalf("unexpected enqueued URLs: %v", visited)
+	}
+	for path, v := range expected {
+		if visited[path] != v {
+			t.Errorf("unexpected context of %s: %q", path, visited[path])
+		}
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	ts := newTestServer(false)
+	defer ts.Close()
+
+	s := New(colly.NewCollector())
+	sitemaps, err := s.Discover(ts.URL + "/some/page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sitemaps) != 1 || sitemaps[0] != ts.URL+"/sitemap.xml" {
+		t.Errorf("unexpected sitemaps: %v", sitemaps)
+	}
+	var locs []string
+	s.OnURL(func(u *URL) {
+		locs = append(locs, u.Loc)
+	})
+	if err := s.Crawl(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	if len(locs) != 1 || locs[0] != ts.URL+"/f" {
+		t.Errorf("unexpected URLs: %v", locs)
+	}
+}
+
+func TestParseLastMod(t *testing.T) {
+	tests := map[string]time.Time{
+		"2024":                      time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		"2024-05":                   time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+		"2024-05-01T10:30Z":         time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC),
+		"2024-05-01T10:30:15.5Z":    time.Date(2024, 5, 1, 10, 30, 15, 5e8, time.UTC),
+		"2024-05-01T10:30:00-01:00": time.Date(2024, 5, 1, 11, 30, 0, 0, time.UTC),
+		"yesterday":                 {},
+	}
+	for v, expected := range tests {
+		if lm := parseLastMod(v); !lm.Equal(expected) {
+			t.Errorf("unexpected lastmod of %q: %v", v, lm)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2018 Adam Tauber
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"math"
+	"math/bits"
+	"net/http/cookiejar"
+	"net/url"
+	"sync"
+)
+
+const (
+	defaultBloomCapacity          = 1 << 20
+	defaultBloomFalsePositiveRate = 0.001
+	// bloomTightening is the ratio by which the error rate of each
+	// new filter is tightened, so that the compound error rate of
+	// the scalable filter converges to FalsePositiveRate.
+	bloomTightening = 0.85
+	bloomGrowth     = 2
+)
+
+// BloomStorage is a Storage implementation which keeps visited request
+// IDs in a scalable Bloom filter instead of a map. Its memory usage is a
+// few bits per visited URL regardless of the URL length, in exchange
+// for a small probability of reporting an unvisited request as visited
+// (such requests are skipped by the Collector).
+//
+// The filter starts with Capacity slots and adds a new, twice as large
+// filter each time the current one is full, keeping the overall
+// false-positive rate below FalsePositiveRate. Set MaxFilters to bound
+// the memory usage; once the limit is reached the last filter keeps
+// absorbing requests and the error rate grows, which is reported by
+// EstimatedFalsePositiveRate. BloomStorage doesn't record visit times,
+// so visits never expire with Collector.RevisitAfter.
+//
+// Cookies are kept in memory in a cookie jar.
+type BloomStorage struct {
+	// Capacity is the expected number of visited requests of the first
+	// filter. Defaults to 1048576.
+	Capacity uint64
+	// FalsePositiveRate is the target probability of reporting an
+	// unvisited request as visited. Defaults to 0.001.
+	FalsePositiveRate float64
+	// MaxFilters limits the number of filters. 0 means unlimited.
+	MaxFilters int
+
+	lock    *sync.RWMutex
+	filters []*bloomFilter
+	jar     *cookiejar.Jar
+}
+
+type bloomFilter struct {
+	bits     []uint64
+	m        uint64
+	k        uint64
+	capacity uint64
+	count    uint64
+	set      uint64
+}
+
+// Init initializes BloomStorage
+func (s *BloomStorage) Init() error {
+	if s.lock == nil {
+		s.lock = &sync.RWMutex{}
+	}
+	if s.Capacity == 0 {
+		s.Capacity = defaultBloomCapacity
+	}
+	if s.FalsePositiveRate <= 0 || s.FalsePositiveRate >= 1 {
+		s.FalsePositiveRate = defaultBloomFalsePositiveRate
+	}
+	if s.filters == nil {
+		s.filters = []*bloomFilter{newBloomFilter(s.Capacity, s.FalsePositiveRate*(1-bloomTightening))}
+	}
+	if s.jar == nil {
+		var err error
+		s.jar, err = cookiejar.New(nil)
+		return err
+	}
+	return nil
+}
+
+// Visited implements Storage.Visited()
+func (s *BloomStorage) Visited(requestID uint64) error {
+	h1, h2 := bloomHashes(requestID)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, f := range s.filters {
+		if f.test(h1, h2) {
+			return nil
+		}
+	}
+	f := s.filters[len(s.filters)-1]
+	if f.count >= f.capacity && (s.MaxFilters <= 0 || len(s.filters) < s.MaxFilters) {
+		p := s.FalsePositiveRate * (1 - bloomTightening) * math.Pow(bloomTightening, float64(len(s.filters)))
+		f = newBloomFilter(f.capacity*bloomGrowth, p)
+		s.filters = append(s.filters, f)
+	}
+	f.add(h1, h2)
+	return nil
+}
+
+// IsVisited implements Storage.IsVisited()
+func (s *BloomStorage) IsVisited(requestID uint64) (bool, error) {
+	h1, h2 := bloomHashes(requestID)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, f := range s.filters {
+		if f.test(h1, h2) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Cookies implements Storage.Cookies()
+func (s *BloomStorage) Cookies(u *url.URL) string {
+	return StringifyCookies(s.jar.Cookies(u))
+}
+
+// SetCookies implements Storage.SetCookies()
+func (s *BloomStorage) SetCookies(u *url.URL, cookies string) {
+	s.jar.SetCookies(u, UnstringifyCookies(cookies))
+}
+
+// Close implements Storage.Close()
+func (s *BloomStorage) Close() error {
+	return nil
+}
+
+// Count returns the number of requests stored in the filter. It can be
+// slightly lower than the number of Visited calls, because requests
+// which were false positives are not added again.
+func (s *BloomStorage) Count() uint64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var n uint64
+	for _, f := range s.filters {
+		n += f.count
+	}
+	return n
+}
+
+// FillRatio returns the ratio of the set bits of the filter.
+// The closer it gets to 1, the higher the false-positive rate is.
+func (s *BloomStorage) FillRatio() float64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var set, m uint64
+	for _, f := range s.filters {
+		set += f.set
+		m += f.m
+	}
+	return float64(set) / float64(m)
+}
+
+// EstimatedFalsePositiveRate returns the current probability of
+// reporting an unvisited request as visited
+func (s *BloomStorage) EstimatedFalsePositiveRate() float64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	pass := 1.0
+	for _, f := range s.filters {
+		pass *= 1 - math.Pow(float64(f.set)/float64(f.m), float64(f.k))
+	}
+	return 1 - pass
+}
+
+// MemoryUsage returns the size of the filter bitmaps in bytes
+func (s *BloomStorage) MemoryUsage() uint64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var n uint64
+	for _, f := range s.filters {
+		n += uint64(len(f.bits)) * 8
+	}
+	return n
+}
+
+func newBloomFilter(capacity uint64, p float64) *bloomFilter {
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	m = max((m+63)/64*64, 64)
+	k := max(uint64(math.Ceil(math.Log2(1/p))), 1)
+	return &bloomFilter{
+		bits:     make([]uint64, m/64),
+		m:        m,
+		k:        k,
+		capacity: capacity,
+	}
+}
+
+func (f *bloomFilter) add(h1, h2 uint64) {
+	for i := uint64(0); i < f.k; i++ {
+		pos := (h1 + i*h2) % f.m
+		mask := uint64(1) << (pos % 64)
+		if f.bits[pos/64]&mask == 0 {
+			f.bits[pos/64] |= mask
+			f.set++
+		}
+	}
+	f.count++
+}
+
+func (f *bloomFilter) test(h1, h2 uint64) bool {
+	for i := uint64(0); i < f.k; i++ {
+		pos := (h1 + i*h2) % f.m
+		if f.bits[pos/64]&(uint64(1)<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bloomHashes derives the two base hashes of the double hashing scheme
+// from a request ID. Request IDs are already hashes, but they are mixed
+// again to decorrelate the two values.
+func bloomHashes(id uint64) (uint64, uint64) {
+	h1 := mix64(id)
+	h2 := mix64(bits.RotateLeft64(id, 32) ^ 0x9e3779b97f4a7c15)
+	return h1, h2 | 1
+}
+
+// mix64 is the finalizer of the SplitMix64 generator
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
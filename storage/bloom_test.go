@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"testing"
+)
+
+func TestBloomStorage(t *testing.T) {
+	s := &BloomStorage{Capacity: 1000, FalsePositiveRate: 0.01}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	const n = 10000
+	for i := uint64(0); i < n; i++ {
+		s.Visited(i)
+	}
+	for i := uint64(0); i < n; i++ {
+		if visited, _ := s.IsVisited(i); !visited {
+			t.Fatalf("request %d should be visited", i)
+		}
+	}
+	if len(s.filters) < 2 {
+		t.Errorf("filter should have grown, got %d filters", len(s.filters))
+	}
+	falsePositives := 0
+	for i := uint64(n); i < 2*n; i++ {
+		if visited, _ := s.IsVisited(i); visited {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / n; rate > 0.02 {
+		t.Errorf("false-positive rate is too high: %f", rate)
+	}
+	if rate := s.EstimatedFalsePositiveRate(); rate <= 0 || rate > 0.01 {
+		t.Errorf("wrong estimated false-positive rate: %f", rate)
+	}
+	if r := s.FillRatio(); r <= 0 || r >= 1 {
+		t.Errorf("wrong fill ratio: %f", r)
+	}
+	if c := s.Count(); c > n || c < n*98/100 {
+		t.Errorf("wrong count: %d", c)
+	}
+}
+
+func TestBloomStorageMaxFilters(t *testing.T) {
+	s := &BloomStorage{Capacity: 100, FalsePositiveRate: 0.01, MaxFilters: 1}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	size := s.MemoryUsage()
+	for i := uint64(0); i < 1000; i++ {
+		s.Visited(i)
+	}
+	if len(s.filters) != 1 || s.MemoryUsage() != size {
+		t.Errorf("filter should not grow beyond MaxFilters")
+	}
+	if rate := s.EstimatedFalsePositiveRate(); rate <= 0.01 {
+		t.Errorf("estimated false-positive rate should exceed the target of an overfilled filter, got %f", rate)
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2018 Adam Tauber
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const netscapeHttpOnlyPrefix = "#HttpOnly_"
+
+// ReadNetscapeCookies parses cookies from a Netscape cookies.txt file,
+// the format used by curl, wget and most browser export extensions
+func ReadNetscapeCookies(r io.Reader) ([]*Cookie, error) {
+	var cookies []*Cookie
+	now := time.Now()
+	s := bufio.NewScanner(r)
+	line := 0
+	for s.Scan() {
+		line++
+		l := strings.TrimRight(s.Text(), "\r")
+		httpOnly := false
+		if strings.HasPrefix(l, netscapeHttpOnlyPrefix) {
+			l = l[len(netscapeHttpOnlyPrefix):]
+			httpOnly = true
+		}
+		if strings.TrimSpace(l) == "" || l[0] == '#' {
+			continue
+		}
+		fields := strings.Split(l, "\t")
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("storage: invalid cookies.txt line %d", line)
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("storage: invalid expiry on cookies.txt line %d: %w", line, err)
+		}
+		c := &Cookie{
+			Domain:   strings.ToLower(strings.TrimPrefix(fields[0], ".")),
+			HostOnly: !strings.EqualFold(fields[1], "TRUE"),
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			Name:     fields[5],
+			Value:    fields[6],
+			HttpOnly: httpOnly,
+			Created:  now,
+		}
+		if expires > 0 {
+			c.Expires = time.Unix(expires, 0)
+		}
+		cookies = append(cookies, c)
+	}
+	return cookies, s.Err()
+}
+
+// WriteNetscapeCookies writes cookies in the Netscape cookies.txt format
+func WriteNetscapeCookies(w io.Writer, cookies []*Cookie) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("# Netscape HTTP Cookie File\n\n")
+	for _, c := range cookies {
+		domain := c.Domain
+		if !c.HostOnly {
+			domain = "." + domain
+		}
+		if c.HttpOnly {
+			domain = netscapeHttpOnlyPrefix + domain
+		}
+		var expires int64
+		if !c.Expires.IsZero() {
+			expires = c.Expires.Unix()
+		}
+		fmt.Fprintf(bw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			domain, netscapeBool(!c.HostOnly), c.Path, netscapeBool(c.Secure), expires, c.Name, c.Value)
+	}
+	return bw.Flush()
+}
+
+// jsonCookie is the cookie format of the common browser
+// extensions and of the chrome.cookies API
+type jsonCookie struct {
+	Domain         string  `json:"domain"`
+	ExpirationDate float64 `json:"expirationDate,omitempty"`
+	HostOnly       bool    `json:"hostOnly"`
+	HTTPOnly       bool    `json:"httpOnly"`
+	Name           string  `json:"name"`
+	Path           string  `json:"path"`
+	SameSite       string  `json:"sameSite,omitempty"`
+	Secure         bool    `json:"secure"`
+	Session        bool    `json:"session"`
+	Value          string  `json:"value"`
+}
+
+// ReadJSONCookies parses cookies from a JSON array in the format of
+// the chrome.cookies API, which is used by most browser cookie
+// export extensions
+func ReadJSONCookies(r io.Reader) ([]*Cookie, error) {
+	var jcs []jsonCookie
+	if err := json.NewDecoder(r).Decode(&jcs); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	cookies := make([]*Cookie, 0, len(jcs))
+	for _, jc := range jcs {
+		c := &Cookie{
+			Name:     jc.Name,
+			Value:    jc.Value,
+			Domain:   strings.ToLower(strings.TrimPrefix(jc.Domain, ".")),
+			Path:     jc.Path,
+			HostOnly: jc.HostOnly,
+			Secure:   jc.Secure,
+			HttpOnly: jc.HTTPOnly,
+			Created:  now,
+		}
+		if c.Path == "" {
+			c.Path = "/"
+		}
+		if !jc.Session && jc.ExpirationDate > 0 {
+			sec, frac := math.Modf(jc.ExpirationDate)
+			c.Expires = time.Unix(int64(sec), int64(frac*1e9))
+		}
+		switch strings.ToLower(jc.SameSite) {
+		case "lax":
+			c.SameSite = http.SameSiteLaxMode
+		case "strict":
+			c.SameSite = http.SameSiteStrictMode
+		case "no_restriction", "none":
+			c.SameSite = http.SameSiteNoneMode
+		}
+		cookies = append(cookies, c)
+	}
+	return cookies, nil
+}
+
+// WriteJSONCookies writes cookies as a JSON array in the format
+// of the chrome.cookies API
+func WriteJSONCookies(w io.Writer, cookies []*Cookie) error {
+	jcs := make([]jsonCookie, 0, len(cookies))
+	for _, c := range cookies {
+		domain := c.Domain
+		if !c.HostOnly {
+			domain = "." + domain
+		}
+		jc := jsonCookie{
+			Domain:   domain,
+			HostOnly: c.HostOnly,
+			HTTPOnly: c.HttpOnly,
+			Name:     c.Name,
+			Path:     c.Path,
+			Secure:   c.Secure,
+			Session:  c.Expires.IsZero(),
+			Value:    c.Value,
+		}
+		if !jc.Session {
+			jc.ExpirationDate = float64(c.Expires.UnixNano()) / 1e9
+		}
+		switch c.SameSite {
+		case http.SameSiteLaxMode:
+			jc.SameSite = "lax"
+		case http.SameSiteStrictMode:
+			jc.SameSite = "strict"
+		case http.SameSiteNoneMode:
+			jc.SameSite = "no_restriction"
+		default:
+			jc.SameSite = "unspecified"
+		}
+		jcs = append(jcs, jc)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(jcs)
+}
+
+func netscapeBool(b bool) string {
+	if b {
+		return "TRUE"
+	}
+	return "FALSE"
+}
@@ -0,0 +1,292 @@
+// Copyright 2018 Adam Tauber
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+var errNoHost = errors.New("storage: URL has no host")
+
+// CookieStorage is an optional interface of Storage implementations
+// which store structured cookie records. If the storage of a Collector
+// implements it, the Collector's cookie jar uses it instead of
+// Storage.Cookies and Storage.SetCookies, which preserves the domain,
+// host-only and creation time attributes of the cookies.
+type CookieStorage interface {
+	// SetCookieRecords stores cookie records. A record replaces the
+	// stored record with the same Domain, Path and Name, expired
+	// records delete it.
+	SetCookieRecords(cookies []*Cookie) error
+	// CookieRecords returns the records stored for the given domain
+	CookieRecords(domain string) ([]*Cookie, error)
+	// AllCookieRecords returns every stored record
+	AllCookieRecords() ([]*Cookie, error)
+}
+
+// Cookie is a stored cookie with the attributes required to decide
+// which requests it is sent with, see RFC 6265 section 5.3.
+type Cookie struct {
+	Name  string
+	Value string
+	// Domain is the domain of the cookie without a leading dot
+	Domain string
+	Path   string
+	// Expires is the expiry time of the cookie.
+	// It is zero for session cookies.
+	Expires time.Time
+	// Created is the creation time of the cookie
+	Created time.Time
+	// HostOnly cookies are sent only to Domain and not to its subdomains
+	HostOnly bool
+	Secure   bool
+	HttpOnly bool
+	SameSite http.SameSite
+}
+
+// NewCookie creates a cookie record from a cookie received in the
+// response of u. It returns nil if the cookie can't be set by u, for
+// example if its domain attribute doesn't match the host of u.
+func NewCookie(u *url.URL, c *http.Cookie, now time.Time) *Cookie {
+	host, err := canonicalHost(u.Hostname())
+	if err != nil {
+		return nil
+	}
+	r := &Cookie{
+		Name:     c.Name,
+		Value:    c.Value,
+		Domain:   host,
+		Path:     c.Path,
+		Created:  now,
+		HostOnly: true,
+		Secure:   c.Secure,
+		HttpOnly: c.HttpOnly,
+		SameSite: c.SameSite,
+	}
+	if c.Domain != "" {
+		domain := strings.ToLower(strings.TrimPrefix(c.Domain, "."))
+		if domain != host {
+			if net.ParseIP(host) != nil || !strings.HasSuffix(host, "."+domain) {
+				return nil
+			}
+			// cookies can't be set for public suffixes like "co.uk"
+			if ps, _ := publicsuffix.PublicSuffix(domain); ps == domain {
+				return nil
+			}
+		}
+		r.Domain = domain
+		r.HostOnly = false
+	}
+	if r.Path == "" || r.Path[0] != '/' {
+		r.Path = defaultCookiePath(u.EscapedPath())
+	}
+	switch {
+	case c.MaxAge < 0:
+		r.Expires = time.Unix(1, 0)
+	case c.MaxAge > 0:
+		r.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+	case !c.Expires.IsZero():
+		r.Expires = c.Expires
+	}
+	return r
+}
+
+// HTTPCookie converts the record to an http.Cookie
+func (c *Cookie) HTTPCookie() *http.Cookie {
+	hc := &http.Cookie{
+		Name:     c.Name,
+		Value:    c.Value,
+		Path:     c.Path,
+		Expires:  c.Expires,
+		Secure:   c.Secure,
+		HttpOnly: c.HttpOnly,
+		SameSite: c.SameSite,
+	}
+	if !c.HostOnly {
+		hc.Domain = c.Domain
+	}
+	return hc
+}
+
+// Expired returns true if the cookie is expired at the given time
+func (c *Cookie) Expired(now time.Time) bool {
+	return !c.Expires.IsZero() && !c.Expires.After(now)
+}
+
+// Matches returns true if the cookie has to be sent with requests of u
+func (c *Cookie) Matches(u *url.URL) bool {
+	host, err := canonicalHost(u.Hostname())
+	if err != nil {
+		return false
+	}
+	if host != c.Domain && (c.HostOnly || !strings.HasSuffix(host, "."+c.Domain)) {
+		return false
+	}
+	if c.Secure && u.Scheme != "https" {
+		return false
+	}
+	p := u.EscapedPath()
+	if p == "" {
+		p = "/"
+	}
+	if p == c.Path {
+		return true
+	}
+	return strings.HasPrefix(p, c.Path) && (strings.HasSuffix(c.Path, "/") || p[len(c.Path)] == '/')
+}
+
+func (c *Cookie) key() string {
+	return c.Domain + ";" + c.Path + ";" + c.Name
+}
+
+// CookiesForURL returns the unexpired cookies of s which have to be sent
+// with requests of u, ordered as RFC 6265 section 5.4 recommends
+func CookiesForURL(s CookieStorage, u *url.URL) ([]*Cookie, error) {
+	host, err := canonicalHost(u.Hostname())
+	if err != nil {
+		return nil, nil
+	}
+	now := time.Now()
+	var cookies []*Cookie
+	// Look up the host and all of its parent domains
+	for domain := host; ; {
+		records, err := s.CookieRecords(domain)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range records {
+			if !c.Expired(now) && c.Matches(u) {
+				cookies = append(cookies, c)
+			}
+		}
+		i := strings.IndexByte(domain, '.')
+		if i < 0 || net.ParseIP(host) != nil {
+			break
+		}
+		domain = domain[i+1:]
+	}
+	sort.SliceStable(cookies, func(i, j int) bool {
+		if len(cookies[i].Path) != len(cookies[j].Path) {
+			return len(cookies[i].Path) > len(cookies[j].Path)
+		}
+		return cookies[i].Created.Before(cookies[j].Created)
+	})
+	return cookies, nil
+}
+
+// cookieString returns the cookies of s matching u in the format of
+// Storage.Cookies
+func cookieString(s CookieStorage, u *url.URL) string {
+	records, err := CookiesForURL(s, u)
+	if err != nil {
+		return ""
+	}
+	cookies := make([]*http.Cookie, len(records))
+	for i, r := range records {
+		cookies[i] = &http.Cookie{Name: r.Name, Value: r.Value}
+	}
+	return StringifyCookies(cookies)
+}
+
+// cookieRecordsOf converts cookies in the format of Storage.SetCookies
+// to cookie records
+func cookieRecordsOf(u *url.URL, cookies string) []*Cookie {
+	now := time.Now()
+	var records []*Cookie
+	for _, c := range UnstringifyCookies(cookies) {
+		if r := NewCookie(u, c, now); r != nil {
+			records = append(records, r)
+		}
+	}
+	return records
+}
+
+// cookieRecords is an in-memory index of cookie records
+// keyed by domain and Cookie.key()
+type cookieRecords map[string]map[string]*Cookie
+
+func (m cookieRecords) set(c *Cookie, now time.Time) {
+	domain := m[c.Domain]
+	if c.Expired(now) {
+		delete(domain, c.key())
+		if len(domain) == 0 {
+			delete(m, c.Domain)
+		}
+		return
+	}
+	if domain == nil {
+		domain = make(map[string]*Cookie)
+		m[c.Domain] = domain
+	}
+	stored := *c
+	if old, ok := domain[c.key()]; ok {
+		stored.Created = old.Created
+	}
+	domain[c.key()] = &stored
+}
+
+func (m cookieRecords) get(domain string) []*Cookie {
+	cookies := make([]*Cookie, 0, len(m[domain]))
+	for _, c := range m[domain] {
+		copied := *c
+		cookies = append(cookies, &copied)
+	}
+	return cookies
+}
+
+func (m cookieRecords) all() []*Cookie {
+	var cookies []*Cookie
+	for domain := range m {
+		cookies = append(cookies, m.get(domain)...)
+	}
+	return cookies
+}
+
+func (m cookieRecords) len() int {
+	n := 0
+	for _, d := range m {
+		n += len(d)
+	}
+	return n
+}
+
+func canonicalHost(host string) (string, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" {
+		return "", errNoHost
+	}
+	return host, nil
+}
+
+// defaultCookiePath implements the default-path algorithm
+// of RFC 6265 section 5.1.4
+func defaultCookiePath(p string) string {
+	if p == "" || p[0] != '/' {
+		return "/"
+	}
+	i := strings.LastIndexByte(p, '/')
+	if i == 0 {
+		return "/"
+	}
+	return p[:i]
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCookiesForURL(t *testing.T) {
+	s := &FileStorage{Path: filepath.Join(t.TempDir(), "colly.log")}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	now := time.Now()
+	from, _ := url.Parse("https://www.example.com/account/login")
+	cookies := []*http.Cookie{
+		{Name: "shared", Value: "1", Domain: ".example.com", Path: "/"},
+		{Name: "host", Value: "2"},
+		{Name: "secure", Value: "3", Domain: "example.com", Path: "/", Secure: true},
+		{Name: "expired", Value: "4", Domain: "example.com", MaxAge: -1},
+		{Name: "foreign", Value: "5", Domain: "other.com"},
+		{Name: "suffix", Value: "6", Domain: "com"},
+	}
+	var records []*Cookie
+	for i, c := range cookies {
+		if r := NewCookie(from, c, now.Add(time.Duration(i))); r != nil {
+			records = append(records, r)
+		}
+	}
+	if len(records) != 4 {
+		t.Fatalf("foreign cookies should be rejected, got %d records", len(records))
+	}
+	s.SetCookieRecords(records)
+
+	tests := []struct {
+		url   string
+		names []string
+	}{
+		{"https://www.example.com/account/", []string{"host", "shared", "secure"}},
+		{"https://www.example.com/", []string{"shared", "secure"}},
+		{"http://api.example.com/", []string{"shared"}},
+		{"https://other.com/", nil},
+	}
+	for _, tc := range tests {
+		u, _ := url.Parse(tc.url)
+		got, err := CookiesForURL(s, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, c := range got {
+			names = append(names, c.Name)
+		}
+		if !reflect.DeepEqual(names, tc.names) {
+			t.Errorf("wrong cookies for %s: got %v, want %v", tc.url, names, tc.names)
+		}
+	}
+}
+
+func TestNetscapeCookies(t *testing.T) {
+	const cookiesTxt = `# Netscape HTTP Cookie File
+
+.example.com	TRUE	/	FALSE	0	session	abc
+#HttpOnly_www.example.com	FALSE	/app	TRUE	2000000000	token	xyz
+`
+	cookies, err := ReadNetscapeCookies(strings.NewReader(cookiesTxt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cookies) != 2 {
+		t.Fatalf("wrong number of cookies: %d", len(cookies))
+	}
+	c := cookies[1]
+	if c.Domain != "www.example.com" || !c.HostOnly || !c.HttpOnly || !c.Secure || c.Path != "/app" || c.Expires.Unix() != 2000000000 {
+		t.Errorf("wrongly parsed cookie: %+v", c)
+	}
+	if cookies[0].HostOnly || !cookies[0].Expires.IsZero() {
+		t.Errorf("wrongly parsed session cookie: %+v", cookies[0])
+	}
+
+	var buf bytes.Buffer
+	if err := WriteNetscapeCookies(&buf, cookies); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != cookiesTxt {
+		t.Errorf("cookies.txt round trip failed:\n%s", buf.String())
+	}
+}
+
+func TestJSONCookies(t *testing.T) {
+	cookies := []*Cookie{
+		{Name: "a", Value: "1", Domain: "example.com", Path: "/", SameSite: http.SameSiteLaxMode},
+		{Name: "b", Value: "2", Domain: "www.example.com", Path: "/", HostOnly: true, Secure: true, Expires: time.Unix(2000000000, 0)},
+	}
+	var buf bytes.Buffer
+	if err := WriteJSONCookies(&buf, cookies); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadJSONCookies(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range got {
+		got[i].Created = time.Time{}
+		if !reflect.DeepEqual(got[i], cookies[i]) {
+			t.Errorf("JSON round trip failed: got %+v, want %+v", got[i], cookies[i])
+		}
+	}
+}
@@ -0,0 +1,550 @@
+// Copyright 2018 Adam Tauber
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// SyncPolicy defines when FileStorage flushes its log to stable storage
+type SyncPolicy int
+
+const (
+	// SyncInterval flushes and fsyncs the log periodically in the
+	// background. At most SyncInterval worth of writes can be lost
+	// on a crash. This is the default policy.
+	SyncInterval SyncPolicy = iota
+	// SyncAlways flushes and fsyncs the log after every write
+	SyncAlways
+	// SyncNever leaves flushing to the operating system. Buffered
+	// writes are only guaranteed to be on the disk after Close.
+	SyncNever
+)
+
+const (
+	recordVisited byte = 1
+	recordCookie  byte = 3
+	recordRobots  byte = 4
+)
+
+const (
+	fileStorageMagic = "COLLYFS1"
+
+	recordHeaderSize = 8
+	maxRecordSize    = 64 << 20
+
+	defaultSyncInterval   = time.Second
+	defaultCompactMinSize = 1 << 16
+)
+
+// ErrCorruptLog is returned by FileStorage.Init if the log file
+// is not a FileStorage log or it is corrupted
+var ErrCorruptLog = errors.New("storage: corrupt log file")
+
+// FileStorage is a Storage implementation which persists visited
+// request IDs, cookies and robots.txt files in an append-only log on
+// the disk.
+// The log is replayed into an in-memory index by Init, so long crawls
+// can be stopped and resumed without revisiting already seen pages.
+//
+// Every record is checksummed, a partially written record at the end
+// of the log (e.g. after a crash) is discarded on Init and corrupted
+// records are skipped. The log is
+// rewritten in a compacted form when obsolete records outnumber
+// the live ones.
+type FileStorage struct {
+	// Path is the location of the log file
+	Path string
+	// Sync defines when the log is flushed to stable storage
+	Sync SyncPolicy
+	// SyncInterval is the flush period of the SyncInterval policy.
+	// Defaults to one second.
+	SyncInterval time.Duration
+	// CompactMinRecords is the minimum number of records the log must
+	// contain before it gets compacted. Defaults to 65536.
+	// Set it to a negative value to disable automatic compaction.
+	CompactMinRecords int
+
+	lock    *sync.RWMutex
+	file    *os.File
+	w       *bufio.Writer
+	visited map[uint64]int64
+	jar     cookieRecords
+	robots  map[string]*Robots
+	records int
+	dirty   bool
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// Init implements Storage.Init(). It opens or creates the log
+// and loads its content into memory.
+func (s *FileStorage) Init() error {
+	if s.lock == nil {
+		s.lock = &sync.RWMutex{}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file != nil {
+		return nil
+	}
+	if s.SyncInterval <= 0 {
+		s.SyncInterval = defaultSyncInterval
+	}
+	if s.CompactMinRecords == 0 {
+		s.CompactMinRecords = defaultCompactMinSize
+	}
+	s.visited = make(map[uint64]int64)
+	s.jar = make(cookieRecords)
+	s.robots = make(map[string]*Robots)
+	s.records = 0
+
+	if dir := filepath.Dir(s.Path); dir != "" {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(s.Path, os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	if err := s.load(f); err != nil {
+		f.Close()
+		return err
+	}
+	s.file = f
+	s.w = bufio.NewWriter(f)
+	if s.shouldCompact() {
+		if err := s.compact(); err != nil {
+			s.file.Close()
+			s.file, s.w = nil, nil
+			return err
+		}
+	}
+	if s.Sync == SyncInterval {
+		s.done = make(chan struct{})
+		s.wg.Add(1)
+		go s.syncLoop(s.done)
+	}
+	return nil
+}
+
+// Close flushes pending writes and closes the log file
+func (s *FileStorage) Close() error {
+	if s.lock == nil {
+		return nil
+	}
+	s.lock.Lock()
+	if s.file == nil {
+		s.lock.Unlock()
+		return nil
+	}
+	if s.done != nil {
+		close(s.done)
+		s.done = nil
+	}
+	s.lock.Unlock()
+	s.wg.Wait()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	err := s.flush(true)
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	s.file = nil
+	s.w = nil
+	return err
+}
+
+// Visited implements Storage.Visited()
+func (s *FileStorage) Visited(requestID uint64) error {
+	now := time.Now().UnixNano()
+	var b [17]byte
+	b[0] = recordVisited
+	binary.BigEndian.PutUint64(b[1:], requestID)
+	binary.BigEndian.PutUint64(b[9:], uint64(now))
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.append(b[:]); err != nil {
+		return err
+	}
+	s.visited[requestID] = now
+	return s.maybeCompact()
+}
+
+// IsVisited implements Storage.IsVisited()
+func (s *FileStorage) IsVisited(requestID uint64) (bool, error) {
+	s.lock.RLock()
+	_, visited := s.visited[requestID]
+	s.lock.RUnlock()
+	return visited, nil
+}
+
+// VisitedAt implements VisitTimeStorage.VisitedAt()
+func (s *FileStorage) VisitedAt(requestID uint64) (time.Time, bool, error) {
+	s.lock.RLock()
+	t, visited := s.visited[requestID]
+	s.lock.RUnlock()
+	if !visited {
+		return time.Time{}, false, nil
+	}
+	return time.Unix(0, t), true, nil
+}
+
+// Cookies implements Storage.Cookies(). It returns the cookie
+// records matching u, like the cookie jar of the Collector.
+func (s *FileStorage) Cookies(u *url.URL) string {
+	return cookieString(s, u)
+}
+
+// SetCookies implements Storage.SetCookies(). The cookies are stored
+// as cookie records.
+func (s *FileStorage) SetCookies(u *url.URL, cookies string) {
+	// Storage.SetCookies cannot report errors, the cookies are kept
+	// in memory even if the log write fails.
+	s.SetCookieRecords(cookieRecordsOf(u, cookies))
+}
+
+// SetCookieRecords implements CookieStorage.SetCookieRecords()
+func (s *FileStorage) SetCookieRecords(cookies []*Cookie) error {
+	now := time.Now()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, c := range cookies {
+		b, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		if err := s.append(append([]byte{recordCookie}, b...)); err != nil {
+			return err
+		}
+		s.jar.set(c, now)
+	}
+	return s.maybeCompact()
+}
+
+// CookieRecords implements CookieStorage.CookieRecords()
+func (s *FileStorage) CookieRecords(domain string) ([]*Cookie, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.jar.get(domain), nil
+}
+
+// AllCookieRecords implements CookieStorage.AllCookieRecords()
+func (s *FileStorage) AllCookieRecords() ([]*Cookie, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.jar.all(), nil
+}
+
+// SetRobots implements RobotsStorage.SetRobots()
+func (s *FileStorage) SetRobots(r *Robots) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.append(append([]byte{recordRobots}, b...)); err != nil {
+		return err
+	}
+	s.robots[r.Host] = r
+	return s.maybeCompact()
+}
+
+// Robots implements RobotsStorage.Robots()
+func (s *FileStorage) Robots(host string) (*Robots, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.robots[host], nil
+}
+
+// Compact rewrites the log so it contains only the live records
+func (s *FileStorage) Compact() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.compact()
+}
+
+func (s *FileStorage) load(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		if _, err := f.WriteString(fileStorageMagic); err != nil {
+			return err
+		}
+		return f.Sync()
+	}
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(fileStorageMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != fileStorageMagic {
+		return ErrCorruptLog
+	}
+	offset := int64(len(magic))
+	header := make([]byte, recordHeaderSize)
+	for info.Size()-offset >= recordHeaderSize {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return err
+		}
+		size := binary.BigEndian.Uint32(header)
+		if size == 0 || size > maxRecordSize {
+			// a zero filled tail is left by a crash, anything else
+			// can't be skipped
+			if zeroTail(header, r) {
+				break
+			}
+			return ErrCorruptLog
+		}
+		end := offset + recordHeaderSize + int64(size)
+		if end > info.Size() {
+			break
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return err
+		}
+		if crc32.ChecksumIEEE(payload) == binary.BigEndian.Uint32(header[4:]) {
+			s.apply(payload)
+		} else if end == info.Size() {
+			// torn last record
+			break
+		}
+		// A corrupted record is skipped, it is dropped by the next
+		// compaction.
+		s.records++
+		offset = end
+	}
+	// Drop the torn tail of the log, if any.
+	if offset != info.Size() {
+		if err := f.Truncate(offset); err != nil {
+			return err
+		}
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	return err
+}
+
+// apply loads a record into memory. Malformed and unknown records are
+// ignored.
+func (s *FileStorage) apply(payload []byte) {
+	switch payload[0] {
+	case recordVisited:
+		if len(payload) != 17 {
+			return
+		}
+		s.visited[binary.BigEndian.Uint64(payload[1:])] = int64(binary.BigEndian.Uint64(payload[9:]))
+	case recordCookie:
+		c := &Cookie{}
+		if err := json.Unmarshal(payload[1:], c); err != nil {
+			return
+		}
+		s.jar.set(c, time.Now())
+	case recordRobots:
+		r := &Robots{}
+		if err := json.Unmarshal(payload[1:], r); err != nil {
+			return
+		}
+		s.robots[r.Host] = r
+	}
+}
+
+func (s *FileStorage) append(payload []byte) error {
+	if s.w == nil {
+		return os.ErrClosed
+	}
+	if err := writeRecord(s.w, payload); err != nil {
+		return err
+	}
+	s.records++
+	s.dirty = true
+	if s.Sync == SyncAlways {
+		return s.flush(true)
+	}
+	return nil
+}
+
+func (s *FileStorage) flush(sync bool) error {
+	if !s.dirty {
+		return nil
+	}
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	s.dirty = false
+	if sync && s.Sync != SyncNever {
+		return s.file.Sync()
+	}
+	return nil
+}
+
+func (s *FileStorage) syncLoop(done <-chan struct{}) {
+	defer s.wg.Done()
+	t := time.NewTicker(s.SyncInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.lock.Lock()
+			if s.file != nil {
+				s.flush(true)
+			}
+			s.lock.Unlock()
+		case <-done:
+			return
+		}
+	}
+}
+
+func (s *FileStorage) shouldCompact() bool {
+	live := len(s.visited) + s.jar.len() + len(s.robots)
+	return s.CompactMinRecords > 0 && s.records >= s.CompactMinRecords && s.records > 2*live
+}
+
+func (s *FileStorage) maybeCompact() error {
+	if !s.shouldCompact() {
+		return nil
+	}
+	return s.compact()
+}
+
+func (s *FileStorage) compact() error {
+	if s.file == nil {
+		return os.ErrClosed
+	}
+	if err := s.flush(false); err != nil {
+		return err
+	}
+	tmpName := s.Path + ".compact"
+	tmp, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	records, err := s.writeSnapshot(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, s.Path); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	syncDir(filepath.Dir(s.Path))
+	s.file.Close()
+	s.file = tmp
+	s.w = bufio.NewWriter(tmp)
+	s.records = records
+	return nil
+}
+
+func (s *FileStorage) writeSnapshot(w io.Writer) (int, error) {
+	if _, err := io.WriteString(w, fileStorageMagic); err != nil {
+		return 0, err
+	}
+	records := 0
+	var b [17]byte
+	b[0] = recordVisited
+	for id, t := range s.visited {
+		binary.BigEndian.PutUint64(b[1:], id)
+		binary.BigEndian.PutUint64(b[9:], uint64(t))
+		if err := writeRecord(w, b[:]); err != nil {
+			return 0, err
+		}
+		records++
+	}
+	for _, c := range s.jar.all() {
+		b, err := json.Marshal(c)
+		if err != nil {
+			return 0, err
+		}
+		if err := writeRecord(w, append([]byte{recordCookie}, b...)); err != nil {
+			return 0, err
+		}
+		records++
+	}
+	for _, r := range s.robots {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return 0, err
+		}
+		if err := writeRecord(w, append([]byte{recordRobots}, b...)); err != nil {
+			return 0, err
+		}
+		records++
+	}
+	return records, nil
+}
+
+func writeRecord(w io.Writer, payload []byte) error {
+	var header [recordHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(payload))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// zeroTail returns true if header and the rest of r contain only zeros
+func zeroTail(header []byte, r io.Reader) bool {
+	if len(bytes.Trim(header, "\x00")) != 0 {
+		return false
+	}
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := r.Read(buf)
+		if len(bytes.Trim(buf[:n], "\x00")) != 0 {
+			return false
+		}
+		if err != nil {
+			return err == io.EOF
+		}
+	}
+}
+
+// syncDir makes a rename durable by syncing the parent directory.
+// Errors are ignored, some platforms don't support syncing directories.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
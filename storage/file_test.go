@@ -0,0 +1,246 @@
+package storage
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFileStoragePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "colly.log")
+	u, _ := url.Parse("http://example.com/")
+
+	s := &FileStorage{Path: path, Sync: SyncAlways}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(0); i < 100; i++ {
+		if err := s.Visited(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.SetCookies(u, "a=1")
+	s.SetCookies(u, "a=2")
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = &FileStorage{Path: path}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := uint64(0); i < 100; i++ {
+		if visited, _ := s.IsVisited(i); !visited {
+			t.Fatalf("request %d should be visited after reopening the log", i)
+		}
+	}
+	if visited, _ := s.IsVisited(100); visited {
+		t.Error("request 100 should not be visited")
+	}
+	if c := s.Cookies(u); c != "a=2" {
+		t.Errorf("wrong cookies after reopening the log: %q", c)
+	}
+}
+
+func TestFileStorageTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "colly.log")
+
+	s := &FileStorage{Path: path, Sync: SyncAlways}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	s.Visited(1)
+	s.Visited(2)
+	s.Close()
+
+	// simulate a crash in the middle of writing a record
+	info, _ := os.Stat(path)
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	s = &FileStorage{Path: path, Sync: SyncAlways}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if visited, _ := s.IsVisited(1); !visited {
+		t.Error("request 1 should survive a torn tail")
+	}
+	if visited, _ := s.IsVisited(2); visited {
+		t.Error("torn record should be discarded")
+	}
+	s.Visited(3)
+	s.Close()
+
+	s = &FileStorage{Path: path}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if visited, _ := s.IsVisited(3); !visited {
+		t.Error("records written after recovery should be readable")
+	}
+}
+
+func TestFileStorageCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "colly.log")
+
+	s := &FileStorage{Path: path, Sync: SyncAlways}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	s.Visited(1)
+	s.Visited(2)
+	s.Visited(3)
+	s.Close()
+
+	// flip a byte in the payload of the second record
+	data, _ := os.ReadFile(path)
+	offset := len(fileStorageMagic) + 2*recordHeaderSize + 17 + 5
+	data[offset] ^= 0xff
+	if err := os.WriteFile(path, data, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	s = &FileStorage{Path: path}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[uint64]bool{1: true, 2: false, 3: true} {
+		if visited, _ := s.IsVisited(id); visited != want {
+			t.Errorf("request %d: visited %v, want %v", id, visited, want)
+		}
+	}
+	s.Close()
+
+	// a zero filled tail is dropped
+	data, _ = os.ReadFile(path)
+	if err := os.WriteFile(path, append(data, make([]byte, 100)...), 0640); err != nil {
+		t.Fatal(err)
+	}
+	s = &FileStorage{Path: path}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if info, _ := os.Stat(path); info.Size() != int64(len(data)) {
+		t.Errorf("zero filled tail not truncated: %d", info.Size())
+	}
+
+	// a corrupted length can't be skipped
+	data[len(fileStorageMagic)] = 0xff
+	if err := os.WriteFile(path, data, 0640); err != nil {
+		t.Fatal(err)
+	}
+	s = &FileStorage{Path: path}
+	if err := s.Init(); err != ErrCorruptLog {
+		t.Errorf("expected ErrCorruptLog, got %v", err)
+	}
+	if info, _ := os.Stat(path); info.Size() != int64(len(data)) {
+		t.Errorf("corrupted log truncated to %d bytes", info.Size())
+	}
+}
+
+func TestFileStorageCompactionError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "colly.log")
+
+	s := &FileStorage{Path: path, Sync: SyncAlways, CompactMinRecords: -1}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		s.Visited(1)
+	}
+	s.Close()
+
+	// the temporary file of the compaction can't be created
+	if err := os.Mkdir(path+".compact", 0750); err != nil {
+		t.Fatal(err)
+	}
+	s = &FileStorage{Path: path, CompactMinRecords: 5}
+	if err := s.Init(); err == nil {
+		t.Fatal("compaction error not returned")
+	}
+	if s.file != nil {
+		t.Error("log file left open after failed Init")
+	}
+	os.Remove(path + ".compact")
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if visited, _ := s.IsVisited(1); !visited {
+		t.Error("request 1 should be visited")
+	}
+}
+
+func TestFileStorageCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "colly.log")
+	u, _ := url.Parse("http://example.com/")
+
+	s := &FileStorage{Path: path, Sync: SyncNever, CompactMinRecords: 10}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		s.SetCookies(u, "a=b")
+	}
+	s.Visited(1)
+	if s.records > 10 {
+		t.Errorf("log should have been compacted, got %d records", s.records)
+	}
+	s.Close()
+
+	s = &FileStorage{Path: path}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if visited, _ := s.IsVisited(1); !visited {
+		t.Error("request 1 should be visited after compaction")
+	}
+	if c := s.Cookies(u); c != "a=b" {
+		t.Errorf("wrong cookies after compaction: %q", c)
+	}
+}
+
+func TestFileStorageRobots(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "colly.log")
+	fetched := time.Now().Truncate(time.Second)
+
+	s := &FileStorage{Path: path, Sync: SyncNever, CompactMinRecords: 10}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		r := &Robots{Host: "example.com", StatusCode: 200, Body: []byte("User-agent: *\nDisallow: /" + strconv.Itoa(i)), Fetched: fetched}
+		if err := s.SetRobots(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.SetRobots(&Robots{Host: "other.com", StatusCode: 404, Fetched: fetched})
+	s.Close()
+
+	s = &FileStorage{Path: path}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	r, err := s.Robots("example.com")
+	if err != nil || r == nil {
+		t.Fatalf("robots.txt not persisted: %v", err)
+	}
+	if string(r.Body) != "User-agent: *\nDisallow: /19" || r.StatusCode != 200 || !r.Fetched.Equal(fetched) {
+		t.Errorf("unexpected robots.txt: %+v", r)
+	}
+	if r, _ := s.Robots("other.com"); r == nil || r.StatusCode != 404 {
+		t.Errorf("unexpected robots.txt: %+v", r)
+	}
+	if r, _ := s.Robots("missing.com"); r != nil {
+		t.Error("unexpected robots.txt of missing host")
+	}
+}
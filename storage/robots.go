@@ -0,0 +1,41 @@
+// Copyright 2018 Adam Tauber
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import "time"
+
+// Robots is a stored robots.txt file
+type Robots struct {
+	// Host is the host of the robots.txt file
+	Host string
+	// StatusCode is the status code of the robots.txt response
+	StatusCode int
+	// Body is the content of the robots.txt file
+	Body []byte
+	// Fetched is the time when the robots.txt file was fetched
+	Fetched time.Time
+}
+
+// RobotsStorage is an optional interface of Storage implementations
+// which persist robots.txt files. Collector uses it to keep robots.txt
+// files across restarts until they expire.
+type RobotsStorage interface {
+	// SetRobots stores a robots.txt file, replacing the previous file
+	// of its host
+	SetRobots(r *Robots) error
+	// Robots returns the stored robots.txt file of host.
+	// It returns nil if there is no stored file.
+	Robots(host string) (*Robots, error)
+}
@@ -16,10 +16,10 @@ package storage
 
 import (
 	"net/http"
-	"net/http/cookiejar"
 	"net/url"
 	"strings"
 	"sync"
+	"time"
 )
 
 // Storage is an interface which handles Collector's internal data,
@@ -41,27 +41,38 @@ type Storage interface {
 	SetCookies(u *url.URL, cookies string)
 }
 
+// VisitTimeStorage is an optional interface of Storage implementations
+// which record when a request was visited. Collector uses it to treat
+// visits older than Collector.RevisitAfter as expired.
+type VisitTimeStorage interface {
+	// VisitedAt returns the time when the request ID was last stored
+	// by Visited. ok is false if the request ID is not visited.
+	VisitedAt(requestID uint64) (t time.Time, ok bool, err error)
+}
+
 // InMemoryStorage is the default storage backend of colly.
 // InMemoryStorage keeps cookies and visited urls in memory
 // without persisting data on the disk.
 type InMemoryStorage struct {
-	visitedURLs map[uint64]bool
+	visitedURLs map[uint64]time.Time
 	lock        *sync.RWMutex
-	jar         *cookiejar.Jar
+	jar         cookieRecords
+	robots      map[string]*Robots
 }
 
 // Init initializes InMemoryStorage
 func (s *InMemoryStorage) Init() error {
 	if s.visitedURLs == nil {
-		s.visitedURLs = make(map[uint64]bool)
+		s.visitedURLs = make(map[uint64]time.Time)
 	}
 	if s.lock == nil {
 		s.lock = &sync.RWMutex{}
 	}
+	if s.robots == nil {
+		s.robots = make(map[string]*Robots)
+	}
 	if s.jar == nil {
-		var err error
-		s.jar, err = cookiejar.New(nil)
-		return err
+		s.jar = make(cookieRecords)
 	}
 	return nil
 }
@@ -69,7 +80,7 @@ func (s *InMemoryStorage) Init() error {
 // Visited implements Storage.Visited()
 func (s *InMemoryStorage) Visited(requestID uint64) error {
 	s.lock.Lock()
-	s.visitedURLs[requestID] = true
+	s.visitedURLs[requestID] = time.Now()
 	s.lock.Unlock()
 	return nil
 }
@@ -77,19 +88,69 @@ func (s *InMemoryStorage) Visited(requestID uint64) error {
 // IsVisited implements Storage.IsVisited()
 func (s *InMemoryStorage) IsVisited(requestID uint64) (bool, error) {
 	s.lock.RLock()
-	visited := s.visitedURLs[requestID]
+	_, visited := s.visitedURLs[requestID]
 	s.lock.RUnlock()
 	return visited, nil
 }
 
-// Cookies implements Storage.Cookies()
+// VisitedAt implements VisitTimeStorage.VisitedAt()
+func (s *InMemoryStorage) VisitedAt(requestID uint64) (time.Time, bool, error) {
+	s.lock.RLock()
+	t, visited := s.visitedURLs[requestID]
+	s.lock.RUnlock()
+	return t, visited, nil
+}
+
+// Cookies implements Storage.Cookies(). It returns the cookie
+// records matching u, like the cookie jar of the Collector.
 func (s *InMemoryStorage) Cookies(u *url.URL) string {
-	return StringifyCookies(s.jar.Cookies(u))
+	return cookieString(s, u)
 }
 
-// SetCookies implements Storage.SetCookies()
+// SetCookies implements Storage.SetCookies(). The cookies are stored
+// as cookie records.
 func (s *InMemoryStorage) SetCookies(u *url.URL, cookies string) {
-	s.jar.SetCookies(u, UnstringifyCookies(cookies))
+	s.SetCookieRecords(cookieRecordsOf(u, cookies))
+}
+
+// SetCookieRecords implements CookieStorage.SetCookieRecords()
+func (s *InMemoryStorage) SetCookieRecords(cookies []*Cookie) error {
+	now := time.Now()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, c := range cookies {
+		s.jar.set(c, now)
+	}
+	return nil
+}
+
+// CookieRecords implements CookieStorage.CookieRecords()
+func (s *InMemoryStorage) CookieRecords(domain string) ([]*Cookie, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.jar.get(domain), nil
+}
+
+// AllCookieRecords implements CookieStorage.AllCookieRecords()
+func (s *InMemoryStorage) AllCookieRecords() ([]*Cookie, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.jar.all(), nil
+}
+
+// SetRobots implements RobotsStorage.SetRobots()
+func (s *InMemoryStorage) SetRobots(r *Robots) error {
+	s.lock.Lock()
+	s.robots[r.Host] = r
+	s.lock.Unlock()
+	return nil
+}
+
+// Robots implements RobotsStorage.Robots()
+func (s *InMemoryStorage) Robots(host string) (*Robots, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.robots[host], nil
 }
 
 // Close implements Storage.Close()
@@ -0,0 +1,206 @@
+// Copyright 2018 Adam Tauber
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package colly
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAdaptiveMaxDelay      = time.Minute
+	defaultAdaptiveTargetLatency = time.Second
+	// minBackoffDelay is the smallest delay set by an adaptive
+	// LimitRule after a 429 or 503 response
+	minBackoffDelay = time.Second
+	// adaptiveHostIdleTimeout is the time after which the adaptive state
+	// of a host without requests is dropped
+	adaptiveHostIdleTimeout = 10 * time.Minute
+)
+
+// hostThrottle is the adaptive state of a host matching an adaptive LimitRule
+type hostThrottle struct {
+	delay       time.Duration
+	parallelism int
+	active      int
+	used        time.Time
+}
+
+func (r *LimitRule) initAdaptive() {
+	r.hosts = make(map[string]*hostThrottle)
+	r.hostsEvicted = time.Now()
+	r.hostsCond = sync.NewCond(&r.hostsLock)
+}
+
+func (r *LimitRule) maxDelay() time.Duration {
+	if r.MaxDelay > 0 {
+		return r.MaxDelay
+	}
+	return defaultAdaptiveMaxDelay
+}
+
+func (r *LimitRule) maxParallelism() int {
+	return max(r.MaxParallelism, r.Parallelism, 1)
+}
+
+func (r *LimitRule) targetLatency() time.Duration {
+	if r.TargetLatency > 0 {
+		return r.TargetLatency
+	}
+	return defaultAdaptiveTargetLatency
+}
+
+// host returns the adaptive state of host. hostsLock must be held.
+func (r *LimitRule) host(host string) *hostThrottle {
+	h, ok := r.hosts[host]
+	if !ok {
+		h = &hostThrottle{
+			delay:       min(max(r.Delay, r.MinDelay), r.maxDelay()),
+			parallelism: max(r.Parallelism, 1),
+		}
+		r.hosts[host] = h
+	}
+	h.used = time.Now()
+	return h
+}
+
+// evictHosts drops the state of the hosts which have been idle for
+// adaptiveHostIdleTimeout. hostsLock must be held.
+func (r *LimitRule) evictHosts(now time.Time) {
+	if now.Sub(r.hostsEvicted) < adaptiveHostIdleTimeout {
+		return
+	}
+	r.hostsEvicted = now
+	for host, h := range r.hosts {
+		if h.active == 0 && now.Sub(h.used) >= adaptiveHostIdleTimeout {
+			delete(r.hosts, host)
+		}
+	}
+}
+
+// acquireHost blocks until host has a free slot of its adaptive parallelism
+func (r *LimitRule) acquireHost(host string) {
+	r.hostsLock.Lock()
+	defer r.hostsLock.Unlock()
+	h := r.host(host)
+	for h.active >= h.parallelism {
+		r.hostsCond.Wait()
+	}
+	h.active++
+}
+
+// releaseHost frees the slot of host taken by acquireHost
+func (r *LimitRule) releaseHost(host string) {
+	r.hostsLock.Lock()
+	r.host(host).active--
+	r.evictHosts(time.Now())
+	r.hostsLock.Unlock()
+	r.hostsCond.Broadcast()
+}
+
+// hostDelay returns the current adaptive delay of host
+func (r *LimitRule) hostDelay(host string) time.Duration {
+	r.hostsLock.Lock()
+	defer r.hostsLock.Unlock()
+	return r.host(host).delay
+}
+
+// observe adapts the delay and the parallelism of host to the result
+// of a request. The delay converges to the latency divided by the
+// parallelism, so the host is expected to handle parallelism requests at
+// a time. The parallelism grows while the latency stays below
+// TargetLatency and shrinks when it is exceeded. 429 and 503 responses
+// and timeouts double the delay and halve the parallelism.
+func (r *LimitRule) observe(host string, latency time.Duration, statusCode int, err error) {
+	r.hostsLock.Lock()
+	defer r.hostsLock.Unlock()
+	h := r.host(host)
+	if isThrottled(statusCode, err) {
+		h.delay = min(max(h.delay*2, latency, minBackoffDelay, r.MinDelay), r.maxDelay())
+		h.parallelism = max(h.parallelism/2, 1)
+		return
+	}
+	if err != nil || latency <= 0 {
+		return
+	}
+	target := latency / time.Duration(h.parallelism)
+	h.delay = min(max((h.delay+target)/2, r.MinDelay), r.maxDelay())
+	if latency <= r.targetLatency() {
+		h.parallelism = min(h.parallelism+1, r.maxParallelism())
+	} else {
+		h.parallelism = max(h.parallelism-1, 1)
+	}
+	if h.parallelism > h.active {
+		r.hostsCond.Broadcast()
+	}
+}
+
+// isThrottled returns true if the result of a request shows that the
+// server is overloaded
+func isThrottled(statusCode int, err error) bool {
+	if err != nil {
+		var netErr net.Error
+		return errors.As(err, &netErr) && netErr.Timeout()
+	}
+	return statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable
+}
+
+// Throttle returns the current delay and parallelism of host. For
+// non-adaptive rules it returns Delay and Parallelism.
+func (r *LimitRule) Throttle(host string) (delay time.Duration, parallelism int) {
+	if !r.Adaptive || r.hosts == nil {
+		return r.Delay, max(r.Parallelism, 1)
+	}
+	r.hostsLock.Lock()
+	defer r.hostsLock.Unlock()
+	h := r.host(host)
+	return h.delay, h.parallelism
+}
+
+// slots returns the number of concurrent requests allowed to host
+// and the number of requests holding a slot
+func (r *LimitRule) slots(host string) (limit, active int) {
+	if !r.Adaptive || r.hosts == nil {
+		return cap(r.waitChan), len(r.waitChan)
+	}
+	r.hostsLock.Lock()
+	defer r.hostsLock.Unlock()
+	h := r.host(host)
+	return h.parallelism, h.active
+}
+
+// reserve takes a token from the bucket of the rule and returns the
+// time to wait until the token becomes available. The bucket may go
+// into debt, so the waiting requests are spread evenly at Rate.
+func (r *LimitRule) reserve() time.Duration {
+	now := time.Now()
+	burst := float64(max(r.Burst, 1))
+	r.tokensLock.Lock()
+	defer r.tokensLock.Unlock()
+	if r.tokensUpdated.IsZero() {
+		r.tokens = burst
+	} else {
+		r.tokens = min(r.tokens+now.Sub(r.tokensUpdated).Seconds()*r.Rate, burst)
+	}
+	r.tokensUpdated = now
+	r.tokens--
+	if r.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-r.tokens / r.Rate * float64(time.Second))
+}
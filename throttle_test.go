@@ -0,0 +1,160 @@
+package colly
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveLimitRuleObserve(t *testing.T) {
+	r := &LimitRule{
+		DomainGlob:     "*",
+		Adaptive:       true,
+		Parallelism:    2,
+		MaxParallelism: 4,
+		MinDelay:       10 * time.Millisecond,
+		MaxDelay:       5 * time.Second,
+		TargetLatency:  100 * time.Millisecond,
+	}
+	if err := r.Init(); err != nil {
+		t.Fatal(err)
+	}
+	const host = "example.com"
+	if d, p := r.Throttle(host); d != 10*time.Millisecond || p != 2 {
+		t.Fatalf("unexpected initial state: %v %d", d, p)
+	}
+
+	for i := 0; i < 10; i++ {
+		r.observe(host, 20*time.Millisecond, http.StatusOK, nil)
+	}
+	if d, p := r.Throttle(host); d != 10*time.Millisecond || p != 4 {
+		t.Errorf("fast host not sped up: %v %d", d, p)
+	}
+
+	r.observe(host, 20*time.Millisecond, http.StatusTooManyRequests, nil)
+	if d, p := r.Throttle(host); d != minBackoffDelay || p != 2 {
+		t.Errorf("no backoff after 429: %v %d", d, p)
+	}
+	for i := 0; i < 4; i++ {
+		r.observe(host, 0, http.StatusServiceUnavailable, nil)
+	}
+	if d, p := r.Throttle(host); d != 5*time.Second || p != 1 {
+		t.Errorf("backoff not bounded: %v %d", d, p)
+	}
+
+	for i := 0; i < 3; i++ {
+		r.observe(host, time.Second, http.StatusOK, nil)
+	}
+	if _, p := r.Throttle(host); p != 1 {
+		t.Errorf("parallelism increased on slow host: %d", p)
+	}
+
+	if d, p := r.Throttle("other.com"); d != 10*time.Millisecond || p != 2 {
+		t.Errorf("hosts are not independent: %v %d", d, p)
+	}
+}
+
+func TestAdaptiveLimitRuleEvictHosts(t *testing.T) {
+	r := &LimitRule{DomainGlob: "*", Adaptive: true}
+	if err := r.Init(); err != nil {
+		t.Fatal(err)
+	}
+	r.acquireHost("busy.com")
+	r.acquireHost("idle.com")
+	r.releaseHost("idle.com")
+	r.Throttle("recent.com")
+
+	now := time.Now()
+	r.hostsLock.Lock()
+	r.hosts["busy.com"].used = now.Add(-adaptiveHostIdleTimeout)
+	r.hosts["idle.com"].used = now.Add(-adaptiveHostIdleTimeout)
+	r.evictHosts(now)
+	if len(r.hosts) != 3 {
+		t.Errorf("hosts evicted before the timeout: %d left", len(r.hosts))
+	}
+	r.evictHosts(now.Add(adaptiveHostIdleTimeout))
+	_, busy := r.hosts["busy.com"]
+	_, idle := r.hosts["idle.com"]
+	r.hostsLock.Unlock()
+	if !busy || idle {
+		t.Errorf("wrong hosts evicted: busy %v, idle %v", busy, idle)
+	}
+	r.releaseHost("busy.com")
+}
+
+func TestAdaptiveLimitRuleBackoff(t *testing.T) {
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	rule := &LimitRule{
+		DomainGlob: "*",
+		Adaptive:   true,
+		MaxDelay:   200 * time.Millisecond,
+	}
+	c := NewCollector(AllowURLRevisit())
+	if err := c.Limit(rule); err != nil {
+		t.Fatal(err)
+	}
+	c.Visit(ts.URL)
+	host := ts.Listener.Addr().String()
+	if d, _ := rule.Throttle(host); d != 200*time.Millisecond {
+		t.Errorf("expected backoff delay, got %v", d)
+	}
+	if limit, _ := c.DomainLimit(host); limit != 1 {
+		t.Errorf("expected limit 1, got %d", limit)
+	}
+
+	start := time.Now()
+	c.Visit(ts.URL)
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("adaptive delay not applied")
+	}
+	if d, _ := rule.Throttle(host); d >= 200*time.Millisecond {
+		t.Errorf("delay not decreased after success: %v", d)
+	}
+}
+
+func TestLimitRuleRate(t *testing.T) {
+	r := &LimitRule{DomainGlob: "*", Rate: 10, Burst: 3}
+	if err := r.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if d := r.reserve(); d != 0 {
+			t.Fatalf("burst request %d delayed by %v", i, d)
+		}
+	}
+	if d := r.reserve(); d <= 0 || d > 100*time.Millisecond {
+		t.Errorf("unexpected delay after burst: %v", d)
+	}
+	if d := r.reserve(); d <= 100*time.Millisecond || d > 200*time.Millisecond {
+		t.Errorf("waiting requests not spread: %v", d)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	c := NewCollector(AllowURLRevisit(), Async())
+	if err := c.Limit(&LimitRule{DomainGlob: "*", Rate: 20, Parallelism: 5}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		c.Visit(ts.URL)
+	}
+	c.Wait()
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("10 requests at 20 req/s finished in %v", elapsed)
+	}
+}
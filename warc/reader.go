@@ -0,0 +1,124 @@
+// Copyright 2018 Adam Tauber
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package warc
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidRecord is returned by Reader for malformed records
+var ErrInvalidRecord = errors.New("warc: invalid record")
+
+// ErrRecordTooLarge is returned by Reader for records with content
+// longer than Reader.MaxContentSize
+var ErrRecordTooLarge = errors.New("warc: record too large")
+
+const defaultMaxContentSize = 1 << 30
+
+// Reader reads the records of an archive. Both compressed and
+// uncompressed archives are supported.
+type Reader struct {
+	// MaxContentSize is the maximum content size of a record.
+	// Defaults to 1GB.
+	MaxContentSize int64
+
+	r *bufio.Reader
+}
+
+// NewReader creates a Reader reading from r
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		// the records are concatenated gzip members
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		br = bufio.NewReader(gr)
+	}
+	return &Reader{r: br}, nil
+}
+
+// Next returns the next record of the archive. It returns io.EOF if there
+// are no more records.
+func (r *Reader) Next() (*Record, error) {
+	var version string
+	for version == "" {
+		line, err := r.r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil, io.EOF
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		version = strings.TrimRight(line, "\r\n")
+	}
+	if !strings.HasPrefix(version, "WARC/1.") {
+		return nil, fmt.Errorf("%w: unsupported version %q", ErrInvalidRecord, version)
+	}
+	rec := &Record{}
+	for {
+		line, err := r.r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("%w: invalid field %q", ErrInvalidRecord, line)
+		}
+		rec.Header = append(rec.Header, Field{name, strings.TrimSpace(value)})
+	}
+	length, err := strconv.ParseInt(rec.Header.Get("Content-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("%w: invalid Content-Length", ErrInvalidRecord)
+	}
+	maxSize := r.MaxContentSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxContentSize
+	}
+	if length > maxSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrRecordTooLarge, length)
+	}
+	// the buffer grows with the data read, a Content-Length longer than
+	// the archive doesn't allocate the whole length
+	var content bytes.Buffer
+	if _, err := io.CopyN(&content, r.r, length); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+	}
+	rec.Content = content.Bytes()
+	end := make([]byte, 4)
+	if _, err := io.ReadFull(r.r, end); err != nil || !bytes.Equal(end, []byte("\r\n\r\n")) {
+		return nil, fmt.Errorf("%w: missing record end", ErrInvalidRecord)
+	}
+	return rec, nil
+}
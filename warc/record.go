@@ -0,0 +1,131 @@
+// Copyright 2018 Adam Tauber
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package warc implements writing and reading of WARC 1.1 archives
+// (ISO 28500) of the HTTP traffic of collectors.
+package warc
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"time"
+)
+
+// WARC record types
+const (
+	TypeWarcinfo = "warcinfo"
+	TypeRequest  = "request"
+	TypeResponse = "response"
+	TypeMetadata = "metadata"
+)
+
+const warcVersion = "WARC/1.1"
+
+// Field is a named field of a record header
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Header contains the named fields of a record in their order.
+// Field names are case-insensitive.
+type Header []Field
+
+// Get returns the value of the first field called name
+func (h Header) Get(name string) string {
+	for _, f := range h {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// Set sets the value of the field called name, or appends a new field
+func (h *Header) Set(name, value string) {
+	for i, f := range *h {
+		if strings.EqualFold(f.Name, name) {
+			(*h)[i].Value = value
+			return
+		}
+	}
+	*h = append(*h, Field{name, value})
+}
+
+// Record is a WARC record
+type Record struct {
+	Header Header
+	// Content is the content block of the record
+	Content []byte
+	// body is written after Content, it holds bodySize bytes
+	body     io.Reader
+	bodySize int64
+}
+
+// Type returns the WARC-Type of the record
+func (r *Record) Type() string {
+	return r.Header.Get("WARC-Type")
+}
+
+// TargetURI returns the WARC-Target-URI of the record
+func (r *Record) TargetURI() string {
+	return r.Header.Get("WARC-Target-URI")
+}
+
+// ID returns the WARC-Record-ID of the record
+func (r *Record) ID() string {
+	return r.Header.Get("WARC-Record-ID")
+}
+
+// NewRecord creates a record of type recordType with a new record ID and
+// the current date
+func NewRecord(recordType, contentType string, content []byte) *Record {
+	return &Record{
+		Header: Header{
+			{"WARC-Type", recordType},
+			{"WARC-Record-ID", newRecordID()},
+			{"WARC-Date", formatDate(time.Now())},
+			{"Content-Type", contentType},
+		},
+		Content: content,
+	}
+}
+
+func newRecordID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func formatDate(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000000Z")
+}
+
+// Digest returns the digest of b in the format of the WARC digest fields
+func Digest(b []byte) string {
+	h := sha1.New()
+	h.Write(b)
+	return hashDigest(h)
+}
+
+func hashDigest(h hash.Hash) string {
+	return "sha1:" + base32.StdEncoding.EncodeToString(h.Sum(nil))
+}
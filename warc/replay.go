@@ -0,0 +1,116 @@
+// Copyright 2018 Adam Tauber
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package warc
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gocolly/colly/v2"
+)
+
+// ErrNotArchived is returned by replayed collectors for requests without
+// archived response
+var ErrNotArchived = errors.New("warc: response not archived")
+
+// Replay replays the response records of archive files through the
+// callbacks of a collector, e.g. to scrape archived pages again with
+// new OnHTML callbacks. It replaces the transport of c with one serving
+// the archived responses and visits the target URI of every response
+// record. Links visited by the callbacks are served from the archives as
+// well; requests without archived response fail with ErrNotArchived.
+// Missing robots.txt files are served as 404 responses.
+//
+// The responses are held in memory during the replay.
+func Replay(c *colly.Collector, archives ...string) error {
+	t := &replayTransport{responses: make(map[string][]byte)}
+	var targets []string
+	for _, path := range archives {
+		if err := t.load(path, &targets); err != nil {
+			return err
+		}
+	}
+	c.WithTransport(t)
+	for _, target := range targets {
+		err := c.Visit(target)
+		var visited *colly.AlreadyVisitedError
+		if err != nil && !errors.As(err, &visited) && !errors.Is(err, colly.ErrRobotsTxtBlocked) {
+			return err
+		}
+	}
+	c.Wait()
+	return nil
+}
+
+// replayTransport serves archived responses by their target URIs
+type replayTransport struct {
+	responses map[string][]byte
+}
+
+func (t *replayTransport) load(path string, targets *[]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := NewReader(f)
+	if err != nil {
+		return err
+	}
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if rec.Type() != TypeResponse {
+			continue
+		}
+		target := rec.TargetURI()
+		if _, ok := t.responses[target]; !ok && !strings.HasSuffix(target, "/robots.txt") {
+			*targets = append(*targets, target)
+		}
+		t.responses[target] = rec.Content
+	}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	content, ok := t.responses[req.URL.String()]
+	if !ok || (req.Method != "GET" && req.Method != "HEAD") {
+		if req.URL.Path == "/robots.txt" {
+			return &http.Response{
+				Status:     "404 Not Found",
+				StatusCode: http.StatusNotFound,
+				Proto:      "HTTP/1.1",
+				ProtoMajor: 1,
+				ProtoMinor: 1,
+				Header:     http.Header{},
+				Body:       http.NoBody,
+				Request:    req,
+			}, nil
+		}
+		return nil, fmt.Errorf("%w: %s %s", ErrNotArchived, req.Method, req.URL)
+	}
+	return http.ReadResponse(bufio.NewReader(bytes.NewReader(content)), req)
+}
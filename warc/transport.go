@@ -0,0 +1,234 @@
+// Copyright 2018 Adam Tauber
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package warc
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gocolly/colly/v2/internal/reqbody"
+)
+
+// Transport is an http.RoundTripper which archives every exchange as a
+// request, a response and a metadata record:
+//
+//	w := &warc.Writer{Dir: "archive"}
+//	defer w.Close()
+//	c.WithTransport(&warc.Transport{Writer: w})
+//
+// Response bodies are archived as they are transferred. To keep them
+// content encoded, Transport requests gzip compression explicitly if the
+// request has no Accept-Encoding header, which makes the responses
+// returned by Transport gzip encoded. Collectors decode them, other
+// clients have to decode them themselves.
+//
+// Response bodies are copied to a temporary file while they are read and
+// the records are written when the body is read to the end or closed, so
+// bodies are never held in memory. Bodies closed before the end are
+// archived as truncated.
+type Transport struct {
+	// Writer writes the records
+	Writer *Writer
+	// Transport sends the requests. Defaults to http.DefaultTransport.
+	Transport http.RoundTripper
+	// RecordRobots enables the archiving of robots.txt fetches
+	RecordRobots bool
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if !t.RecordRobots && req.URL.Path == "/robots.txt" {
+		return transport.RoundTrip(req)
+	}
+	reqBody, err := reqbody.Read(req)
+	if err != nil {
+		return nil, err
+	}
+	var ip string
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if addr, ok := info.Conn.RemoteAddr().(*net.TCPAddr); ok {
+				ip = addr.IP.String()
+			}
+		},
+	}
+	out := req.Clone(httptrace.WithClientTrace(req.Context(), trace))
+	if req.Body != nil {
+		out.Body = io.NopCloser(bytes.NewReader(reqBody))
+	}
+	if out.Header.Get("Accept-Encoding") == "" {
+		out.Header.Set("Accept-Encoding", "gzip")
+	}
+	start := time.Now()
+	res, err := transport.RoundTrip(out)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp("", "colly-warc-")
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	head := httpResponseHead(res)
+	b := &spool{
+		ReadCloser: res.Body,
+		file:       file,
+		payload:    sha1.New(),
+		block:      sha1.New(),
+	}
+	b.block.Write(head)
+	b.w = io.MultiWriter(file, b.payload, b.block)
+	b.done = func(truncated bool) error {
+		return t.archive(out, reqBody, head, b, truncated, ip, start)
+	}
+	res.Body = b
+	res.Request = req
+	return res, nil
+}
+
+func (t *Transport) archive(req *http.Request, reqBody []byte, head []byte, b *spool, truncated bool, ip string, start time.Time) error {
+	target := req.URL.String()
+	date := formatDate(start)
+
+	resRecord := NewRecord(TypeResponse, "application/http;msgtype=response", head)
+	resRecord.body = b.file
+	resRecord.bodySize = b.size
+	resRecord.Header.Set("WARC-Date", date)
+	resRecord.Header.Set("WARC-Target-URI", target)
+	if ip != "" {
+		resRecord.Header.Set("WARC-IP-Address", ip)
+	}
+	resRecord.Header.Set("WARC-Block-Digest", hashDigest(b.block))
+	resRecord.Header.Set("WARC-Payload-Digest", hashDigest(b.payload))
+	if truncated {
+		resRecord.Header.Set("WARC-Truncated", "unspecified")
+	}
+
+	reqRecord := NewRecord(TypeRequest, "application/http;msgtype=request", httpRequest(req, reqBody))
+	reqRecord.Header.Set("WARC-Date", date)
+	reqRecord.Header.Set("WARC-Target-URI", target)
+	reqRecord.Header.Set("WARC-Concurrent-To", resRecord.ID())
+	reqRecord.Header.Set("WARC-Block-Digest", Digest(reqRecord.Content))
+	if len(reqBody) > 0 {
+		reqRecord.Header.Set("WARC-Payload-Digest", Digest(reqBody))
+	}
+
+	metadata := "fetchTimeMs: " + strconv.FormatInt(time.Since(start).Milliseconds(), 10) + "\r\n"
+	if referer := req.Header.Get("Referer"); referer != "" {
+		metadata += "via: " + referer + "\r\n"
+	}
+	metaRecord := NewRecord(TypeMetadata, "application/warc-fields", []byte(metadata))
+	metaRecord.Header.Set("WARC-Date", date)
+	metaRecord.Header.Set("WARC-Target-URI", target)
+	metaRecord.Header.Set("WARC-Refers-To", resRecord.ID())
+	metaRecord.Header.Set("WARC-Concurrent-To", resRecord.ID())
+
+	return t.Writer.WriteRecords(reqRecord, resRecord, metaRecord)
+}
+
+// httpRequest returns the HTTP/1.1 message of a request
+func httpRequest(req *http.Request, body []byte) []byte {
+	var buf bytes.Buffer
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), host)
+	req.Header.Write(&buf)
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// httpResponseHead returns the status line and the header of the HTTP
+// message of a response
+func httpResponseHead(res *http.Response) []byte {
+	var buf bytes.Buffer
+	status := res.Status
+	if status == "" {
+		status = strconv.Itoa(res.StatusCode) + " " + http.StatusText(res.StatusCode)
+	}
+	fmt.Fprintf(&buf, "HTTP/%d.%d %s\r\n", res.ProtoMajor, res.ProtoMinor, status)
+	res.Header.Write(&buf)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// spool copies a response body to a temporary file while it is read. The
+// records are written when the body is read to the end or closed.
+type spool struct {
+	io.ReadCloser
+	file           *os.File
+	w              io.Writer
+	payload, block hash.Hash
+	size           int64
+	err            error
+	once           sync.Once
+	archiveErr     error
+	done           func(truncated bool) error
+}
+
+func (s *spool) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	if n > 0 && s.err == nil {
+		_, s.err = s.w.Write(p[:n])
+		s.size += int64(n)
+	}
+	if err == io.EOF {
+		if err := s.finish(false); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+func (s *spool) Close() error {
+	err := s.ReadCloser.Close()
+	if ferr := s.finish(s.ReadCloser != http.NoBody); ferr != nil {
+		return ferr
+	}
+	return err
+}
+
+// finish writes the records once and removes the temporary file
+func (s *spool) finish(truncated bool) error {
+	s.once.Do(func() {
+		err := s.err
+		if err == nil {
+			_, err = s.file.Seek(0, io.SeekStart)
+		}
+		if err == nil {
+			err = s.done(truncated)
+		}
+		s.file.Close()
+		os.Remove(s.file.Name())
+		s.archiveErr = err
+	})
+	return s.archiveErr
+}
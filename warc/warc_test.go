@@ -0,0 +1,273 @@
+package warc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gocolly/colly/v2"
+)
+
+func newTestServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("User-agent: *\nAllow: /\n"))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><head><title>index</title></head><body><a href="/gzip">next</a></body></html>`))
+	})
+	mux.HandleFunc("/gzip", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gw := gzip.NewWriter(w)
+		gw.Write([]byte(`<html><head><title>compressed</title></head></html>`))
+		gw.Close()
+	})
+	return httptest.NewServer(mux)
+}
+
+func readArchives(t *testing.T, files []string) []*Record {
+	var records []*Record
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			rec, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			records = append(records, rec)
+		}
+		f.Close()
+	}
+	return records
+}
+
+func crawl(t *testing.T, c *colly.Collector, u string) []string {
+	var titles []string
+	c.OnHTML("title", func(e *colly.HTMLElement) {
+		titles = append(titles, e.Text)
+	})
+	c.OnHTML("a[href]", func(e *colly.HTMLElement) {
+		e.Request.Visit(e.Attr("href"))
+	})
+	c.OnError(func(r *colly.Response, err error) {
+		t.Errorf("unexpected error: %v", err)
+	})
+	if err := c.Visit(u + "/"); err != nil {
+		t.Fatal(err)
+	}
+	return titles
+}
+
+func TestTransport(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	w := &Writer{Dir: t.TempDir()}
+	c := colly.NewCollector()
+	c.WithTransport(&Transport{Writer: w})
+	if titles := crawl(t, c, ts.URL); strings.Join(titles, ",") != "index,compressed" {
+		t.Fatalf("unexpected titles: %v", titles)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files, err := w.Files()
+	if err != nil || len(files) != 1 || !strings.HasSuffix(files[0], ".warc.gz") {
+		t.Fatalf("unexpected archive files: %v %v", files, err)
+	}
+
+	records := readArchives(t, files)
+	var types []string
+	for _, rec := range records {
+		types = append(types, rec.Type())
+		if strings.HasSuffix(rec.TargetURI(), "/robots.txt") {
+			t.Error("robots.txt recorded")
+		}
+		if d := rec.Header.Get("WARC-Block-Digest"); d != "" && d != Digest(rec.Content) {
+			t.Errorf("invalid block digest of %s record", rec.Type())
+		}
+	}
+	if strings.Join(types, ",") != "warcinfo,request,response,metadata,request,response,metadata" {
+		t.Fatalf("unexpected records: %v", types)
+	}
+
+	res := records[5]
+	if res.TargetURI() != ts.URL+"/gzip" || res.Header.Get("WARC-IP-Address") != "127.0.0.1" {
+		t.Errorf("unexpected response record header: %v", res.Header)
+	}
+	if records[4].Header.Get("WARC-Concurrent-To") != res.ID() || records[6].Header.Get("WARC-Refers-To") != res.ID() {
+		t.Error("records are not related")
+	}
+	_, payload, _ := bytes.Cut(res.Content, []byte("\r\n\r\n"))
+	if res.Header.Get("WARC-Payload-Digest") != Digest(payload) {
+		t.Error("invalid payload digest")
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatalf("payload is not archived as transferred: %v", err)
+	}
+	if b, _ := io.ReadAll(gr); !bytes.Contains(b, []byte("compressed")) {
+		t.Errorf("unexpected payload: %q", b)
+	}
+}
+
+func TestTransportRecordRobots(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	w := &Writer{Dir: t.TempDir(), Uncompressed: true}
+	c := colly.NewCollector()
+	c.IgnoreRobotsTxt = false
+	c.WithTransport(&Transport{Writer: w, RecordRobots: true})
+	crawl(t, c, ts.URL)
+	w.Close()
+	files, _ := w.Files()
+	if len(files) != 1 || !strings.HasSuffix(files[0], ".warc") {
+		t.Fatalf("unexpected archive files: %v", files)
+	}
+	found := false
+	for _, rec := range readArchives(t, files) {
+		if rec.Type() == TypeResponse && rec.TargetURI() == ts.URL+"/robots.txt" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("robots.txt not recorded")
+	}
+}
+
+func TestTransportStreaming(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	w := &Writer{Dir: t.TempDir(), Uncompressed: true}
+	tr := &Transport{Writer: w}
+	for i, n := range []int{-1, 10} {
+		req, _ := http.NewRequest("GET", ts.URL+"/", nil)
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if files, _ := w.Files(); i == 0 && len(files) != 0 {
+			t.Fatal("records written before the body is read")
+		}
+		if n < 0 {
+			io.ReadAll(res.Body)
+		} else {
+			io.ReadFull(res.Body, make([]byte, n))
+		}
+		res.Body.Close()
+	}
+	w.Close()
+	files, _ := w.Files()
+	var responses []*Record
+	for _, rec := range readArchives(t, files) {
+		if rec.Type() == TypeResponse {
+			responses = append(responses, rec)
+		}
+	}
+	if len(responses) != 2 {
+		t.Fatalf("unexpected number of responses: %d", len(responses))
+	}
+	for i, rec := range responses {
+		if rec.Header.Get("WARC-Block-Digest") != Digest(rec.Content) {
+			t.Errorf("invalid block digest of response %d", i)
+		}
+		_, payload, _ := bytes.Cut(rec.Content, []byte("\r\n\r\n"))
+		if rec.Header.Get("WARC-Payload-Digest") != Digest(payload) {
+			t.Errorf("invalid payload digest of response %d", i)
+		}
+	}
+	if !bytes.HasSuffix(responses[0].Content, []byte("</html>")) || responses[0].Header.Get("WARC-Truncated") != "" {
+		t.Errorf("unexpected complete response: %q", responses[0].Content)
+	}
+	if !bytes.HasSuffix(responses[1].Content, []byte("\r\n\r\n<html><hea")) || responses[1].Header.Get("WARC-Truncated") != "unspecified" {
+		t.Errorf("unexpected truncated response: %v %q", responses[1].Header, responses[1].Content)
+	}
+}
+
+func TestWriterRotation(t *testing.T) {
+	w := &Writer{Dir: t.TempDir(), MaxFileSize: 100}
+	for i := 0; i < 3; i++ {
+		rec := NewRecord(TypeMetadata, "text/plain", bytes.Repeat([]byte("x"), 200))
+		if err := w.WriteRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	files, _ := w.Files()
+	if len(files) != 3 {
+		t.Fatalf("expected 3 files, got %d", len(files))
+	}
+	for _, path := range files {
+		records := readArchives(t, []string{path})
+		if len(records) != 2 || records[0].Type() != TypeWarcinfo || records[1].Type() != TypeMetadata {
+			t.Errorf("unexpected records in %s", path)
+		}
+	}
+}
+
+func TestReaderContentLength(t *testing.T) {
+	for _, tt := range []struct {
+		length string
+		err    error
+	}{
+		{"9000000000000000000", ErrRecordTooLarge},
+		{"1000000000", ErrInvalidRecord},
+		{"-1", ErrInvalidRecord},
+	} {
+		archive := "WARC/1.1\r\nWARC-Type: metadata\r\nContent-Length: " + tt.length + "\r\n\r\nshort\r\n\r\n"
+		r, err := NewReader(strings.NewReader(archive))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Next(); !errors.Is(err, tt.err) {
+			t.Errorf("Content-Length %s: expected %v, got %v", tt.length, tt.err, err)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	ts := newTestServer()
+	w := &Writer{Dir: t.TempDir()}
+	c := colly.NewCollector()
+	c.WithTransport(&Transport{Writer: w})
+	crawl(t, c, ts.URL)
+	w.Close()
+	ts.Close()
+
+	files, _ := w.Files()
+	c = colly.NewCollector()
+	c.IgnoreRobotsTxt = false
+	var titles []string
+	c.OnHTML("title", func(e *colly.HTMLElement) {
+		titles = append(titles, e.Text)
+	})
+	if err := Replay(c, files...); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(titles, ",") != "index,compressed" {
+		t.Errorf("unexpected titles: %v", titles)
+	}
+
+	err := c.Visit(ts.URL + "/missing")
+	if err == nil || !strings.Contains(err.Error(), ErrNotArchived.Error()) {
+		t.Errorf("expected ErrNotArchived, got %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2018 Adam Tauber
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package warc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultMaxFileSize is the default size limit of archive files
+const defaultMaxFileSize = 1 << 30
+
+// Writer writes WARC records to archive files in a directory. A new file
+// is started when the current one exceeds MaxFileSize, so files can be
+// slightly larger than the limit. Every file starts with a warcinfo
+// record. Writer is safe for concurrent use.
+type Writer struct {
+	// Dir is the directory of the archive files
+	Dir string
+	// Prefix is the file name prefix of the archive files.
+	// Defaults to "colly".
+	Prefix string
+	// MaxFileSize is the size in bytes after which a new archive file is
+	// started. Defaults to 1GB.
+	MaxFileSize int64
+	// Uncompressed disables the gzip compression of the records.
+	// Compressed records are written as separate gzip members, so the
+	// files can be read by any WARC tool and records can be accessed
+	// by their offsets.
+	Uncompressed bool
+	// Info contains the fields of the warcinfo records
+	Info Header
+	lock sync.Mutex
+	file *os.File
+	size int64
+	seq  int
+}
+
+// WriteRecord writes a record to the current archive file
+func (w *Writer) WriteRecord(r *Record) error {
+	return w.WriteRecords(r)
+}
+
+// WriteRecords writes related records, e.g. a request and its response,
+// to the same archive file
+func (w *Writer) WriteRecords(records ...*Record) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+	for _, r := range records {
+		if err := w.write(r); err != nil {
+			return err
+		}
+	}
+	maxSize := w.MaxFileSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxFileSize
+	}
+	if w.size >= maxSize {
+		return w.close()
+	}
+	return nil
+}
+
+// Close closes the current archive file
+func (w *Writer) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.close()
+}
+
+// Files returns the paths of the archive files written by w
+func (w *Writer) Files() ([]string, error) {
+	return filepath.Glob(filepath.Join(w.Dir, w.prefix()+"-*.warc*"))
+}
+
+func (w *Writer) close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+func (w *Writer) prefix() string {
+	if w.Prefix == "" {
+		return "colly"
+	}
+	return w.Prefix
+}
+
+func (w *Writer) open() error {
+	if err := os.MkdirAll(w.Dir, 0750); err != nil {
+		return err
+	}
+	w.seq++
+	name := fmt.Sprintf("%s-%s-%05d-%d.warc", w.prefix(), time.Now().UTC().Format("20060102150405"), w.seq, os.Getpid())
+	if !w.Uncompressed {
+		name += ".gz"
+	}
+	f, err := os.OpenFile(filepath.Join(w.Dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	w.file = f
+	w.size = 0
+
+	var info bytes.Buffer
+	fields := w.Info
+	if fields.Get("software") == "" {
+		fields = append(Header{{"software", "colly"}}, fields...)
+	}
+	for _, f := range fields {
+		fmt.Fprintf(&info, "%s: %s\r\n", f.Name, f.Value)
+	}
+	r := NewRecord(TypeWarcinfo, "application/warc-fields", info.Bytes())
+	r.Header.Set("WARC-Filename", name)
+	if err := w.write(r); err != nil {
+		w.close()
+		return err
+	}
+	return nil
+}
+
+func (w *Writer) write(r *Record) error {
+	var out io.Writer = w.file
+	var gw *gzip.Writer
+	if !w.Uncompressed {
+		gw = gzip.NewWriter(w.file)
+		out = gw
+	}
+	if err := writeRecord(out, r); err != nil {
+		return err
+	}
+	if gw != nil {
+		if err := gw.Close(); err != nil {
+			return err
+		}
+	}
+	info, err := w.file.Stat()
+	if err != nil {
+		return err
+	}
+	w.size = info.Size()
+	return nil
+}
+
+func writeRecord(w io.Writer, r *Record) error {
+	var buf bytes.Buffer
+	buf.WriteString(warcVersion + "\r\n")
+	for _, f := range r.Header {
+		if f.Name == "Content-Length" {
+			continue
+		}
+		fmt.Fprintf(&buf, "%s: %s\r\n", f.Name, f.Value)
+	}
+	buf.WriteString("Content-Length: " + strconv.FormatInt(int64(len(r.Content))+r.bodySize, 10) + "\r\n\r\n")
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if _, err := w.Write(r.Content); err != nil {
+		return err
+	}
+	if r.body != nil {
+		n, err := io.Copy(w, r.body)
+		if err != nil {
+			return err
+		}
+		if n != r.bodySize {
+			return io.ErrUnexpectedEOF
+		}
+	}
+	_, err := io.WriteString(w, "\r\n\r\n")
+	return err
+}